@@ -0,0 +1,262 @@
+package fastzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// NewArchiverForAppend opens an existing zip file and returns a new Archiver
+// that appends entries to it. New entries are written over the existing
+// central directory, and on Close, a central directory holding both the
+// existing and new entries is written. The existing entries' data is left in
+// place.
+//
+// Entries with the same name as an existing entry are handled according to
+// the merge policy, see WithArchiverMergePolicy. Split archives are not
+// supported.
+//
+// As well as the archive's path, the chroot that new files are archived
+// relative to is required, as with NewArchiver, so files can be appended with
+// Archive. It can be any directory if entries are only copied with CopyEntry
+// or Merge.
+//
+// Close() must be called to write the central directory and close the file.
+// If archiving fails, the file is left without a valid central directory.
+func NewArchiverForAppend(path, chroot string, opts ...ArchiverOption) (*Archiver, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	aw, err := newAppendWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	a, err := NewArchiver(aw, chroot, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// appendWriter writes entries to an existing zip file, starting at its
+// central directory.
+//
+// Like zip64Writer, the central directory is buffered when finishing, so that
+// the existing central directory records can be inserted before those written
+// by zip.Writer.
+type appendWriter struct {
+	f *os.File
+
+	// dir holds the existing central directory records, which start at offset
+	// relative to the start of the archive
+	dir     []byte
+	records uint64
+	offset  int64
+	comment []byte
+	names   map[string]struct{}
+
+	buf *bytes.Buffer
+}
+
+func newAppendWriter(f *os.File) (*appendWriter, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, err
+	}
+
+	n := size
+	if n > directoryEndLen+uint16max {
+		n = directoryEndLen + uint16max
+	}
+	b := make([]byte, n)
+	if _, err := f.ReadAt(b, size-n); err != nil {
+		return nil, err
+	}
+
+	eocd := findDirectoryEnd(b)
+	if eocd < 0 {
+		return nil, zip.ErrFormat
+	}
+	end := b[eocd:]
+
+	disk := uint64(binary.LittleEndian.Uint16(end[4:]))
+	records := uint64(binary.LittleEndian.Uint16(end[10:]))
+	dirSize := uint64(binary.LittleEndian.Uint32(end[12:]))
+	offset := uint64(binary.LittleEndian.Uint32(end[16:]))
+	dirEnd := size - n + int64(eocd)
+
+	if records == uint16max || dirSize == uint32max || offset == uint32max {
+		// the ZIP64 end record is expected to directly precede the locator
+		dirEnd -= directory64LocLen + directory64EndLen
+		if dirEnd < 0 {
+			return nil, zip.ErrFormat
+		}
+
+		var end64 [directory64EndLen]byte
+		if _, err := f.ReadAt(end64[:], dirEnd); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(end64[:]) != directory64EndSignature {
+			return nil, zip.ErrFormat
+		}
+
+		disk = uint64(binary.LittleEndian.Uint32(end64[16:]))
+		records = binary.LittleEndian.Uint64(end64[32:])
+		dirSize = binary.LittleEndian.Uint64(end64[40:])
+		offset = binary.LittleEndian.Uint64(end64[48:])
+	}
+
+	if disk != 0 {
+		return nil, zip.ErrFormat
+	}
+
+	dirStart := dirEnd - int64(dirSize)
+	if dirStart < 0 || dirSize > uint64(size) {
+		return nil, zip.ErrFormat
+	}
+
+	aw := &appendWriter{
+		f:       f,
+		dir:     make([]byte, dirSize),
+		records: records,
+		offset:  int64(offset),
+		comment: append([]byte{}, end[directoryEndLen:]...),
+		names:   make(map[string]struct{}, len(zr.File)),
+	}
+	if _, err := f.ReadAt(aw.dir, dirStart); err != nil {
+		return nil, err
+	}
+	for _, file := range zr.File {
+		aw.names[file.Name] = struct{}{}
+	}
+
+	if _, err := f.Seek(dirStart, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return aw, nil
+}
+
+func (aw *appendWriter) Write(p []byte) (int, error) {
+	if aw.buf != nil {
+		return aw.buf.Write(p)
+	}
+	return aw.f.Write(p)
+}
+
+// finish inserts the existing central directory records before the buffered
+// central directory, followed by end of central directory records covering
+// both. The file is then truncated, removing any remains of the existing
+// central directory, and closed.
+func (aw *appendWriter) finish() error {
+	b := aw.buf.Bytes()
+	aw.buf = nil
+
+	eocd := findDirectoryEnd(b)
+	if eocd < 0 {
+		return zip.ErrFormat
+	}
+
+	records := uint64(binary.LittleEndian.Uint16(b[eocd+10:]))
+	size := uint64(binary.LittleEndian.Uint32(b[eocd+12:]))
+	offset := uint64(binary.LittleEndian.Uint32(b[eocd+16:]))
+	comment := b[eocd+directoryEndLen:]
+	if len(comment) == 0 {
+		comment = aw.comment
+	}
+
+	dirEnd := eocd
+	zip64 := records == uint16max || size == uint32max || offset == uint32max
+	if zip64 {
+		dirEnd = eocd - directory64LocLen - directory64EndLen
+		if dirEnd < 0 || binary.LittleEndian.Uint32(b[dirEnd:]) != directory64EndSignature {
+			return zip.ErrFormat
+		}
+		records = binary.LittleEndian.Uint64(b[dirEnd+32:])
+		size = binary.LittleEndian.Uint64(b[dirEnd+40:])
+		offset = binary.LittleEndian.Uint64(b[dirEnd+48:])
+	}
+
+	dirStart := dirEnd - int(size)
+	if dirStart < 0 {
+		return zip.ErrFormat
+	}
+
+	records += aw.records
+	size += uint64(len(aw.dir))
+	zip64 = zip64 || records >= uint16max || size >= uint32max || offset >= uint32max
+
+	out := bytes.NewBuffer(make([]byte, 0, len(b)+len(aw.dir)+directory64EndLen+directory64LocLen))
+	out.Write(b[:dirStart])
+	out.Write(aw.dir)
+	out.Write(b[dirStart:dirEnd])
+
+	var eocdRecord [directoryEndLen]byte
+	binary.LittleEndian.PutUint32(eocdRecord[0:], directoryEndSignature)
+	binary.LittleEndian.PutUint16(eocdRecord[20:], uint16(len(comment)))
+
+	if zip64 {
+		var records64 [directory64EndLen + directory64LocLen]byte
+		r := records64[:]
+		binary.LittleEndian.PutUint32(r[0:], directory64EndSignature)
+		binary.LittleEndian.PutUint64(r[4:], directory64EndLen-12)
+		binary.LittleEndian.PutUint16(r[12:], zipVersion45)
+		binary.LittleEndian.PutUint16(r[14:], zipVersion45)
+		binary.LittleEndian.PutUint64(r[24:], records)
+		binary.LittleEndian.PutUint64(r[32:], records)
+		binary.LittleEndian.PutUint64(r[40:], size)
+		binary.LittleEndian.PutUint64(r[48:], offset)
+
+		r = r[directory64EndLen:]
+		binary.LittleEndian.PutUint32(r[0:], directory64LocSignature)
+		binary.LittleEndian.PutUint64(r[8:], offset+size)
+		binary.LittleEndian.PutUint32(r[16:], 1)
+		out.Write(records64[:])
+
+		binary.LittleEndian.PutUint16(eocdRecord[8:], uint16max)
+		binary.LittleEndian.PutUint16(eocdRecord[10:], uint16max)
+		binary.LittleEndian.PutUint32(eocdRecord[12:], uint32max)
+		binary.LittleEndian.PutUint32(eocdRecord[16:], uint32max)
+	} else {
+		binary.LittleEndian.PutUint16(eocdRecord[8:], uint16(records))
+		binary.LittleEndian.PutUint16(eocdRecord[10:], uint16(records))
+		binary.LittleEndian.PutUint32(eocdRecord[12:], uint32(size))
+		binary.LittleEndian.PutUint32(eocdRecord[16:], uint32(offset))
+	}
+	out.Write(eocdRecord[:])
+	out.Write(comment)
+
+	if _, err := out.WriteTo(aw.f); err != nil {
+		aw.f.Close()
+		return err
+	}
+
+	return aw.close()
+}
+
+// close truncates the file at the current position and closes it.
+func (aw *appendWriter) close() error {
+	pos, err := aw.f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = aw.f.Truncate(pos)
+	}
+	if cerr := aw.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -2,10 +2,14 @@ package fastzip
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -15,6 +19,7 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/zip"
 	"github.com/klauspost/compress/zstd"
 	"github.com/saracen/fastzip/internal/filepool"
@@ -24,16 +29,9 @@ import (
 
 const irregularModes = os.ModeSocket | os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe
 
-var bufioReaderPool = sync.Pool{
-	New: func() interface{} {
-		return bufio.NewReaderSize(nil, 32*1024)
-	},
-}
-
-var (
-	defaultCompressor     = FlateCompressor(-1)
-	defaultZstdCompressor = ZstdCompressor(int(zstd.SpeedDefault))
-)
+// defaultBufioSize is the default size of the buffers used to read files when
+// archiving, and to write files when extracting.
+const defaultBufioSize = 32 * 1024
 
 // Archiver is an opinionated Zip archiver.
 //
@@ -42,16 +40,35 @@ var (
 //
 // Access permissions, ownership (unix) and modification times are preserved.
 type Archiver struct {
-	// This 2 fields are accessed via atomic operations
+	// This 5 fields are accessed via atomic operations
 	// They are at the start of the struct so they are properly 8 byte aligned
-	written, entries int64
+	written, entries, total int64
+	spillCount, spillBytes  int64
 
 	zw      *zip.Writer
+	zip64   *zip64Writer
+	span    *spanWriter
+	app     *appendWriter
+	rl      *rateLimitWriter
 	options archiverOptions
 	chroot  string
 	m       sync.Mutex
 
 	compressors map[uint16]zip.Compressor
+	digests     map[string][]byte
+
+	// readers is the pool of buffered readers files are read with
+	readers *sync.Pool
+
+	// blocks are the buffers large files are compressed in parallel with
+	blocks chan *parallelBlock
+
+	// levels caches the compressors of levels chosen by the level function
+	levels  sync.Map
+	methods map[string]uint16
+
+	// prefixed indicates whether the prefix directories have been written
+	prefixed bool
 }
 
 // NewArchiver returns a new Archiver.
@@ -70,6 +87,11 @@ func NewArchiver(w io.Writer, chroot string, opts ...ArchiverOption) (*Archiver,
 	a.options.concurrency = runtime.GOMAXPROCS(0)
 	a.options.stageDir = chroot
 	a.options.bufferSize = -1
+	a.options.smallThreshold = defaultSmallArchiveThreshold
+	a.options.readBufferSize = defaultBufioSize
+	a.options.storeDOSAttrs = dosAttributesSupported
+	a.options.storeDirs = true
+	a.options.storeOwnership = true
 	for _, o := range opts {
 		err := o(&a.options)
 		if err != nil {
@@ -77,279 +99,1698 @@ func NewArchiver(w io.Writer, chroot string, opts ...ArchiverOption) (*Archiver,
 		}
 	}
 
-	a.zw = zip.NewWriter(w)
-	a.zw.SetOffset(a.options.offset)
+	// readers are pooled per archiver, as they're sized by its options
+	a.readers = &sync.Pool{
+		New: func() interface{} {
+			return bufio.NewReaderSize(nil, a.options.readBufferSize)
+		},
+	}
+
+	if a.options.noStaging {
+		if a.options.largeFileParallel || a.options.memStaging || a.options.maxStageFiles > 0 {
+			return nil, ErrStagingRequired
+		}
+		a.options.concurrency = 1
+	}
+
+	if a.options.largeFileParallel && a.options.concurrency > 1 {
+		a.blocks = make(chan *parallelBlock, a.options.concurrency)
+		for i := 0; i < a.options.concurrency; i++ {
+			a.blocks <- &parallelBlock{}
+		}
+	}
+
+	if a.options.stageDir != chroot {
+		if err := a.checkStageDir(a.options.stageDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.seekOffset(w); err != nil {
+		return nil, err
+	}
+
+	a.newZipWriter(w)
 
 	// register flate compressor
-	a.RegisterCompressor(zip.Deflate, defaultCompressor)
-	a.RegisterCompressor(zstd.ZipMethodWinZip, defaultZstdCompressor)
+	a.RegisterCompressor(zip.Deflate, FlateCompressor(-1))
+	a.RegisterCompressor(zstd.ZipMethodWinZip, ZstdCompressor(int(zstd.SpeedDefault)))
 
 	return a, nil
 }
 
+// logf logs a debug message with the logger, if set.
+func (a *Archiver) logf(format string, args ...interface{}) {
+	if a.options.logger != nil {
+		a.options.logger(format, args...)
+	}
+}
+
+// skip records that a file is skipped, logging why and calling the skip
+// handler, if set.
+func (a *Archiver) skip(name string, fi os.FileInfo, format string, args ...interface{}) {
+	a.logf(format, args...)
+	atomic.AddInt64(&a.total, -1)
+
+	if a.options.skipHandler != nil {
+		a.options.skipHandler(name, fi)
+	}
+}
+
+// checkStageDir checks that files can be created in the stage directory, if
+// it's to be used, so that an unwritable directory is reported up front rather
+// than when a file first exceeds the staging buffer mid-archive. It's only
+// called for stage directories set with WithStageDirectory, as the chroot
+// being archived is often read-only and may never need staging.
+func (a *Archiver) checkStageDir(dir string) error {
+	if a.options.concurrency <= 1 || a.options.memStaging {
+		return nil
+	}
+
+	f, err := os.CreateTemp(dir, "fastzip_preflight_")
+	if err != nil {
+		return fmt.Errorf("stage directory is not writable: %w", err)
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// Reset rebinds the Archiver to a new writer and chroot, keeping the options
+// and registered compressors, and resets the written, entries and staging
+// counters. If the stage directory was not set, it follows the new chroot.
+//
+// Close should be called before Reset to finish the previous archive. Reset
+// must not be called concurrently with Archive.
+func (a *Archiver) Reset(w io.Writer, chroot string) error {
+	chroot, err := filepath.Abs(chroot)
+	if err != nil {
+		return err
+	}
+
+	stageDir := a.options.stageDir
+	if stageDir == a.chroot {
+		stageDir = chroot
+	} else if err := a.checkStageDir(stageDir); err != nil {
+		return err
+	}
+	if err := a.seekOffset(w); err != nil {
+		return err
+	}
+	a.options.stageDir = stageDir
+	a.chroot = chroot
+
+	atomic.StoreInt64(&a.written, 0)
+	atomic.StoreInt64(&a.entries, 0)
+	atomic.StoreInt64(&a.total, 0)
+	atomic.StoreInt64(&a.spillCount, 0)
+	atomic.StoreInt64(&a.spillBytes, 0)
+	a.digests = nil
+	a.methods = nil
+	a.prefixed = false
+
+	a.newZipWriter(w)
+	for method, comp := range a.compressors {
+		a.zw.RegisterCompressor(method, comp)
+	}
+
+	return nil
+}
+
 // RegisterCompressor registers custom compressors for a specified method ID.
 // The common methods Store and Deflate are built in.
+//
+// RegisterCompressor must be called before Archive. Registering a compressor
+// for a method that already has one replaces it, including the built in
+// compressors.
 func (a *Archiver) RegisterCompressor(method uint16, comp zip.Compressor) {
 	a.zw.RegisterCompressor(method, comp)
 	a.compressors[method] = comp
 }
 
-// Close closes the underlying ZipWriter.
-func (a *Archiver) Close() error {
-	return a.zw.Close()
+// CompressionMethod returns the default compression method used for files.
+func (a *Archiver) CompressionMethod() uint16 {
+	return a.options.method
 }
 
-// Written returns how many bytes and entries have been written to the archive.
-// Written can be called whilst archiving is in progress.
-func (a *Archiver) Written() (bytes, entries int64) {
-	return atomic.LoadInt64(&a.written), atomic.LoadInt64(&a.entries)
+// Chroot returns the absolute path of the directory files are archived
+// relative to.
+func (a *Archiver) Chroot() string {
+	return a.chroot
 }
 
-// Archive archives all files, symlinks and directories.
-func (a *Archiver) Archive(ctx context.Context, files map[string]os.FileInfo) (err error) {
-	names := make([]string, 0, len(files))
-	for name := range files {
-		names = append(names, name)
-	}
-	sort.Strings(names)
+// Concurrency returns the maximum number of files compressed concurrently.
+func (a *Archiver) Concurrency() int {
+	return a.options.concurrency
+}
 
-	var fp *filepool.FilePool
+// Offset returns the offset of the beginning of the zip data.
+func (a *Archiver) Offset() int64 {
+	return a.options.offset
+}
 
-	concurrency := a.options.concurrency
-	if len(files) < concurrency {
-		concurrency = len(files)
+// RegisteredMethods returns the sorted method IDs that a compressor is
+// registered for, including Store.
+func (a *Archiver) RegisteredMethods() []uint16 {
+	methods := make([]uint16, 0, len(a.compressors)+1)
+	if _, ok := a.compressors[zip.Store]; !ok {
+		methods = append(methods, zip.Store)
 	}
-	if concurrency > 1 {
-		fp, err = filepool.New(a.options.stageDir, concurrency, a.options.bufferSize)
-		if err != nil {
-			return err
-		}
-		defer dclose(fp, &err)
+	for method := range a.compressors {
+		methods = append(methods, method)
 	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i] < methods[j] })
 
-	wg, ctx := errgroup.WithContext(ctx)
-	defer func() {
-		if werr := wg.Wait(); werr != nil {
-			err = werr
-		}
-	}()
-
-	hdrs := make([]zip.FileHeader, len(names))
-
-	for i, name := range names {
-		fi := files[name]
-		if fi.Mode()&irregularModes != 0 {
-			continue
-		}
+	return methods
+}
 
-		path, err := filepath.Abs(name)
-		if err != nil {
-			return err
-		}
+// seekOffset seeks the writer to the offset of the beginning of the zip data,
+// if an offset is set and the writer is seekable. Writers that implement
+// io.Seeker but can't seek, such as pipes, are left as they are.
+func (a *Archiver) seekOffset(w io.Writer) error {
+	s, ok := w.(io.Seeker)
+	if !ok || a.options.offset <= 0 {
+		return nil
+	}
 
-		if !strings.HasPrefix(path, a.chroot+string(filepath.Separator)) && path != a.chroot {
-			return fmt.Errorf("%s cannot be archived from outside of chroot (%s)", name, a.chroot)
-		}
+	if _, err := s.Seek(0, io.SeekCurrent); err != nil {
+		return nil
+	}
 
-		rel, err := filepath.Rel(a.chroot, path)
-		if err != nil {
-			return err
-		}
+	_, err := s.Seek(a.options.offset, io.SeekStart)
+	return err
+}
 
-		hdr := &hdrs[i]
-		fileInfoHeader(rel, fi, hdr)
+func (a *Archiver) newZipWriter(w io.Writer) {
+	offset := a.options.offset
+	a.span, _ = w.(*spanWriter)
+	if a.span != nil {
+		offset = spanSignatureLen
+	}
+	a.app, _ = w.(*appendWriter)
+	if a.app != nil {
+		offset = a.app.offset
+	}
 
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
+	a.rl = nil
+	if a.options.rateLimit > 0 {
+		a.rl = &rateLimitWriter{w: w, l: newRateLimiter(a.options.rateLimit), ctx: context.Background()}
+		w = a.rl
+	}
 
-		switch {
-		case hdr.Mode()&os.ModeSymlink != 0:
-			err = a.createSymlink(path, fi, hdr)
+	a.zip64 = nil
+	if a.options.forceZip64 {
+		a.zip64 = &zip64Writer{w: w}
+		w = a.zip64
+	}
 
-		case hdr.Mode().IsDir():
-			err = a.createDirectory(fi, hdr)
+	a.zw = zip.NewWriter(w)
+	a.zw.SetOffset(offset)
+}
 
-		default:
-			if hdr.UncompressedSize64 > 0 {
-				hdr.Method = a.options.method
-			}
+// Close closes the underlying ZipWriter. For split archives, the parts are
+// also closed.
+func (a *Archiver) Close() error {
+	if a.zip64 == nil && a.span == nil && a.app == nil {
+		return a.zw.Close()
+	}
 
-			if fp == nil {
-				err = a.createFile(ctx, path, fi, hdr, nil)
-				incOnSuccess(&a.entries, err)
-			} else {
-				f := fp.Get()
-				wg.Go(func() error {
-					err := a.createFile(ctx, path, fi, hdr, f)
-					fp.Put(f)
-					incOnSuccess(&a.entries, err)
-					return err
-				})
-			}
-		}
+	// the central directory is buffered, so that it can be rewritten
+	if err := a.zw.Flush(); err != nil {
+		return err
+	}
+	if a.zip64 != nil {
+		a.zip64.buf = new(bytes.Buffer)
+	}
+	if a.span != nil {
+		a.span.buf = new(bytes.Buffer)
+	}
+	if a.app != nil {
+		a.app.buf = new(bytes.Buffer)
+	}
+	if err := a.zw.Close(); err != nil {
+		return err
+	}
 
-		if err != nil {
+	if a.zip64 != nil {
+		if err := a.zip64.finish(); err != nil {
 			return err
 		}
 	}
-
-	return wg.Wait()
+	if a.span != nil {
+		return a.span.finish()
+	}
+	if a.app != nil {
+		return a.app.finish()
+	}
+	return nil
 }
 
-func fileInfoHeader(name string, fi os.FileInfo, hdr *zip.FileHeader) {
-	hdr.Name = filepath.ToSlash(name)
-	hdr.UncompressedSize64 = uint64(fi.Size())
-	hdr.Modified = fi.ModTime()
-	hdr.SetMode(fi.Mode())
+// Written returns how many bytes and entries have been written to the archive.
+// Written can be called whilst archiving is in progress.
+func (a *Archiver) Written() (bytes, entries int64) {
+	return atomic.LoadInt64(&a.written), atomic.LoadInt64(&a.entries)
+}
 
-	if hdr.Mode().IsDir() {
-		hdr.Name += "/"
+// Progress returns a snapshot of the archiving progress. EntriesTotal is the
+// number of files provided to Archive, excluding any that are skipped.
+// Progress can be called whilst archiving is in progress.
+func (a *Archiver) Progress() Progress {
+	return Progress{
+		BytesWritten: atomic.LoadInt64(&a.written),
+		EntriesDone:  atomic.LoadInt64(&a.entries),
+		EntriesTotal: atomic.LoadInt64(&a.total),
 	}
+}
 
-	const uint32max = (1 << 32) - 1
-	if hdr.UncompressedSize64 > uint32max {
-		hdr.UncompressedSize = uint32max
-	} else {
-		hdr.UncompressedSize = uint32(hdr.UncompressedSize64)
+// StagingStats reports how often data staged for concurrent compression
+// exceeded the staging buffer.
+type StagingStats struct {
+	// SpillCount is the number of files whose compressed data exceeded the
+	// buffer size.
+	SpillCount int64
+
+	// SpillBytes is the total number of bytes that exceeded the buffer size,
+	// written to the stage directory or, with in-memory staging, held in
+	// memory.
+	SpillBytes int64
+}
+
+// StagingStats returns the staging statistics of all completed Archive calls.
+// These can be used to pick a buffer size suited to a workload.
+func (a *Archiver) StagingStats() StagingStats {
+	return StagingStats{
+		SpillCount: atomic.LoadInt64(&a.spillCount),
+		SpillBytes: atomic.LoadInt64(&a.spillBytes),
 	}
 }
 
-func (a *Archiver) createDirectory(fi os.FileInfo, hdr *zip.FileHeader) error {
+// Digests returns the digest of the uncompressed data of each regular file
+// archived, keyed by entry name, when enabled with WithArchiverDigest.
+func (a *Archiver) Digests() map[string][]byte {
 	a.m.Lock()
 	defer a.m.Unlock()
 
-	_, err := a.createHeader(fi, hdr)
-	incOnSuccess(&a.entries, err)
-	return err
+	digests := make(map[string][]byte, len(a.digests))
+	for name, sum := range a.digests {
+		digests[name] = sum
+	}
+	return digests
 }
 
-func (a *Archiver) createSymlink(path string, fi os.FileInfo, hdr *zip.FileHeader) error {
+// EntryMethods returns the compression method each regular file archived was
+// written with, keyed by entry name. Files are stored, rather than compressed,
+// when compression wouldn't reduce their size or the incompressible heuristic
+// matched.
+func (a *Archiver) EntryMethods() map[string]uint16 {
 	a.m.Lock()
 	defer a.m.Unlock()
 
-	w, err := a.createHeader(fi, hdr)
-	if err != nil {
-		return err
+	methods := make(map[string]uint16, len(a.methods))
+	for name, method := range a.methods {
+		methods[name] = method
 	}
+	return methods
+}
 
-	link, err := os.Readlink(path)
-	if err != nil {
-		return err
+// ArchivePaths archives the files, symlinks and directories at the paths
+// provided. Each path is read with os.Lstat, so symlinks are archived as
+// symlinks, subject to the symlink mode, rather than followed. Directories are
+// not recursed into.
+func (a *Archiver) ArchivePaths(ctx context.Context, paths []string) error {
+	files := make(map[string]os.FileInfo, len(paths))
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		files[path] = fi
 	}
 
-	_, err = io.WriteString(w, link)
-	incOnSuccess(&a.entries, err)
-	return err
+	return a.Archive(ctx, files)
 }
 
-func (a *Archiver) createFile(ctx context.Context, path string, fi os.FileInfo, hdr *zip.FileHeader, tmp *filepool.File) error {
-	f, err := os.Open(path)
+// CopyEntry copies an entry from another archive without recompressing it.
+// The entry's compressed data, CRC, sizes and metadata are copied as is. When
+// appending, an entry with the same name as an entry already in the archive is
+// handled according to the merge policy.
+func (a *Archiver) CopyEntry(ctx context.Context, src *zip.File) error {
+	if a.app == nil {
+		return a.copyEntry(ctx, src, src.Name)
+	}
+
+	hdr := src.FileHeader
+	ok, err := a.appendName(&hdr)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if !ok {
+		a.logf("skipping %s, already in archive", hdr.Name)
+		return nil
+	}
 
-	return a.compressFile(ctx, f, fi, hdr, tmp)
+	return a.copyEntry(ctx, src, hdr.Name)
 }
 
-// compressFile pre-compresses the file first to a file from the filepool,
-// making use of zip.CreateRaw. This allows for concurrent files to be
-// compressed and then added to the zip file when ready.
-// If no filepool file is available (when using a concurrency of 1) or the
-// compressed file is larger than the uncompressed version, the file is moved
-// to the zip file using the conventional zip.CreateHeader.
-func (a *Archiver) compressFile(ctx context.Context, f *os.File, fi os.FileInfo, hdr *zip.FileHeader, tmp *filepool.File) error {
-	comp, ok := a.compressors[hdr.Method]
-	// if we don't have the registered compressor, it most likely means Store is
-	// being used, so we revert to non-concurrent behaviour
-	if !ok || tmp == nil {
-		return a.compressFileSimple(ctx, f, fi, hdr)
+// Merge copies the entries of the archives provided, in order, without
+// recompressing them. Entries with the same name as an entry already merged
+// are handled according to the merge policy.
+func (a *Archiver) Merge(ctx context.Context, extractors ...*Extractor) error {
+	names := make(map[string]struct{})
+	if a.app != nil {
+		names = a.app.names
 	}
+	for _, e := range extractors {
+		for _, file := range e.Files() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 
-	fw, err := comp(tmp)
-	if err != nil {
-		return err
+			name := file.Name
+			if _, ok := names[name]; ok {
+				if file.Mode().IsDir() {
+					continue
+				}
+
+				switch a.options.mergePolicy {
+				case MergeSkip:
+					continue
+
+				case MergeRename:
+					name = renameEntry(name, names)
+
+				default:
+					return fmt.Errorf("%s: %w", name, ErrDuplicateName)
+				}
+			}
+			names[name] = struct{}{}
+
+			if err := a.copyEntry(ctx, file, name); err != nil {
+				return err
+			}
+		}
 	}
 
-	br := bufioReaderPool.Get().(*bufio.Reader)
-	defer bufioReaderPool.Put(br)
-	br.Reset(f)
+	return nil
+}
 
-	_, err = io.Copy(io.MultiWriter(fw, tmp.Hasher()), br)
-	dclose(fw, &err)
-	if err != nil {
-		return err
+// appendName applies the merge policy to an entry with the same name as an
+// entry already in the archive being appended to, returning false if the entry
+// is to be skipped. Directory entries with the same name are always skipped.
+func (a *Archiver) appendName(hdr *zip.FileHeader) (bool, error) {
+	names := a.app.names
+	if _, ok := names[hdr.Name]; ok {
+		if hdr.Mode().IsDir() {
+			return false, nil
+		}
+
+		switch a.options.mergePolicy {
+		case MergeSkip:
+			return false, nil
+
+		case MergeRename:
+			hdr.Name = renameEntry(hdr.Name, names)
+
+		default:
+			return false, fmt.Errorf("%s: %w", hdr.Name, ErrDuplicateName)
+		}
 	}
+	names[hdr.Name] = struct{}{}
 
-	hdr.CompressedSize64 = tmp.Written()
-	// if compressed file is larger, use the uncompressed version.
-	if hdr.CompressedSize64 > hdr.UncompressedSize64 {
-		f.Seek(0, io.SeekStart)
-		hdr.Method = zip.Store
-		return a.compressFileSimple(ctx, f, fi, hdr)
+	return true, nil
+}
+
+// renameEntry returns a name not in names, by adding a numeric suffix before
+// the extension of the name's base name.
+func renameEntry(name string, names map[string]struct{}) string {
+	ext := path.Ext(name)
+	stem := name[:len(name)-len(ext)]
+	if stem == "" || strings.HasSuffix(stem, "/") {
+		// names such as ".profile" have no extension
+		stem, ext = name, ""
 	}
-	hdr.CRC32 = tmp.Checksum()
 
-	a.m.Lock()
-	defer a.m.Unlock()
+	for i := 1; ; i++ {
+		renamed := fmt.Sprintf("%s_%d%s", stem, i, ext)
+		if _, ok := names[renamed]; !ok {
+			return renamed
+		}
+	}
+}
+
+func (a *Archiver) copyEntry(ctx context.Context, src *zip.File, name string) (err error) {
+	atomic.AddInt64(&a.total, 1)
+	defer func() { incOnSuccess(&a.entries, err) }()
 
-	w, err := a.createHeaderRaw(fi, hdr)
+	r, err := src.OpenRaw()
 	if err != nil {
 		return err
 	}
 
-	br.Reset(tmp)
-	_, err = br.WriteTo(countWriter{w, &a.written, ctx})
-	return err
-}
-
-// compressFileSimple uses the conventional zip.createHeader. This differs from
-// compressFile as it locks the zip _whilst_ compressing (if the method is not
-// Store).
-func (a *Archiver) compressFileSimple(ctx context.Context, f *os.File, fi os.FileInfo, hdr *zip.FileHeader) error {
-	br := bufioReaderPool.Get().(*bufio.Reader)
-	defer bufioReaderPool.Put(br)
-	br.Reset(f)
+	// the ZIP64 extra field is written by the zip writer, and the extended
+	// timestamp and Unicode Path extra fields by createHeaderRaw
+	hdr := src.FileHeader
+	hdr.Name = name
+	hdr.Extra = removeExtraFields(src.Extra, zip64ExtraID, zipextra.ExtraFieldExtTime, extraFieldUnicodePath)
 
 	a.m.Lock()
 	defer a.m.Unlock()
 
-	w, err := a.createHeader(fi, hdr)
+	w, err := a.createHeaderRaw(src.FileInfo(), &hdr, false)
 	if err != nil {
 		return err
 	}
 
-	_, err = br.WriteTo(countWriter{w, &a.written, ctx})
+	_, err = io.Copy(countWriter{w, &a.written, ctx}, r)
 	return err
 }
 
-func (a *Archiver) createHeaderRaw(fi os.FileInfo, fh *zip.FileHeader) (io.Writer, error) {
-	// When the standard Go library's version of CreateRaw was added, rather
-	// than solely focus on custom compression in "raw" mode, it also removed
-	// the convenience of setting up common zip flags and timestamp logic. This
-	// here replicates what CreateHeader() does:
-	// https://github.com/golang/go/blob/go1.17/src/archive/zip/writer.go#L271
-	const zipVersion20 = 20
+// WalkDir walks the file tree rooted at root, returning the root and all of its
+// descendants in the form expected by Archive. Files are read with os.Lstat
+// semantics, so symlinks, including those to directories, are returned as
+// symlinks and not recursed into.
+func WalkDir(root string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		files[path] = fi
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	utf8Valid1, utf8Require1 := detectUTF8(fh.Name)
-	utf8Valid2, utf8Require2 := detectUTF8(fh.Comment)
-	switch {
-	case fh.NonUTF8:
-		fh.Flags &^= 0x800
-	case (utf8Require1 || utf8Require2) && (utf8Valid1 && utf8Valid2):
-		fh.Flags |= 0x800
+	return files, nil
+}
+
+// Archive archives all files, symlinks and directories. Files are compressed
+// concurrently, but entries are always written in name order, or the order
+// set by WithArchiverSort.
+func (a *Archiver) Archive(ctx context.Context, files map[string]os.FileInfo) (err error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if less := a.options.less; less != nil {
+		sort.SliceStable(names, func(i, j int) bool { return less(names[i], names[j]) })
 	}
 
-	fh.CreatorVersion = fh.CreatorVersion&0xff00 | zipVersion20
-	fh.ReaderVersion = zipVersion20
+	atomic.AddInt64(&a.total, int64(len(names)))
 
-	if !fh.Modified.IsZero() {
-		fh.ModifiedDate, fh.ModifiedTime = timeToMsDosTime(fh.Modified)
-		fh.Extra = append(fh.Extra, zipextra.NewExtendedTimestamp(fh.Modified).Encode()...)
+	// ctx is canceled if archiving fails, so that entries already queued to
+	// workers aren't written after the error is returned
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// rate limited writes stop waiting if ctx is canceled
+	if a.rl != nil {
+		a.rl.ctx = ctx
+		defer func() { a.rl.ctx = context.Background() }()
 	}
 
-	fh.Flags |= 0x8
+	var fp *filepool.FilePool
+
+	concurrency := a.options.concurrency
+	if len(files) < concurrency {
+		concurrency = len(files)
+	}
+	if concurrency > 1 {
+		bufferSize := a.smallBufferSize(files, a.bufferSize(concurrency))
+		switch {
+		case a.options.memStaging:
+			fp, err = filepool.NewMemory(concurrency, bufferSize)
+		case a.options.maxStageFiles > 0:
+			fp, err = filepool.NewShared(a.options.stageDir, concurrency, bufferSize, a.options.maxStageFiles)
+		default:
+			fp, err = filepool.New(a.options.stageDir, concurrency, bufferSize)
+		}
+		if err != nil {
+			return err
+		}
+		defer dclose(fp, &err)
+		defer func() {
+			atomic.AddInt64(&a.spillCount, fp.SpillCount())
+			atomic.AddInt64(&a.spillBytes, fp.SpillBytes())
+		}()
+	}
+
+	if a.options.prefix != "" && a.options.storeDirs && !a.prefixed {
+		if err := a.createPrefixDirectories(); err != nil {
+			return err
+		}
+	}
+
+	// entries are prepared in name order and queued to workers, which pull
+	// the next entry as soon as they're free, so that large files don't hold
+	// up the compression of small files. Each entry is written to the archive
+	// only once the entry before it has been, keeping the archive's order
+	// deterministic.
+	queue := make(chan *archiveEntry)
+	wg, ctx := errgroup.WithContext(ctx)
+	defer func() {
+		// an error that wasn't caused by a worker failing, or ctx being
+		// canceled, stops the workers, and is returned rather than the
+		// cancellation errors they return
+		failed := err != nil && ctx.Err() == nil
+		if failed {
+			cancel()
+		}
+
+		close(queue)
+		if werr := wg.Wait(); werr != nil && !failed {
+			err = werr
+		}
+	}()
+
+	if fp != nil {
+		for i := 0; i < concurrency; i++ {
+			wg.Go(func() error {
+				return a.worker(ctx, fp, queue)
+			})
+		}
+	}
+	turn := newTurn()
+
+	hdrs := make([]zip.FileHeader, len(names))
+	links := make(map[fileID]string)
+
+	// archived holds the names archived, and whether they're directories
+	archived := make(map[string]bool)
+
+	for i, name := range names {
+		fi := files[name]
+		if fi.Mode()&irregularModes != 0 && !a.options.irregular {
+			a.skip(name, fi, "skipping irregular file %s", name)
+			continue
+		}
+
+		path, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+
+		if !within(a.chroot, path) {
+			return fmt.Errorf("%s cannot be archived from outside of chroot (%s)", name, a.chroot)
+		}
+
+		rel, err := filepath.Rel(a.chroot, path)
+		if err != nil {
+			return err
+		}
+
+		// filepath.Rel returns "." for the chroot itself, which would
+		// otherwise be archived as "./", or with a prefix, is archived as the
+		// prefix directory
+		if rel == "." && (a.options.omitRootDir || a.options.prefix != "") {
+			atomic.AddInt64(&a.total, -1)
+			continue
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			switch a.options.symlinkMode {
+			case SymlinkSkip:
+				a.skip(name, fi, "skipping symlink %s", name)
+				continue
+
+			case SymlinkDereference:
+				if path, fi, err = a.dereference(name, path); err != nil {
+					return err
+				}
+				if fi.Mode()&irregularModes != 0 && !a.options.irregular {
+					a.skip(name, files[name], "skipping symlink %s to irregular file", name)
+					continue
+				}
+			}
+		}
+
+		if fi.IsDir() && !a.options.storeDirs {
+			atomic.AddInt64(&a.total, -1)
+			continue
+		}
+
+		if max := a.options.maxFileSize; max > 0 && fi.Mode().IsRegular() && fi.Size() > max {
+			if !a.options.skipOversized {
+				return fmt.Errorf("%s: %w", name, ErrMaxFileSize)
+			}
+			a.skip(name, fi, "skipping file %s, size %d exceeds maximum %d", name, fi.Size(), max)
+			continue
+		}
+
+		hdr := &hdrs[i]
+		if err := fileInfoHeader(a.options.prefix, rel, fi, hdr); err != nil {
+			return err
+		}
+		a.normalizeName(hdr)
+
+		if a.app != nil {
+			ok, err := a.appendName(hdr)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				a.skip(name, fi, "skipping %s, already in archive", hdr.Name)
+				continue
+			}
+		}
+
+		if err := a.checkDuplicate(hdr, archived); err != nil {
+			return err
+		}
+
+		if a.options.storeXattrs {
+			if err := storeXattrs(path, hdr); err != nil {
+				return err
+			}
+		}
+
+		// both options are stored in the NTFS extra field, which holds the
+		// creation time alongside the other times
+		if a.options.storeNTFSTimes {
+			storeNTFSTimes(fi, hdr)
+		} else if a.options.storeCreationTime {
+			storeCreationTime(fi, hdr)
+		}
+
+		if a.options.preciseModTime {
+			hdr.Extra = append(hdr.Extra, encodeModTime(fi.ModTime())...)
+		}
+
+		if a.options.storeDOSAttrs {
+			if attrs, ok := dosAttributes(fi); ok {
+				hdr.ExternalAttrs |= uint32(attrs)
+			}
+		}
+
+		if a.options.storeFileFlags {
+			if flags, ok := fileFlags(fi); ok {
+				hdr.Extra = append(hdr.Extra, encodeFileFlags(flags)...)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var target string
+		if a.options.hardLinks && fi.Mode().IsRegular() {
+			if id, ok := getFileID(fi); ok {
+				if target, ok = links[id]; !ok {
+					links[id] = hdr.Name
+				}
+			}
+		}
+
+		entry := &archiveEntry{path: path, fi: fi, hdr: hdr, target: target}
+		if fp == nil {
+			if err := a.createEntry(ctx, entry, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		entry.turn, turn = turn, turn.next()
+
+		select {
+		case queue <- entry:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// archiveEntry is an entry queued to be written to the archive.
+type archiveEntry struct {
+	path   string
+	fi     os.FileInfo
+	hdr    *zip.FileHeader
+	target string
+	turn   entryTurn
+}
+
+// entryTurn orders the writing of entries to the archive. An entry can be
+// written once prev is closed, and closes done once it has been written.
+type entryTurn struct {
+	prev <-chan struct{}
+	done chan struct{}
+}
+
+// newTurn returns the turn of the first entry, which can be written
+// immediately.
+func newTurn() entryTurn {
+	prev := make(chan struct{})
+	close(prev)
+	return entryTurn{prev: prev, done: make(chan struct{})}
+}
+
+// next returns the turn of the entry that follows.
+func (t entryTurn) next() entryTurn {
+	return entryTurn{prev: t.done, done: make(chan struct{})}
+}
+
+// wait blocks until it's the entry's turn to be written, or ctx is canceled.
+// A zero entryTurn never blocks.
+func (t entryTurn) wait(ctx context.Context) error {
+	if t.prev == nil {
+		return nil
+	}
+
+	select {
+	case <-t.prev:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// worker archives entries from the queue until it's closed. An entry's turn
+// is only passed to the next entry if it was archived successfully, otherwise
+// the error cancels ctx, stopping the entries waiting for their turn.
+func (a *Archiver) worker(ctx context.Context, fp *filepool.FilePool, queue <-chan *archiveEntry) error {
+	for entry := range queue {
+		f := fp.Get()
+		err := a.createEntry(ctx, entry, f)
+		fp.Put(f)
+		if err != nil {
+			return err
+		}
+		close(entry.turn.done)
+	}
+	return nil
+}
+
+// createEntry writes an entry to the archive. Regular files are compressed,
+// staged to tmp if provided, before waiting for the entry's turn, whereas
+// other entries wait for their turn first.
+func (a *Archiver) createEntry(ctx context.Context, entry *archiveEntry, tmp *filepool.File) error {
+	path, fi, hdr := entry.path, entry.fi, entry.hdr
+
+	if hdr.Mode().IsRegular() && entry.target == "" {
+		if hdr.UncompressedSize64 > 0 {
+			hdr.Method = a.method(path, fi)
+		}
+
+		err := a.createFile(ctx, path, fi, hdr, tmp, entry.turn)
+		incOnSuccess(&a.entries, err)
+		return err
+	}
+
+	if err := entry.turn.wait(ctx); err != nil {
+		return err
+	}
+
+	switch {
+	case hdr.Mode()&os.ModeSymlink != 0:
+		return a.createSymlink(path, fi, hdr)
+
+	case hdr.Mode().IsDir():
+		return a.createDirectory(fi, hdr)
+
+	case entry.target != "":
+		a.logf("archiving %s as a hard link to %s", hdr.Name, entry.target)
+		return a.createHardlink(fi, hdr, entry.target)
+
+	default:
+		return a.createIrregular(fi, hdr)
+	}
+}
+
+// within returns whether path is root or a descendant of root.
+func within(root, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// dereference resolves a symlink, returning the path and file info of its
+// target. Symlink cycles are reported as an error wrapping ErrSymlinkLoop.
+func (a *Archiver) dereference(name, path string) (string, os.FileInfo, error) {
+	target, err := resolveSymlinkSafely(path, a.chroot)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return target, fi, nil
+}
+
+// minBufferSize is the minimum buffer size of each file when the total buffer
+// memory is limited.
+const minBufferSize = 64 * 1024
+
+// bufferSize returns the buffer size of each file compressed concurrently,
+// limited by the maximum total buffer memory.
+func (a *Archiver) bufferSize(concurrency int) int {
+	size := a.options.bufferSize
+	if size < 0 {
+		size = filepool.DefaultBufferSize
+	}
+
+	if max := a.options.maxBufferMemory; max > 0 && size > max/concurrency {
+		size = max / concurrency
+		if size < minBufferSize {
+			size = minBufferSize
+		}
+	}
+
+	return size
+}
+
+// defaultSmallArchiveThreshold is the default total size of regular files at
+// or below which buffers are reduced to fit the largest file.
+const defaultSmallArchiveThreshold = 16 * 1024 * 1024
+
+// smallBufferSize reduces size to fit the largest regular file in files, if
+// their total size is at or below the small archive threshold. Room is left
+// for the worst-case expansion of incompressible data, so that files are
+// still staged without spilling.
+func (a *Archiver) smallBufferSize(files map[string]os.FileInfo, size int) int {
+	threshold := a.options.smallThreshold
+	if threshold <= 0 {
+		return size
+	}
+
+	var total, largest int64
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		total += fi.Size()
+		if total > threshold {
+			return size
+		}
+		if fi.Size() > largest {
+			largest = fi.Size()
+		}
+	}
+
+	if n := largest + largest>>8 + 1024; n < int64(size) {
+		return int(n)
+	}
+	return size
+}
+
+// method returns the zip method to be used for a regular file.
+func (a *Archiver) method(path string, fi os.FileInfo) uint16 {
+	if _, ok := a.options.storeExts[strings.ToLower(filepath.Ext(path))]; ok {
+		return zip.Store
+	}
+	if a.options.methodFunc != nil {
+		return a.options.methodFunc(path, fi)
+	}
+	return a.options.method
+}
+
+// levelKey identifies the compressor of a method's compression level.
+type levelKey struct {
+	method uint16
+	level  int
+}
+
+// level returns the compression level chosen for a regular file by the level
+// function, or -1 if the method's registered compressor is to be used. Levels
+// only apply to Deflate and Zstd.
+func (a *Archiver) level(path string, fi os.FileInfo, method uint16) (int, error) {
+	if a.options.levelFunc == nil {
+		return -1, nil
+	}
+
+	var min, max int
+	switch method {
+	case zip.Deflate:
+		min, max = flate.NoCompression, flate.BestCompression
+	case zstd.ZipMethodWinZip:
+		min, max = int(zstd.SpeedFastest), int(zstd.SpeedBestCompression)
+	default:
+		return -1, nil
+	}
+
+	level := a.options.levelFunc(path, fi)
+	if level < 0 {
+		return -1, nil
+	}
+	if level < min || level > max {
+		return 0, fmt.Errorf("%s: level %d: %w", path, level, ErrInvalidLevel)
+	}
+
+	return level, nil
+}
+
+// compressor returns the compressor of a method's compression level, or the
+// method's registered compressor if level is negative. Compressors of levels
+// are created on first use and pooled like the built in compressors.
+func (a *Archiver) compressor(method uint16, level int) (zip.Compressor, bool) {
+	if level < 0 {
+		comp, ok := a.compressors[method]
+		return comp, ok
+	}
+
+	key := levelKey{method, level}
+	if comp, ok := a.levels.Load(key); ok {
+		return comp.(zip.Compressor), true
+	}
+
+	var comp zip.Compressor
+	switch method {
+	case zip.Deflate:
+		comp = FlateCompressor(level)
+	case zstd.ZipMethodWinZip:
+		comp = ZstdCompressor(level)
+	default:
+		comp, ok := a.compressors[method]
+		return comp, ok
+	}
+
+	actual, _ := a.levels.LoadOrStore(key, comp)
+	return actual.(zip.Compressor), true
+}
+
+// createHeaderLevel is like createHeader, but compresses the entry with the
+// compressor of the compression level. The zip writer's compressor for the
+// method is replaced whilst the header is created, which is safe as the lock
+// is held.
+func (a *Archiver) createHeaderLevel(fi os.FileInfo, hdr *zip.FileHeader, level int) (io.Writer, error) {
+	if level >= 0 {
+		if comp, ok := a.compressor(hdr.Method, level); ok {
+			a.zw.RegisterCompressor(hdr.Method, comp)
+			defer a.zw.RegisterCompressor(hdr.Method, a.compressors[hdr.Method])
+		}
+	}
+
+	return a.createHeader(fi, hdr)
+}
+
+func fileInfoHeader(prefix, name string, fi os.FileInfo, hdr *zip.FileHeader) error {
+	name = filepath.ToSlash(name)
+	switch {
+	case prefix != "" && name == ".":
+		name = prefix
+	case prefix != "":
+		name = prefix + "/" + name
+	}
+
+	var err error
+	if hdr.Name, err = cleanName(name, fi.IsDir()); err != nil {
+		return err
+	}
+	hdr.UncompressedSize64 = uint64(fi.Size())
+	hdr.Modified = fi.ModTime()
+	hdr.SetMode(fi.Mode())
+
+	const uint32max = (1 << 32) - 1
+	if hdr.UncompressedSize64 > uint32max {
+		hdr.UncompressedSize = uint32max
+	} else {
+		hdr.UncompressedSize = uint32(hdr.UncompressedSize64)
+	}
+
+	return nil
+}
+
+// cleanName returns an entry name with repeated, leading and trailing slashes
+// removed, and a single trailing slash added for directories. Names with "."
+// or ".." elements return an error wrapping ErrInvalidName, other than "."
+// alone, which names the root directory.
+func cleanName(name string, dir bool) (string, error) {
+	if name == "." {
+		if dir {
+			return "./", nil
+		}
+		return "", fmt.Errorf("%s: %w", name, ErrInvalidName)
+	}
+
+	elems := strings.FieldsFunc(name, func(r rune) bool { return r == '/' })
+	for _, elem := range elems {
+		if elem == "." || elem == ".." {
+			return "", fmt.Errorf("%s: %w", name, ErrInvalidName)
+		}
+	}
+	if len(elems) == 0 {
+		return "", fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+
+	name = strings.Join(elems, "/")
+	if dir {
+		name += "/"
+	}
+	return name, nil
+}
+
+// checkDuplicate returns an error wrapping ErrDuplicateName if an entry with
+// the header's name is in archived, unless duplicates are allowed, adding the
+// name otherwise. Directories with the same name aren't duplicates.
+func (a *Archiver) checkDuplicate(hdr *zip.FileHeader, archived map[string]bool) error {
+	if a.options.allowDuplicates {
+		return nil
+	}
+
+	name := strings.TrimSuffix(hdr.Name, "/")
+	dir := hdr.Mode().IsDir()
+	if prev, ok := archived[name]; ok && !(prev && dir) {
+		return fmt.Errorf("%s: %w", hdr.Name, ErrDuplicateName)
+	}
+	archived[name] = dir
+
+	return nil
+}
+
+// normalizeName applies the Unicode normalization form, if enabled, to the
+// header's name.
+func (a *Archiver) normalizeName(hdr *zip.FileHeader) {
+	if a.options.normalizeNames {
+		hdr.Name = a.options.normalizeForm.String(hdr.Name)
+	}
+}
+
+func storeXattrs(path string, hdr *zip.FileHeader) error {
+	attrs, err := lgetxattrs(path)
+	if err != nil || len(attrs) == 0 {
+		return err
+	}
+
+	extra, err := encodeXattrs(attrs)
+	if err != nil {
+		return fmt.Errorf("%s: %w", hdr.Name, err)
+	}
+	hdr.Extra = append(hdr.Extra, extra...)
+
+	return nil
+}
+
+// createPrefixDirectories writes a directory entry for the prefix and each of
+// its parents, using the chroot directory's metadata.
+func (a *Archiver) createPrefixDirectories() error {
+	fi, err := os.Stat(a.chroot)
+	if err != nil {
+		return err
+	}
+
+	dirs := strings.Split(a.options.prefix, "/")
+	for i := range dirs {
+		atomic.AddInt64(&a.total, 1)
+
+		var hdr zip.FileHeader
+		if err := fileInfoHeader("", strings.Join(dirs[:i+1], "/"), fi, &hdr); err != nil {
+			return err
+		}
+		a.normalizeName(&hdr)
+
+		if a.app != nil {
+			if ok, _ := a.appendName(&hdr); !ok {
+				atomic.AddInt64(&a.total, -1)
+				continue
+			}
+		}
+
+		if err := a.createDirectory(fi, &hdr); err != nil {
+			return err
+		}
+	}
+	a.prefixed = true
+
+	return nil
+}
+
+func (a *Archiver) createDirectory(fi os.FileInfo, hdr *zip.FileHeader) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	_, err := a.createHeader(fi, hdr)
+	incOnSuccess(&a.entries, err)
+	return err
+}
+
+func (a *Archiver) createHardlink(fi os.FileInfo, hdr *zip.FileHeader, target string) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	hdr.UncompressedSize64 = 0
+	hdr.UncompressedSize = 0
+	hdr.Extra = append(hdr.Extra, encodeHardlink(target)...)
+
+	_, err := a.createHeader(fi, hdr)
+	incOnSuccess(&a.entries, err)
+	return err
+}
+
+func (a *Archiver) createIrregular(fi os.FileInfo, hdr *zip.FileHeader) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	hdr.UncompressedSize64 = 0
+	hdr.UncompressedSize = 0
+	hdr.Extra = append(hdr.Extra, deviceExtra(fi)...)
+
+	_, err := a.createHeader(fi, hdr)
+	incOnSuccess(&a.entries, err)
+	return err
+}
+
+func (a *Archiver) createSymlink(path string, fi os.FileInfo, hdr *zip.FileHeader) error {
+	link, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	if a.options.rejectUnsafeLinks {
+		if err := a.safeSymlink(path, link); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+
+	// the target is known upfront, so is stored without a data descriptor
+	hdr.Method = zip.Store
+	hdr.CRC32 = crc32.ChecksumIEEE([]byte(link))
+	hdr.CompressedSize64 = uint64(len(link))
+	hdr.UncompressedSize64 = uint64(len(link))
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	w, err := a.createHeaderRaw(fi, hdr, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, link)
+	incOnSuccess(&a.entries, err)
+	return err
+}
+
+// safeSymlink returns ErrUnsafeSymlink if a symlink's target is absolute or
+// doesn't resolve to within the chroot. Targets are resolved lexically, and
+// then by following any symlinks they lead to, so that targets escaping via
+// another symlink are also rejected. Dangling targets are only checked
+// lexically.
+func (a *Archiver) safeSymlink(path, link string) error {
+	if filepath.IsAbs(link) || filepath.VolumeName(link) != "" || strings.HasPrefix(filepath.ToSlash(link), "/") {
+		return ErrUnsafeSymlink
+	}
+
+	if !within(a.chroot, filepath.Join(filepath.Dir(path), link)) {
+		return ErrUnsafeSymlink
+	}
+
+	if _, err := resolveSymlinkSafely(path, a.chroot); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (a *Archiver) createFile(ctx context.Context, path string, fi os.FileInfo, hdr *zip.FileHeader, tmp *filepool.File, turn entryTurn) (err error) {
+	var digest hash.Hash
+	if a.options.digest != 0 {
+		digest = a.options.digest.New()
+	}
+
+	level, err := a.level(path, fi, hdr.Method)
+	if err != nil {
+		return err
+	}
+
+	if r, ok := a.transform(path, fi); ok {
+		// transformed contents are streamed straight to the archive
+		err = turn.wait(ctx)
+		if err == nil {
+			err = a.compressTransformed(ctx, r, fi, hdr, level, digest)
+		}
+		dclose(r, &err)
+	} else {
+		err = a.compressPath(ctx, path, fi, hdr, tmp, turn, level, digest)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	// compressFile falls back to Store when compression doesn't help, so the
+	// header's method is only final now
+	if a.methods == nil {
+		a.methods = make(map[string]uint16)
+	}
+	a.methods[hdr.Name] = hdr.Method
+
+	if digest != nil {
+		if a.digests == nil {
+			a.digests = make(map[string][]byte)
+		}
+		a.digests[hdr.Name] = digest.Sum(nil)
+	}
+
+	return nil
+}
+
+// compressPath compresses the file at path, sampling it first to detect
+// incompressible data if the compression heuristic is enabled.
+func (a *Archiver) compressPath(ctx context.Context, path string, fi os.FileInfo, hdr *zip.FileHeader, tmp *filepool.File, turn entryTurn, level int, digest hash.Hash) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if hdr.Method != zip.Store && a.options.heuristic != nil {
+		incompressible, err := a.incompressible(f)
+		if err != nil {
+			return err
+		}
+		if incompressible {
+			a.logf("storing %s, sample is incompressible", hdr.Name)
+			hdr.Method = zip.Store
+		}
+	}
+
+	return a.compressFile(ctx, f, fi, hdr, tmp, turn, level, digest)
+}
+
+// transform returns the transformed contents of a file, if a content
+// transform is set and applies to it.
+func (a *Archiver) transform(path string, fi os.FileInfo) (io.ReadCloser, bool) {
+	if a.options.contentTransform == nil {
+		return nil, false
+	}
+	return a.options.contentTransform(path, fi)
+}
+
+// compressTransformed compresses the transformed contents of a file. The size
+// of the data isn't known upfront, so it's written with the conventional
+// zip.CreateHeader, with the sizes and CRC recorded in a data descriptor.
+func (a *Archiver) compressTransformed(ctx context.Context, r io.Reader, fi os.FileInfo, hdr *zip.FileHeader, level int, digest hash.Hash) error {
+	hdr.UncompressedSize64 = 0
+
+	br := a.readers.Get().(*bufio.Reader)
+	defer a.readers.Put(br)
+	br.Reset(r)
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	w, err := a.createHeaderLevel(fi, hdr, level)
+	if err != nil {
+		return err
+	}
+
+	var cw io.Writer = countWriter{w, &a.written, ctx}
+	if digest != nil {
+		cw = io.MultiWriter(cw, digest)
+	}
+
+	_, err = br.WriteTo(cw)
+	return err
+}
+
+// incompressible estimates the byte entropy of a sample from the start of the
+// file and reports whether it meets the heuristic's threshold.
+func (a *Archiver) incompressible(f *os.File) (bool, error) {
+	br := a.readers.Get().(*bufio.Reader)
+	defer a.readers.Put(br)
+	br.Reset(io.NewSectionReader(f, 0, int64(a.options.heuristic.SampleSize)))
+
+	var h histogram
+	if _, err := br.WriteTo(&h); err != nil {
+		return false, err
+	}
+
+	return h.entropy() >= a.options.heuristic.Threshold, nil
+}
+
+// compressFile pre-compresses the file first to a file from the filepool,
+// making use of zip.CreateRaw. This allows for concurrent files to be
+// compressed and then added to the zip file when it is their turn.
+// If no filepool file is available (when using a concurrency of 1) or the
+// compressed file is larger than the uncompressed version, the file is moved
+// to the zip file using the conventional zip.CreateHeader.
+func (a *Archiver) compressFile(ctx context.Context, f *os.File, fi os.FileInfo, hdr *zip.FileHeader, tmp *filepool.File, turn entryTurn, level int, digest hash.Hash) error {
+	comp, ok := a.compressor(hdr.Method, level)
+	// if we don't have the registered compressor, it most likely means Store is
+	// being used, so we revert to non-concurrent behaviour
+	if !ok || tmp == nil {
+		if err := turn.wait(ctx); err != nil {
+			return err
+		}
+		return a.compressFileSimple(ctx, f, fi, hdr, level, digest)
+	}
+
+	br := a.readers.Get().(*bufio.Reader)
+	defer a.readers.Put(br)
+	br.Reset(f)
+
+	hasher := tmp.Hasher()
+	if digest != nil {
+		hasher = io.MultiWriter(hasher, digest)
+	}
+
+	// the checksum of the compressed data is computed as it's staged, so that
+	// the staged data can be verified before it's written to the archive
+	var staged hash.Hash32
+	var dst io.Writer = tmp
+	if a.options.verifyStaging {
+		staged = crc32.NewIEEE()
+		dst = io.MultiWriter(tmp, staged)
+	}
+
+	if a.parallelizable(hdr) {
+		err := a.compressBlocks(ctx, comp, hdr.Method, br, dst, hasher)
+		if err != nil {
+			return err
+		}
+	} else {
+		fw, err := comp(dst)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(io.MultiWriter(fw, hasher), br)
+		dclose(fw, &err)
+		if err != nil {
+			return err
+		}
+	}
+
+	hdr.CompressedSize64 = tmp.Written()
+	// if compressed file is larger, use the uncompressed version.
+	if hdr.CompressedSize64 > hdr.UncompressedSize64 {
+		a.logf("storing %s, compressed size %d exceeds uncompressed size %d", hdr.Name, hdr.CompressedSize64, hdr.UncompressedSize64)
+		f.Seek(0, io.SeekStart)
+		hdr.Method = zip.Store
+		if err := turn.wait(ctx); err != nil {
+			return err
+		}
+		return a.compressFileSimple(ctx, f, fi, hdr, level, digest)
+	}
+	hdr.CRC32 = tmp.Checksum()
+
+	if staged != nil {
+		if err := a.verifyStaged(tmp, staged.Sum32()); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+
+	if err := turn.wait(ctx); err != nil {
+		return err
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	w, err := a.createHeaderRaw(fi, hdr, true)
+	if err != nil {
+		return err
+	}
+
+	br.Reset(tmp)
+	_, err = br.WriteTo(countWriter{w, &a.written, ctx})
+	return err
+}
+
+// verifyStaged re-reads the staged data, returning ErrStagingCorrupt if its
+// checksum doesn't match the checksum computed as it was written. The file is
+// rewound, ready for the data to be read again.
+func (a *Archiver) verifyStaged(tmp *filepool.File, checksum uint32) error {
+	br := a.readers.Get().(*bufio.Reader)
+	defer a.readers.Put(br)
+	br.Reset(tmp)
+
+	crc := crc32.NewIEEE()
+	_, err := br.WriteTo(crc)
+	tmp.Rewind()
+	if err != nil {
+		return err
+	}
+
+	if crc.Sum32() != checksum {
+		return ErrStagingCorrupt
+	}
+	return nil
+}
+
+// parallelBlockSize is the size of the blocks a large file is split into when
+// compressed in parallel.
+const parallelBlockSize = 1 << 20
+
+type flusher interface {
+	Flush() error
+}
+
+// parallelBlock holds the buffers a block is compressed with. An archiver's
+// blocks are shared by all of the files it compresses in parallel, so that the
+// number of blocks compressed at once is limited to the concurrency.
+type parallelBlock struct {
+	data []byte
+	out  bytes.Buffer
+}
+
+// parallelizable returns whether a file can be compressed in parallel blocks.
+func (a *Archiver) parallelizable(hdr *zip.FileHeader) bool {
+	if a.blocks == nil || hdr.UncompressedSize64 <= parallelBlockSize {
+		return false
+	}
+
+	return hdr.Method == zip.Deflate || hdr.Method == zstd.ZipMethodWinZip
+}
+
+// acquireBlocks waits for one of the archiver's blocks to be free, also taking
+// any others that are free without waiting.
+func (a *Archiver) acquireBlocks(ctx context.Context) ([]*parallelBlock, error) {
+	var blocks []*parallelBlock
+	select {
+	case b := <-a.blocks:
+		blocks = append(blocks, b)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for len(blocks) < cap(a.blocks) {
+		select {
+		case b := <-a.blocks:
+			blocks = append(blocks, b)
+		default:
+			return blocks, nil
+		}
+	}
+	return blocks, nil
+}
+
+// compressBlocks compresses blocks of the data read concurrently, writing the
+// compressed blocks to w in order. Deflate blocks are sync flushed so they
+// can be concatenated into a single stream, with the end of stream marker of
+// all but the last block discarded. Zstd blocks are written as independent
+// frames. The uncompressed data is written to hasher.
+func (a *Archiver) compressBlocks(ctx context.Context, comp zip.Compressor, method uint16, r io.Reader, w, hasher io.Writer) error {
+	for last := false; !last; {
+		blocks, err := a.acquireBlocks(ctx)
+		if err != nil {
+			return err
+		}
+
+		var wg errgroup.Group
+		var n int
+		for ; n < len(blocks) && !last; n++ {
+			b := blocks[n]
+			if b.data == nil {
+				b.data = make([]byte, parallelBlockSize)
+			}
+
+			var size int
+			size, err = io.ReadFull(r, b.data)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				last, err = true, nil
+			}
+			if err == nil {
+				_, err = hasher.Write(b.data[:size])
+			}
+			if err != nil {
+				break
+			}
+
+			block, final := b.data[:size], last
+			wg.Go(func() error {
+				return compressBlock(comp, method, block, &b.out, final)
+			})
+		}
+
+		if werr := wg.Wait(); err == nil {
+			err = werr
+		}
+		for i := 0; i < n && err == nil; i++ {
+			_, err = blocks[i].out.WriteTo(w)
+		}
+
+		for _, b := range blocks {
+			a.blocks <- b
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compressBlock(comp zip.Compressor, method uint16, block []byte, buf *bytes.Buffer, final bool) error {
+	buf.Reset()
+
+	fw, err := comp(buf)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fw.Write(block); err != nil {
+		fw.Close()
+		return err
+	}
+
+	if final || method != zip.Deflate {
+		return fw.Close()
+	}
+
+	f, ok := fw.(flusher)
+	if !ok {
+		fw.Close()
+		return ErrCompressorNotFlushable
+	}
+	if err := f.Flush(); err != nil {
+		fw.Close()
+		return err
+	}
+
+	// the final block written on close is discarded, so that the stream
+	// continues with the next block
+	n := buf.Len()
+	err = fw.Close()
+	buf.Truncate(n)
+
+	return err
+}
+
+// compressFileSimple uses the conventional zip.createHeader. This differs from
+// compressFile as it locks the zip _whilst_ compressing (if the method is not
+// Store). The digest, if any, is reset, as the file may have been partially
+// read by compressFile.
+func (a *Archiver) compressFileSimple(ctx context.Context, f *os.File, fi os.FileInfo, hdr *zip.FileHeader, level int, digest hash.Hash) error {
+	br := a.readers.Get().(*bufio.Reader)
+	defer a.readers.Put(br)
+
+	if hdr.Method == zip.Store && hdr.UncompressedSize64 <= maxKnownSizeStore {
+		ok, err := a.storeKnownSize(ctx, br, f, fi, hdr, digest)
+		if ok || err != nil {
+			return err
+		}
+	}
+
+	br.Reset(f)
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	w, err := a.createHeaderLevel(fi, hdr, level)
+	if err != nil {
+		return err
+	}
+
+	var cw io.Writer = countWriter{w, &a.written, ctx}
+	if digest != nil {
+		digest.Reset()
+		cw = io.MultiWriter(cw, digest)
+	}
+
+	_, err = br.WriteTo(cw)
+	return err
+}
+
+// maxKnownSizeStore is the maximum size of a stored file that is written with
+// its CRC and size in the local file header, rather than a data descriptor,
+// allowing the archive to be streamed when unzipping. This requires the file
+// to be read twice, the first time to calculate the CRC.
+const maxKnownSizeStore = 8 * 1024 * 1024
+
+// storeKnownSize stores a file without a data descriptor. If the file's size
+// no longer matches the header, false is returned and nothing is written.
+func (a *Archiver) storeKnownSize(ctx context.Context, br *bufio.Reader, f *os.File, fi os.FileInfo, hdr *zip.FileHeader, digest hash.Hash) (bool, error) {
+	size := int64(hdr.UncompressedSize64)
+
+	crc := crc32.NewIEEE()
+	var hasher io.Writer = crc
+	if digest != nil {
+		digest.Reset()
+		hasher = io.MultiWriter(crc, digest)
+	}
+
+	br.Reset(io.NewSectionReader(f, 0, size+1))
+	n, err := br.WriteTo(hasher)
+	if err != nil || n != size {
+		return false, err
+	}
+
+	hdr.CRC32 = crc.Sum32()
+	hdr.CompressedSize64 = hdr.UncompressedSize64
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	w, err := a.createHeaderRaw(fi, hdr, false)
+	if err != nil {
+		return true, err
+	}
+
+	// without a data descriptor, the header's size and checksum are final, so
+	// the file changing since it was first read would corrupt the entry
+	crc.Reset()
+	br.Reset(io.NewSectionReader(f, 0, size))
+	n, err = br.WriteTo(io.MultiWriter(countWriter{w, &a.written, ctx}, crc))
+	if err != nil {
+		return true, err
+	}
+
+	var probe [1]byte
+	if grown, _ := f.ReadAt(probe[:], size); n != size || grown > 0 || crc.Sum32() != hdr.CRC32 {
+		return true, fmt.Errorf("%s: %w", hdr.Name, ErrFileChanged)
+	}
+
+	return true, nil
+}
+
+// createHeaderRaw creates a header for data written raw. A data descriptor is
+// used unless the header's CRC and sizes are already known.
+func (a *Archiver) createHeaderRaw(fi os.FileInfo, fh *zip.FileHeader, descriptor bool) (io.Writer, error) {
+	// When the standard Go library's version of CreateRaw was added, rather
+	// than solely focus on custom compression in "raw" mode, it also removed
+	// the convenience of setting up common zip flags and timestamp logic. This
+	// here replicates what CreateHeader() does:
+	// https://github.com/golang/go/blob/go1.17/src/archive/zip/writer.go#L271
+	const zipVersion20 = 20
+
+	utf8Valid1, utf8Require1 := detectUTF8(fh.Name)
+	utf8Valid2, utf8Require2 := detectUTF8(fh.Comment)
+	switch {
+	case fh.NonUTF8:
+		fh.Flags &^= 0x800
+	case (utf8Require1 || utf8Require2) && (utf8Valid1 && utf8Valid2):
+		fh.Flags |= 0x800
+	}
+
+	fh.CreatorVersion = fh.CreatorVersion&0xff00 | zipVersion20
+	fh.ReaderVersion = zipVersion20
+
+	if !fh.Modified.IsZero() {
+		fh.ModifiedDate, fh.ModifiedTime = timeToMsDosTime(fh.Modified)
+		fh.Extra = append(fh.Extra, zipextra.NewExtendedTimestamp(fh.Modified).Encode()...)
+	}
+
+	storeUnicodePath(fh)
+
+	if descriptor {
+		fh.Flags |= 0x8
+	} else {
+		fh.Flags &^= 0x8
+	}
 
 	return a.createRaw(fi, fh)
 }
@@ -1,22 +1,182 @@
 package fastzip
 
 import (
+	"crypto"
 	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
 	ErrMinConcurrency = errors.New("concurrency must be at least 1")
+
+	// ErrMinBufferSize is returned when a buffer size is less than the minimum
+	// of 16 bytes.
+	ErrMinBufferSize = errors.New("buffer size must be at least 16 bytes")
+
+	// ErrHashUnavailable is returned by WithArchiverDigest when the hash
+	// function isn't linked into the binary.
+	ErrHashUnavailable = errors.New("hash function is unavailable")
+
+	// ErrUnsafeSymlink is returned when rejecting unsafe symlinks and a
+	// symlink's target is absolute or outside of the chroot.
+	ErrUnsafeSymlink = errors.New("symlink target is absolute or outside of chroot")
+
+	// ErrCompressorNotFlushable is returned when a file is compressed in
+	// parallel blocks with a Deflate compressor whose writers can't be
+	// flushed.
+	ErrCompressorNotFlushable = errors.New("compressor doesn't support flushing")
+
+	// ErrSymlinkLoop is returned when resolving a symlink follows too many
+	// symlinks, such as when symlinks form a cycle.
+	ErrSymlinkLoop = errors.New("too many levels of symlinks")
+
+	// ErrDuplicateName is returned when an entry has the same name as one
+	// already in the archive.
+	ErrDuplicateName = errors.New("duplicate entry name")
+
+	// ErrInvalidName is returned when a file's name in the archive would be
+	// empty, or have "." or ".." elements.
+	ErrInvalidName = errors.New("invalid entry name")
+
+	// ErrInvalidPrefix is returned by WithArchiverPrefix when the prefix is
+	// absolute or refers to a parent directory.
+	ErrInvalidPrefix = errors.New("prefix must be a relative path within the archive")
+
+	// ErrMaxFileSize is returned when a file exceeds the maximum file size.
+	ErrMaxFileSize = errors.New("maximum file size exceeded")
+
+	// ErrStagingRequired is returned when staging is disabled alongside an
+	// option that requires it.
+	ErrStagingRequired = errors.New("option requires staging to be enabled")
+
+	// ErrStagingCorrupt is returned when verifying staged data and it has
+	// changed since it was written.
+	ErrStagingCorrupt = errors.New("staged data is corrupt")
+
+	// ErrFileChanged is returned when a file changes whilst it's being
+	// archived, after its size and checksum have been written.
+	ErrFileChanged = errors.New("file changed whilst being archived")
+
+	// ErrInvalidLevel is returned when the level function chooses a
+	// compression level that is invalid for the file's method.
+	ErrInvalidLevel = errors.New("invalid compression level")
+)
+
+// DefaultStoreExtensions is the list of extensions of commonly
+// already-compressed file types used by WithArchiverSkipCompressedTypes.
+var DefaultStoreExtensions = []string{
+	".7z", ".aac", ".apk", ".avi", ".br", ".bz2", ".docx", ".flac", ".gif",
+	".gz", ".heic", ".jar", ".jpeg", ".jpg", ".lz", ".lz4", ".lzma", ".m4a",
+	".mkv", ".mov", ".mp3", ".mp4", ".ogg", ".png", ".pptx", ".rar", ".tgz",
+	".txz", ".webm", ".webp", ".whl", ".xlsx", ".xz", ".zip", ".zst",
+}
+
+// SymlinkMode determines how symlinks are archived.
+type SymlinkMode int
+
+const (
+	// SymlinkPreserve archives symlinks as symlinks, storing their target.
+	SymlinkPreserve SymlinkMode = iota
+
+	// SymlinkDereference archives the file or directory a symlink resolves
+	// to under the symlink's name. The resolved target must be within the
+	// chroot. A cycle of symlinks returns an error wrapping ErrSymlinkLoop.
+	SymlinkDereference
+
+	// SymlinkSkip skips symlinks.
+	SymlinkSkip
+)
+
+// MergePolicy determines how Merge, and archivers created with
+// NewArchiverForAppend, handle entries with the same name as an entry already
+// in the archive. It also determines how extractors handle files with the
+// same name when flattening, see WithExtractorFlattenPolicy.
+type MergePolicy int
+
+const (
+	// MergeError returns an error wrapping ErrDuplicateName.
+	MergeError MergePolicy = iota
+
+	// MergeSkip skips the entry, keeping the entry already in the archive.
+	MergeSkip
+
+	// MergeRename renames the entry, adding a numeric suffix before the
+	// extension of the entry's base name, such as "dir/file_1.txt".
+	MergeRename
 )
 
 // ArchiverOption is an option used when creating an archiver.
 type ArchiverOption func(*archiverOptions) error
 
 type archiverOptions struct {
-	method      uint16
-	concurrency int
-	bufferSize  int
-	stageDir    string
-	offset      int64
+	method            uint16
+	concurrency       int
+	bufferSize        int
+	readBufferSize    int
+	maxBufferMemory   int
+	smallThreshold    int64
+	stageDir          string
+	maxStageFiles     int
+	memStaging        bool
+	noStaging         bool
+	verifyStaging     bool
+	offset            int64
+	forceZip64        bool
+	rateLimit         int
+	omitRootDir       bool
+	prefix            string
+	normalizeNames    bool
+	normalizeForm     norm.Form
+	logger            func(format string, args ...interface{})
+	skipHandler       func(name string, fi os.FileInfo)
+	storeDirs         bool
+	storeOwnership    bool
+	digest            crypto.Hash
+	mergePolicy       MergePolicy
+	allowDuplicates   bool
+	storeXattrs       bool
+	storeCreationTime bool
+	storeNTFSTimes    bool
+	preciseModTime    bool
+	storeDOSAttrs     bool
+	storeFileFlags    bool
+	maxFileSize       int64
+	skipOversized     bool
+	methodFunc        func(path string, fi os.FileInfo) uint16
+	levelFunc         func(path string, fi os.FileInfo) int
+	less              func(a, b string) bool
+	contentTransform  func(path string, fi os.FileInfo) (io.ReadCloser, bool)
+	storeExts         map[string]struct{}
+	heuristic         *CompressionHeuristic
+	hardLinks         bool
+	irregular         bool
+	largeFileParallel bool
+	symlinkMode       SymlinkMode
+	rejectUnsafeLinks bool
+}
+
+// CompressionHeuristic configures the heuristic used to detect incompressible
+// files before compression.
+type CompressionHeuristic struct {
+	// SampleSize is the number of bytes sampled from the start of a file.
+	SampleSize int
+
+	// Threshold is the byte entropy (in bits per byte, from 0 to 8) at or
+	// above which a sample is considered incompressible.
+	Threshold float64
+}
+
+// DefaultCompressionHeuristic is the configuration used by
+// WithArchiverCompressionHeuristic.
+var DefaultCompressionHeuristic = CompressionHeuristic{
+	SampleSize: 64 * 1024,
+	Threshold:  7.5,
 }
 
 // WithArchiverMethod sets the zip method to be used for compressible files.
@@ -27,6 +187,98 @@ func WithArchiverMethod(method uint16) ArchiverOption {
 	}
 }
 
+// WithArchiverMethodFunc sets a function that is called for each regular file
+// to choose the zip method used. The path provided is the absolute path of the
+// file. When set, it takes precedence over WithArchiverMethod. Methods without
+// a registered compressor are written without concurrent compression.
+func WithArchiverMethodFunc(fn func(path string, fi os.FileInfo) uint16) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.methodFunc = fn
+		return nil
+	}
+}
+
+// WithArchiverLevelFunc sets a function that is called for each regular file
+// compressed with Deflate or Zstd to choose its compression level, with the
+// absolute path of the file. A negative level uses the method's registered
+// compressor. Deflate levels range from 0 to 9, and Zstd levels from 1
+// (fastest) to 4 (best compression), as with zstd.EncoderLevel; other levels
+// return an error wrapping ErrInvalidLevel. The compressors of each level are
+// pooled, so choosing from a few levels is efficient.
+func WithArchiverLevelFunc(fn func(path string, fi os.FileInfo) int) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.levelFunc = fn
+		return nil
+	}
+}
+
+// WithArchiverContentTransform sets a function that is called for each regular
+// file, with the absolute path of the file, before it's archived. If it returns
+// true, the data read from the reader returned is archived instead of the
+// file's, and the reader is closed afterwards. The size of the transformed data
+// isn't known upfront, so these entries are compressed whilst being written to
+// the archive, rather than concurrently, and the compression heuristic is
+// skipped for them.
+func WithArchiverContentTransform(fn func(path string, fi os.FileInfo) (io.ReadCloser, bool)) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.contentTransform = fn
+		return nil
+	}
+}
+
+// WithArchiverStoreExtensions sets a list of file extensions (such as ".jpg")
+// that are always stored uncompressed, bypassing the method selection.
+// Extensions are matched case-insensitively.
+func WithArchiverStoreExtensions(exts []string) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeExts = make(map[string]struct{}, len(exts))
+		for _, ext := range exts {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			o.storeExts[strings.ToLower(ext)] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// WithArchiverSkipCompressedTypes sets whether files with extensions of
+// commonly already-compressed file types (DefaultStoreExtensions) are stored
+// uncompressed.
+func WithArchiverSkipCompressedTypes(skip bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if !skip {
+			o.storeExts = nil
+			return nil
+		}
+		return WithArchiverStoreExtensions(DefaultStoreExtensions)(o)
+	}
+}
+
+// WithArchiverCompressionHeuristic sets whether a sample of each file is
+// inspected before compression, with files that look incompressible being
+// stored uncompressed without first being compressed. Files that compress to
+// a larger size than their original are always stored uncompressed.
+func WithArchiverCompressionHeuristic(enabled bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.heuristic = nil
+		if enabled {
+			h := DefaultCompressionHeuristic
+			o.heuristic = &h
+		}
+		return nil
+	}
+}
+
+// WithArchiverCompressionHeuristicConfig enables the compression heuristic
+// with a custom configuration.
+func WithArchiverCompressionHeuristicConfig(h CompressionHeuristic) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.heuristic = &h
+		return nil
+	}
+}
+
 // WithArchiverConcurrency will set the maximum number of files to be
 // compressed concurrently. The default is set to GOMAXPROCS.
 func WithArchiverConcurrency(n int) ArchiverOption {
@@ -54,9 +306,55 @@ func WithArchiverBufferSize(n int) ArchiverOption {
 	}
 }
 
+// WithArchiverReadBufferSize sets the size of the buffer each file is read
+// through. Larger buffers reduce the number of reads, which can improve
+// throughput on fast storage. Each file compressed concurrently uses its own
+// buffer. The default is 32 kibibytes, and the minimum is 16 bytes.
+func WithArchiverReadBufferSize(n int) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if n < 16 {
+			return ErrMinBufferSize
+		}
+		o.readBufferSize = n
+		return nil
+	}
+}
+
+// WithArchiverMaxTotalBufferMemory limits the total memory allocated for the
+// buffers of files compressed concurrently. The buffer size of each file is
+// reduced to n divided by the concurrency, if smaller than the configured
+// buffer size, but is never less than 64 kibibytes. A value of 0 disables the
+// limit.
+func WithArchiverMaxTotalBufferMemory(n int) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if n < 0 {
+			n = 0
+		}
+		o.maxBufferMemory = n
+		return nil
+	}
+}
+
+// WithArchiverSmallArchiveThreshold sets the total size of regular files,
+// passed to a single call to Archive, at or below which the buffer of each
+// file compressed concurrently is reduced to fit the largest file, rather
+// than allocating the full buffer size for small jobs. The default is 16
+// mebibytes. A value of 0 disables the reduction.
+func WithArchiverSmallArchiveThreshold(n int64) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if n < 0 {
+			n = 0
+		}
+		o.smallThreshold = n
+		return nil
+	}
+}
+
 // WithStageDirectory sets the directory to be used to stage compressed files
 // before they're written to the archive. The default is the directory to be
-// archived.
+// archived. When set, NewArchiver returns an error if files cannot be created
+// in the directory, unless concurrency is 1 or in-memory staging is enabled,
+// as the directory is then unused.
 func WithStageDirectory(dir string) ArchiverOption {
 	return func(o *archiverOptions) error {
 		o.stageDir = dir
@@ -64,11 +362,402 @@ func WithStageDirectory(dir string) ArchiverOption {
 	}
 }
 
+// WithArchiverMaxStageFiles limits the number of temporary files in the stage
+// directory that compressed data exceeding the buffer size is written to. By
+// default, each concurrently compressed file has its own temporary file, so
+// with high concurrency, many files can be open at once. When limited, the
+// files are shared, each partitioned into chunks that are allocated as
+// needed. This suits environments with a limited number of file descriptors,
+// but writes to a shared file are somewhat serialized, and the disk space of
+// chunks is only reclaimed once Archive returns. A value of 0 disables the
+// limit.
+func WithArchiverMaxStageFiles(n int) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if n < 0 {
+			n = 0
+		}
+		o.maxStageFiles = n
+		return nil
+	}
+}
+
+// WithArchiverInMemoryStaging sets whether compressed data exceeding the buffer
+// size is held in memory, rather than written to temporary files in the stage
+// directory. This is useful on read-only or slow filesystems, but memory usage
+// is then unbounded: each of the concurrently compressed files can require
+// memory up to its compressed size, so with high concurrency and large files,
+// considerable memory can be used.
+func WithArchiverInMemoryStaging(enabled bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.memStaging = enabled
+		return nil
+	}
+}
+
+// WithArchiverNoStaging sets whether staging is disabled, so that no staging
+// files or buffers are used. Each file is compressed directly to the writer,
+// one at a time, regardless of the concurrency set, so memory use is bounded
+// and nothing is written to the stage directory. This is useful when writing
+// to a non-seekable stream, such as an io.Pipe or socket, where memory must
+// stay bounded, at the cost of compression being single-threaded.
+//
+// NewArchiver returns ErrStagingRequired if staging is disabled along with
+// options that depend on it: WithArchiverLargeFileParallelism,
+// WithArchiverInMemoryStaging and WithArchiverMaxStageFiles.
+func WithArchiverNoStaging(enabled bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.noStaging = enabled
+		return nil
+	}
+}
+
+// WithArchiverVerifyStaging sets whether compressed data is verified after
+// it's staged, before it's written to the archive. A checksum of the compressed
+// data is computed as it's staged, and compared with a checksum of the data
+// re-read from staging, so that corruption of the stage directory is detected
+// rather than written to the archive. An entry whose staged data doesn't
+// match fails with an error wrapping ErrStagingCorrupt. This costs an extra
+// read of each file's staged data.
+func WithArchiverVerifyStaging(enabled bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.verifyStaging = enabled
+		return nil
+	}
+}
+
 // WithArchiverOffset sets the offset of the beginning of the zip data. This
-// should be used when zip data is appended to an existing file.
+// should be used when zip data is appended to an existing file. If the writer
+// is seekable, such as an *os.File, it's seeked to the offset when the archiver
+// is created or reset, otherwise the caller must have already written the
+// data preceding the offset.
 func WithArchiverOffset(n int64) ArchiverOption {
 	return func(o *archiverOptions) error {
 		o.offset = n
 		return nil
 	}
 }
+
+// WithArchiverForceZip64 sets whether the ZIP64 format is used regardless of
+// the archive's size. When enabled, every central directory entry has a ZIP64
+// extra field holding its sizes and offset, and the ZIP64 end of central
+// directory record and locator are written. Local file headers are
+// unaffected.
+func WithArchiverForceZip64(force bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.forceZip64 = force
+		return nil
+	}
+}
+
+// WithArchiverRateLimit limits the rate, in bytes per second, at which the
+// archive is written. The limit applies to the aggregate output of all
+// concurrently compressed files. A value of 0 disables the limit.
+func WithArchiverRateLimit(bytesPerSec int) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if bytesPerSec < 0 {
+			bytesPerSec = 0
+		}
+		o.rateLimit = bytesPerSec
+		return nil
+	}
+}
+
+// WithArchiverOmitRootDir sets whether the chroot directory itself is skipped
+// when provided to Archive. By default, it's archived as the entry "./", as its
+// path relative to the chroot is ".". Its descendants are archived with their
+// relative names regardless.
+func WithArchiverOmitRootDir(omit bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.omitRootDir = omit
+		return nil
+	}
+}
+
+// WithArchiverPrefix sets a directory that every entry is archived within,
+// without it needing to exist on disk. For example, with the prefix
+// "release-1.2.3", the file "bin/tool" relative to the chroot is archived as
+// "release-1.2.3/bin/tool". Directory entries for the prefix are written with
+// the chroot directory's metadata and the chroot directory itself is archived
+// as the prefix directory.
+func WithArchiverPrefix(prefix string) ArchiverOption {
+	return func(o *archiverOptions) error {
+		prefix = path.Clean(filepath.ToSlash(prefix))
+		if path.IsAbs(prefix) || prefix == ".." || strings.HasPrefix(prefix, "../") {
+			return ErrInvalidPrefix
+		}
+		if prefix == "." {
+			prefix = ""
+		}
+		o.prefix = prefix
+		return nil
+	}
+}
+
+// WithArchiverNormalizeNames applies the Unicode normalization form to entry
+// names. macOS stores filenames decomposed (NFD), whereas most other systems
+// use the composed form (NFC), so normalizing to NFC avoids names that look
+// identical but don't match when extracted elsewhere. By default, names are
+// archived as they are on disk.
+func WithArchiverNormalizeNames(form norm.Form) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.normalizeNames = true
+		o.normalizeForm = form
+		return nil
+	}
+}
+
+// WithArchiverStoreDirectories sets whether directories are archived as
+// entries. The default is true. When disabled, the directory structure is
+// implied by the paths of the files within it, which loses empty directories
+// and directory permissions, ownership and modification times.
+func WithArchiverStoreDirectories(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeDirs = store
+		return nil
+	}
+}
+
+// WithArchiverStoreOwnership sets whether each entry's uid and gid are stored
+// in the archive, using the Info-ZIP Unix extra field. The default is true.
+// Disabling this avoids leaking account IDs when sharing archives publicly.
+// Ownership is only read on Unix platforms, on other platforms this option has
+// no effect.
+func WithArchiverStoreOwnership(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeOwnership = store
+		return nil
+	}
+}
+
+// WithArchiverDigest sets a hash function, such as crypto.SHA256, used to
+// calculate a digest of each regular file's uncompressed data whilst it's
+// archived. The digests are returned by Digests. The hash function's package
+// must be linked into the binary, such as by importing crypto/sha256,
+// otherwise ErrHashUnavailable is returned. A value of 0 disables digests.
+func WithArchiverDigest(h crypto.Hash) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if h != 0 && !h.Available() {
+			return ErrHashUnavailable
+		}
+		o.digest = h
+		return nil
+	}
+}
+
+// WithArchiverSort sets the function used to order the names passed to
+// Archive, which determines the order entries are archived in. Names are those
+// of the files map, rather than the names stored in the archive. The default is
+// a lexical sort. Names are sorted lexically before the function is applied,
+// and the sort is stable, so that names the function considers equal are
+// still archived in a deterministic order. For the output to be
+// reproducible, the function must be deterministic, too.
+//
+// Entries are written in this order regardless of concurrency. The first of a
+// set of hard linked files is archived as the file, with the remainder linking
+// to it.
+func WithArchiverSort(less func(a, b string) bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.less = less
+		return nil
+	}
+}
+
+// WithArchiverAllowDuplicateNames sets whether Archive can write more than
+// one entry with the same name. By default, Archive returns an error wrapping
+// ErrDuplicateName, before writing an entry whose name, after any prefixing
+// and normalization, has already been archived by the same call. Directories
+// with the same name are never considered duplicates. Entries already in an
+// archive being appended to are handled by the merge policy instead.
+func WithArchiverAllowDuplicateNames(allow bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.allowDuplicates = allow
+		return nil
+	}
+}
+
+// WithArchiverMergePolicy sets how Merge, and archivers created with
+// NewArchiverForAppend, handle entries with the same name as an entry already
+// in the archive. The default is MergeError. Directory entries with
+// the same name are never considered a collision, with only the first being
+// kept.
+func WithArchiverMergePolicy(policy MergePolicy) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.mergePolicy = policy
+		return nil
+	}
+}
+
+// WithArchiverStoreXattrs sets whether extended attributes are read and stored
+// in the archive. Extended attributes are only supported on Linux and macOS,
+// enabling this option on other platforms returns ErrXattrUnsupported.
+func WithArchiverStoreXattrs(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		if store && !xattrSupported {
+			return ErrXattrUnsupported
+		}
+		o.storeXattrs = store
+		return nil
+	}
+}
+
+// WithArchiverStoreCreationTime sets whether a file's creation time is stored
+// in the archive, using the NTFS extra field. Creation times are only read on
+// macOS and Windows, on other platforms this option has no effect.
+func WithArchiverStoreCreationTime(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeCreationTime = store
+		return nil
+	}
+}
+
+// WithArchiverStoreNTFSTimes sets whether a file's modification, access and
+// creation times are stored in the archive with 100 nanosecond precision,
+// using the NTFS extra field, rather than only the modification time with 1
+// second precision. Where the access or creation time isn't available, the
+// modification time is stored in its place. This implies
+// WithArchiverStoreCreationTime.
+func WithArchiverStoreNTFSTimes(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeNTFSTimes = store
+		return nil
+	}
+}
+
+// WithArchiverStorePreciseModTime sets whether a file's modification time is
+// stored with nanosecond precision, in an extra field alongside the Info-ZIP
+// extended timestamp, which only has 1 second precision. Extractors restore
+// the precise time where the platform supports it, such as with utimensat on
+// Linux.
+func WithArchiverStorePreciseModTime(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.preciseModTime = store
+		return nil
+	}
+}
+
+// WithArchiverSymlinkMode sets how symlinks are archived. The default is
+// SymlinkPreserve. With SymlinkDereference, a symlink to a directory is
+// archived as a directory entry, the directory's contents are only archived
+// if also provided to Archive. Symlink cycles, and targets outside of the
+// chroot, cause Archive to error.
+func WithArchiverSymlinkMode(mode SymlinkMode) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.symlinkMode = mode
+		return nil
+	}
+}
+
+// WithArchiverRejectUnsafeSymlinks sets whether archiving symlinks with a
+// target that is absolute, or that resolves relative to the symlink's
+// directory to outside of the chroot, returns ErrUnsafeSymlink. This prevents
+// creating archives that are unsafe to extract elsewhere. Targets that lead to
+// further symlinks are followed, and a cycle of symlinks returns an error
+// wrapping ErrSymlinkLoop.
+func WithArchiverRejectUnsafeSymlinks(reject bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.rejectUnsafeLinks = reject
+		return nil
+	}
+}
+
+// WithArchiverStoreDOSAttributes sets whether DOS attributes, such as hidden,
+// system and read-only, are stored in the low 8 bits of each entry's external
+// attributes. DOS attributes are only read on Windows, where this option is
+// enabled by default, on other platforms this option has no effect.
+func WithArchiverStoreDOSAttributes(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeDOSAttrs = store
+		return nil
+	}
+}
+
+// WithArchiverMaxFileSize sets the maximum size of a file that can be
+// archived. Archive returns ErrMaxFileSize for larger files, unless skipping
+// them with WithArchiverSkipOversizedFiles. The size is checked before the file
+// is opened. The default of zero is unlimited.
+func WithArchiverMaxFileSize(n int64) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.maxFileSize = n
+		return nil
+	}
+}
+
+// WithArchiverSkipOversizedFiles sets whether files exceeding the maximum file
+// size are skipped, rather than causing Archive to return ErrMaxFileSize.
+func WithArchiverSkipOversizedFiles(skip bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.skipOversized = skip
+		return nil
+	}
+}
+
+// WithArchiverStoreFileFlags sets whether BSD file flags, as set by chflags,
+// such as the immutable flag, are stored in the archive. File flags are only
+// read on macOS and the BSDs, on other platforms this option has no effect.
+func WithArchiverStoreFileFlags(store bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.storeFileFlags = store
+		return nil
+	}
+}
+
+// WithArchiverHardLinks sets whether hard links are preserved. When enabled,
+// the first path to a file is archived as normal, with subsequent links to the
+// same file being stored as empty entries referencing the first. Other zip
+// tools extract these entries as empty files. On Windows, hard links cannot
+// be detected and are always archived as independent files.
+func WithArchiverHardLinks(enabled bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.hardLinks = enabled
+		return nil
+	}
+}
+
+// WithArchiverIncludeIrregular sets whether named pipes, sockets and device
+// files are archived. These are stored as empty entries, with device numbers
+// stored in an extra field. This is only supported on unix platforms and is a
+// no-op elsewhere.
+func WithArchiverIncludeIrregular(include bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.irregular = include && irregularSupported
+		return nil
+	}
+}
+
+// WithArchiverLargeFileParallelism sets whether large files are split into
+// blocks that are compressed concurrently, up to the concurrency limit. This
+// is supported for Deflate, where the blocks form a single stream, and Zstd,
+// where each block is a separate frame. Parallelism only applies when
+// concurrency is greater than 1 and slightly reduces the compression ratio.
+// The blocks compressed at once, across all files, are limited to the
+// concurrency. A registered Deflate compressor's writers must have a Flush
+// method, otherwise ErrCompressorNotFlushable is returned.
+func WithArchiverLargeFileParallelism(enabled bool) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.largeFileParallel = enabled
+		return nil
+	}
+}
+
+// WithArchiverLogger sets a function used to log debug messages, such as when
+// a file is skipped or stored rather than compressed. It may be called
+// concurrently. By default, nothing is logged.
+func WithArchiverLogger(fn func(format string, args ...interface{})) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.logger = fn
+		return nil
+	}
+}
+
+// WithArchiverSkipHandler sets a function that is called with the name and
+// file info of each file passed to Archive that is skipped rather than
+// archived: irregular files, when not included, symlinks skipped by the
+// symlink mode or leading to irregular files, files exceeding the maximum
+// file size, when skipped, and files already in an archive being appended to.
+// The handler is called from the goroutine calling Archive.
+func WithArchiverSkipHandler(fn func(name string, fi os.FileInfo)) ArchiverOption {
+	return func(o *archiverOptions) error {
+		o.skipHandler = fn
+		return nil
+	}
+}
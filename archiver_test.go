@@ -1,23 +1,36 @@
 package fastzip
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/zip"
 	"github.com/klauspost/compress/zstd"
+	"github.com/saracen/fastzip/internal/filepool"
+	"github.com/saracen/zipextra"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/text/unicode/norm"
 )
 
 var fixedModTime = time.Date(2020, time.February, 1, 6, 0, 0, 0, time.UTC)
@@ -83,6 +96,10 @@ func testCreateArchive(t *testing.T, dir string, files map[string]os.FileInfo, f
 	_, entries := a.Written()
 	require.EqualValues(t, len(files), entries)
 
+	progress := a.Progress()
+	require.EqualValues(t, len(files), progress.EntriesDone)
+	require.EqualValues(t, len(files), progress.EntriesTotal)
+
 	fn(f.Name(), dir)
 }
 
@@ -210,6 +227,43 @@ func TestArchiveWithCompressor(t *testing.T) {
 	testExtract(t, f.Name(), testFiles)
 }
 
+func TestArchiveWithBzip2(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go":       {mode: 0666},
+		"compressible": {mode: 0666, contents: strings.Repeat("1", 1024)},
+		"large_file":   {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 65536)},
+	}
+
+	for _, concurrency := range []int{1, 2} {
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		f, err := ioutil.TempFile("", "fastzip-test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		a, err := NewArchiver(f, dir, WithArchiverMethod(ZipMethodBzip2), WithArchiverConcurrency(concurrency))
+		require.NoError(t, err)
+		a.RegisterCompressor(ZipMethodBzip2, Bzip2Compressor(9))
+		assert.Equal(t, ZipMethodBzip2, a.CompressionMethod())
+		assert.Equal(t, []uint16{zip.Store, zip.Deflate, ZipMethodBzip2, zstd.ZipMethodWinZip}, a.RegisteredMethods())
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		zr, err := zip.OpenReader(f.Name())
+		require.NoError(t, err)
+		for _, file := range zr.File {
+			if file.Name == "compressible" {
+				assert.Equal(t, ZipMethodBzip2, file.Method)
+			}
+		}
+		require.NoError(t, zr.Close())
+
+		testExtract(t, f.Name(), testFiles)
+	}
+}
+
 func TestArchiveWithMethod(t *testing.T) {
 	testFiles := map[string]testFile{
 		"foo.go": {mode: 0666},
@@ -236,6 +290,430 @@ func TestArchiveWithMethod(t *testing.T) {
 	testExtract(t, f.Name(), testFiles)
 }
 
+func TestArchiveWithLevelFunc(t *testing.T) {
+	contents := strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 4096)
+	testFiles := map[string]testFile{
+		"best.txt":    {mode: 0666, contents: contents},
+		"none.txt":    {mode: 0666, contents: contents},
+		"default.txt": {mode: 0666, contents: contents},
+	}
+
+	levels := map[string]int{"best.txt": flate.BestCompression, "none.txt": flate.NoCompression, "default.txt": -1}
+
+	for _, method := range []uint16{zip.Deflate, zstd.ZipMethodWinZip} {
+		for _, concurrency := range []int{1, 4} {
+			files, dir := testCreateFiles(t, testFiles)
+			defer os.RemoveAll(dir)
+
+			f, err := ioutil.TempFile("", "fastzip-test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			a, err := NewArchiver(f, dir, WithArchiverMethod(method), WithArchiverConcurrency(concurrency), WithArchiverLevelFunc(func(path string, fi os.FileInfo) int {
+				level := levels[fi.Name()]
+				if method == zstd.ZipMethodWinZip && level == flate.NoCompression {
+					return int(zstd.SpeedFastest)
+				}
+				if method == zstd.ZipMethodWinZip && level == flate.BestCompression {
+					return int(zstd.SpeedBestCompression)
+				}
+				return level
+			}))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			sizes := make(map[string]uint64)
+			zr, err := zip.OpenReader(f.Name())
+			require.NoError(t, err)
+			for _, file := range zr.File {
+				sizes[file.Name] = file.CompressedSize64
+			}
+			require.NoError(t, zr.Close())
+
+			assert.Less(t, sizes["best.txt"], sizes["none.txt"], "method %d, concurrency %d", method, concurrency)
+
+			testExtract(t, f.Name(), testFiles)
+		}
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	a, err := NewArchiver(io.Discard, dir, WithArchiverLevelFunc(func(path string, fi os.FileInfo) int {
+		return 10
+	}))
+	require.NoError(t, err)
+	assert.ErrorIs(t, a.Archive(context.Background(), files), ErrInvalidLevel)
+}
+
+func TestArchiveWithSort(t *testing.T) {
+	testFiles := map[string]testFile{
+		"a.txt":          {mode: 0666, contents: "a"},
+		"b.txt":          {mode: 0666, contents: "b"},
+		"dir":            {mode: os.ModeDir | 0777},
+		"dir/index.html": {mode: 0666, contents: "index"},
+		"dir/c.txt":      {mode: 0666, contents: "c"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	f, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// index.html first, with everything else in reverse order
+	a, err := NewArchiver(f, dir, WithArchiverConcurrency(1), WithArchiverSort(func(a, b string) bool {
+		if filepath.Base(a) == "index.html" || filepath.Base(b) == "index.html" {
+			return filepath.Base(a) == "index.html" && filepath.Base(b) != "index.html"
+		}
+		return a > b
+	}))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	zr, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer zr.Close()
+
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	assert.Equal(t, []string{"dir/index.html", "dir/c.txt", "dir/", "b.txt", "a.txt", "./"}, names)
+
+	testExtract(t, f.Name(), testFiles)
+}
+
+func TestArchiveOrderWithConcurrency(t *testing.T) {
+	random := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"dir":             {mode: os.ModeDir | 0777},
+		"dir/large":       {mode: 0666, contents: strings.Repeat("large", 1024*1024)},
+		"dir/random":      {mode: 0666, contents: string(random)},
+		"dir/symlink":     {mode: os.ModeSymlink | 0777, contents: "large"},
+		"dir/sub":         {mode: os.ModeDir | 0777},
+		"dir/sub/stored":  {mode: 0666, contents: "stored"},
+		"dir/sub/written": {mode: 0666, contents: "written"},
+	}
+	for i := 0; i < 50; i++ {
+		testFiles[fmt.Sprintf("dir/small_%02d", i)] = testFile{mode: 0666, contents: strings.Repeat("small", i)}
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	names := []string{"./"}
+	for name, tf := range testFiles {
+		if tf.mode.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			testCreateArchive(t, dir, files, func(filename, chroot string) {
+				zr, err := zip.OpenReader(filename)
+				require.NoError(t, err)
+				defer zr.Close()
+
+				var archived []string
+				for _, file := range zr.File {
+					archived = append(archived, file.Name)
+				}
+				assert.Equal(t, names, archived)
+			}, WithArchiverConcurrency(concurrency), WithArchiverMethodFunc(func(path string, fi os.FileInfo) uint16 {
+				if filepath.Base(path) == "stored" {
+					return zip.Store
+				}
+				return zip.Deflate
+			}))
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "fastzip-test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		missing := make(map[string]os.FileInfo)
+		for name, fi := range files {
+			missing[name] = fi
+		}
+		missing[filepath.Join(dir, "dir", "missing")] = files[filepath.Join(dir, "dir", "small_01")]
+
+		a, err := NewArchiver(f, dir, WithArchiverConcurrency(4))
+		require.NoError(t, err)
+		assert.True(t, os.IsNotExist(a.Archive(context.Background(), missing)))
+	})
+}
+
+func TestArchiveWithContentTransform(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.txt": {mode: 0666, contents: "foo  \nbar\t\n" + strings.Repeat("baz \n", 1024)},
+		"bar.bin": {mode: 0666, contents: strings.Repeat("bar ", 1024)},
+	}
+
+	expected := map[string]testFile{
+		"foo.txt": {mode: 0666, contents: "foo\nbar\n" + strings.Repeat("baz\n", 1024)},
+		"bar.bin": testFiles["bar.bin"],
+	}
+
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		for _, concurrency := range []int{1, 4} {
+			files, dir := testCreateFiles(t, testFiles)
+			defer os.RemoveAll(dir)
+
+			f, err := ioutil.TempFile("", "fastzip-test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			var closed int
+			a, err := NewArchiver(f, dir, WithArchiverMethod(method), WithArchiverConcurrency(concurrency), WithArchiverContentTransform(func(path string, fi os.FileInfo) (io.ReadCloser, bool) {
+				if filepath.Ext(path) != ".txt" {
+					return nil, false
+				}
+
+				data, err := os.ReadFile(path)
+				require.NoError(t, err)
+
+				var buf bytes.Buffer
+				for _, line := range strings.SplitAfter(string(data), "\n") {
+					buf.WriteString(strings.TrimRight(line, " \t\n"))
+					if strings.HasSuffix(line, "\n") {
+						buf.WriteString("\n")
+					}
+				}
+
+				return closeFunc{&buf, func() error { closed++; return nil }}, true
+			}))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+			assert.Equal(t, 1, closed)
+
+			zr, err := zip.OpenReader(f.Name())
+			require.NoError(t, err)
+			for _, file := range zr.File {
+				if tf, ok := expected[file.Name]; ok {
+					assert.EqualValues(t, len(tf.contents), file.UncompressedSize64, file.Name)
+					assert.Equal(t, method, file.Method, file.Name)
+				}
+			}
+			require.NoError(t, zr.Close())
+
+			testExtract(t, f.Name(), expected)
+		}
+	}
+}
+
+type closeFunc struct {
+	io.Reader
+	close func() error
+}
+
+func (c closeFunc) Close() error {
+	return c.close()
+}
+
+func TestArchiveWithMethodFunc(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.txt":  {mode: 0666, contents: strings.Repeat("foo", 1024)},
+		"bar.jpg":  {mode: 0666, contents: strings.Repeat("bar", 1024)},
+		"baz.zstd": {mode: 0666, contents: strings.Repeat("baz", 1024)},
+	}
+
+	expected := map[string]uint16{
+		"foo.txt":  zip.Deflate,
+		"bar.jpg":  zip.Store,
+		"baz.zstd": zstd.ZipMethodWinZip,
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		f, err := ioutil.TempFile("", "fastzip-test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		a, err := NewArchiver(f, dir, WithArchiverMethod(zip.Store), WithArchiverConcurrency(concurrency), WithArchiverMethodFunc(func(path string, fi os.FileInfo) uint16 {
+			assert.True(t, filepath.IsAbs(path))
+			return expected[fi.Name()]
+		}))
+		require.NoError(t, err)
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		zr, err := zip.OpenReader(f.Name())
+		require.NoError(t, err)
+		for _, file := range zr.File {
+			assert.Equal(t, expected[file.Name], file.Method, file.Name)
+		}
+		require.NoError(t, zr.Close())
+
+		testExtract(t, f.Name(), testFiles)
+	}
+}
+
+func TestArchiveWithStoreExtensions(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.txt": {mode: 0666, contents: strings.Repeat("foo", 1024)},
+		"bar.JPG": {mode: 0666, contents: strings.Repeat("bar", 1024)},
+		"baz.gz":  {mode: 0666, contents: strings.Repeat("baz", 1024)},
+		"qux":     {mode: 0666, contents: strings.Repeat("qux", 1024)},
+	}
+
+	tests := map[string]struct {
+		opt      ArchiverOption
+		expected map[string]uint16
+	}{
+		"custom": {
+			opt:      WithArchiverStoreExtensions([]string{"jpg", ".TXT"}),
+			expected: map[string]uint16{"foo.txt": zip.Store, "bar.JPG": zip.Store, "baz.gz": zip.Deflate, "qux": zip.Deflate},
+		},
+		"skip compressed types": {
+			opt:      WithArchiverSkipCompressedTypes(true),
+			expected: map[string]uint16{"foo.txt": zip.Deflate, "bar.JPG": zip.Store, "baz.gz": zip.Store, "qux": zip.Deflate},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			files, dir := testCreateFiles(t, testFiles)
+			defer os.RemoveAll(dir)
+
+			testCreateArchive(t, dir, files, func(filename, chroot string) {
+				zr, err := zip.OpenReader(filename)
+				require.NoError(t, err)
+				defer zr.Close()
+
+				for _, file := range zr.File {
+					if file.Mode().IsDir() {
+						continue
+					}
+					assert.Equal(t, tc.expected[file.Name], file.Method, file.Name)
+				}
+			}, tc.opt)
+		})
+	}
+}
+
+func TestArchiveWithCompressionHeuristic(t *testing.T) {
+	random := make([]byte, 128*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"random": {mode: 0666, contents: string(random)},
+		"text":   {mode: 0666, contents: strings.Repeat("hello world ", 10000)},
+	}
+
+	tests := map[string]struct {
+		opt      ArchiverOption
+		expected map[string]uint16
+	}{
+		"default": {
+			opt:      WithArchiverCompressionHeuristic(true),
+			expected: map[string]uint16{"random": zip.Store, "text": zip.Deflate},
+		},
+		"zero threshold": {
+			opt:      WithArchiverCompressionHeuristicConfig(CompressionHeuristic{SampleSize: 1024, Threshold: 0}),
+			expected: map[string]uint16{"random": zip.Store, "text": zip.Store},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			files, dir := testCreateFiles(t, testFiles)
+			defer os.RemoveAll(dir)
+
+			testCreateArchive(t, dir, files, func(filename, chroot string) {
+				zr, err := zip.OpenReader(filename)
+				require.NoError(t, err)
+				defer zr.Close()
+
+				for _, file := range zr.File {
+					if file.Mode().IsDir() {
+						continue
+					}
+					assert.Equal(t, tc.expected[file.Name], file.Method, file.Name)
+				}
+
+				testExtract(t, filename, testFiles)
+			}, tc.opt)
+		})
+	}
+}
+
+func TestArchiveWithHardLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not detected on windows")
+	}
+
+	testFiles := map[string]testFile{
+		"a":     {mode: 0666, contents: strings.Repeat("hello", 1024)},
+		"other": {mode: 0666, contents: "other"},
+	}
+
+	for _, enabled := range []bool{false, true} {
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		for _, name := range []string{"b", "c"} {
+			require.NoError(t, os.Link(filepath.Join(dir, "a"), filepath.Join(dir, name)))
+		}
+		for _, name := range []string{"a", "b", "c"} {
+			fi, err := os.Lstat(filepath.Join(dir, name))
+			require.NoError(t, err)
+			files[filepath.Join(dir, name)] = fi
+		}
+
+		testCreateArchive(t, dir, files, func(filename, chroot string) {
+			zr, err := zip.OpenReader(filename)
+			require.NoError(t, err)
+			defer zr.Close()
+
+			for _, file := range zr.File {
+				if file.Name == "b" || file.Name == "c" {
+					assert.Equal(t, enabled, isHardlink(file), file.Name)
+				}
+			}
+
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out)
+			require.NoError(t, err)
+			defer e.Close()
+			require.NoError(t, e.Extract(context.Background()))
+
+			_, entries := e.Written()
+			assert.EqualValues(t, len(files), entries)
+
+			a, err := os.Stat(filepath.Join(out, "a"))
+			require.NoError(t, err)
+			for _, name := range []string{"b", "c"} {
+				contents, err := os.ReadFile(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, testFiles["a"].contents, string(contents))
+
+				fi, err := os.Stat(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, enabled, os.SameFile(a, fi))
+			}
+		}, WithArchiverHardLinks(enabled))
+	}
+}
+
 func TestArchiveWithStageDirectory(t *testing.T) {
 	testFiles := map[string]testFile{
 		"foo.go": {mode: 0666},
@@ -434,6 +912,46 @@ func TestArchiveWithOffset(t *testing.T) {
 	testExtract(t, f.Name(), testFiles)
 }
 
+func TestArchiveWithOffsetSeeks(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: "foo"},
+		"bar.go": {mode: 0666, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	f, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stub := []byte(strings.Repeat("#", 1000))
+	_, err = f.WriteAt(stub, 0)
+	require.NoError(t, err)
+
+	// the file is positioned at the start, but seeked to the offset
+	a, err := NewArchiver(f, dir, WithArchiverOffset(int64(len(stub))))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	data, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, stub, data[:len(stub)])
+
+	testExtract(t, f.Name(), testFiles)
+
+	// unseekable writers are left as they are
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	_, err = NewArchiver(w, dir, WithArchiverOffset(int64(len(stub))))
+	require.NoError(t, err)
+}
+
 var archiveDir = flag.String("archivedir", runtime.GOROOT(), "The directory to use for archive benchmarks")
 
 func benchmarkArchiveOptions(b *testing.B, stdDeflate bool, options ...ArchiverOption) {
@@ -536,3 +1054,2018 @@ func BenchmarkArchiveZstd_8(b *testing.B) {
 func BenchmarkArchiveZstd_16(b *testing.B) {
 	benchmarkArchiveOptions(b, true, WithArchiverConcurrency(16), WithArchiverMethod(zstd.ZipMethodWinZip))
 }
+
+func TestArchiveWithZstdDict(t *testing.T) {
+	dict, err := os.ReadFile(filepath.Join("testdata", "zstd.dict"))
+	require.NoError(t, err)
+
+	testFiles := make(map[string]testFile)
+	for i := 0; i < 20; i++ {
+		testFiles[fmt.Sprintf("%d.json", i)] = testFile{
+			mode:     0666,
+			contents: fmt.Sprintf(`{"id": %d, "name": "user%d", "email": "user%d@example.com", "active": true, "roles": ["admin", "viewer"]}`, i, i, i),
+		}
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	compressedSize := func(filename string) (size uint64) {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		defer zr.Close()
+
+		for _, file := range zr.File {
+			size += file.CompressedSize64
+		}
+		return size
+	}
+
+	var plain uint64
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		plain = compressedSize(filename)
+	}, WithArchiverMethod(zstd.ZipMethodWinZip))
+
+	f, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverMethod(zstd.ZipMethodWinZip))
+	require.NoError(t, err)
+	a.RegisterCompressor(zstd.ZipMethodWinZip, ZstdCompressorWithDict(int(zstd.SpeedDefault), dict))
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	assert.Less(t, compressedSize(f.Name()), plain)
+
+	e, err := NewExtractor(f.Name(), t.TempDir())
+	require.NoError(t, err)
+	defer e.Close()
+	e.RegisterDecompressor(zstd.ZipMethodWinZip, ZstdDecompressorWithDict(dict))
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, e.ExtractFile(context.Background(), "7.json", buf))
+	assert.Equal(t, testFiles["7.json"].contents, buf.String())
+
+	// without the dictionary, decompression fails
+	e.RegisterDecompressor(zstd.ZipMethodWinZip, ZstdDecompressor())
+	assert.Error(t, e.ExtractFile(context.Background(), "7.json", io.Discard))
+
+	_, err = ZstdCompressorWithDict(int(zstd.SpeedDefault), []byte("invalid"))(io.Discard)
+	assert.Error(t, err)
+
+	_, err = ZstdDecompressorWithDict([]byte("invalid"))(bytes.NewReader(nil)).Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestArchiveWithLargeFileParallelism(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon\n"}
+
+	var sb strings.Builder
+	for sb.Len() < 3*parallelBlockSize+parallelBlockSize/2 {
+		sb.WriteString(words[rng.Intn(len(words))])
+	}
+
+	testFiles := map[string]testFile{
+		"large":      {mode: 0666, contents: sb.String()},
+		"exact":      {mode: 0666, contents: sb.String()[:2*parallelBlockSize]},
+		"small_file": {mode: 0666, contents: "small"},
+	}
+
+	for _, method := range []uint16{zip.Deflate, zstd.ZipMethodWinZip} {
+		t.Run(fmt.Sprintf("method %d", method), func(t *testing.T) {
+			files, dir := testCreateFiles(t, testFiles)
+			defer os.RemoveAll(dir)
+
+			testCreateArchive(t, dir, files, func(filename, chroot string) {
+				zr, err := zip.OpenReader(filename)
+				require.NoError(t, err)
+				defer zr.Close()
+
+				for _, file := range zr.File {
+					if file.Name == "large" || file.Name == "exact" {
+						assert.Equal(t, method, file.Method)
+						assert.Less(t, file.CompressedSize64, file.UncompressedSize64)
+					}
+				}
+
+				testExtract(t, filename, testFiles)
+			}, WithArchiverMethod(method), WithArchiverConcurrency(4), WithArchiverLargeFileParallelism(true))
+		})
+	}
+
+	t.Run("shared blocks", func(t *testing.T) {
+		testFiles := map[string]testFile{
+			"large1": {mode: 0666, contents: sb.String()},
+			"large2": {mode: 0666, contents: sb.String()},
+			"large3": {mode: 0666, contents: sb.String()},
+		}
+
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		a, err := NewArchiver(io.Discard, dir, WithArchiverConcurrency(2), WithArchiverLargeFileParallelism(true))
+		require.NoError(t, err)
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		// every block is returned once the files sharing them are compressed
+		assert.Len(t, a.blocks, 2)
+	})
+
+	t.Run("not flushable", func(t *testing.T) {
+		testFiles := map[string]testFile{
+			"large": {mode: 0666, contents: sb.String()},
+		}
+
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		a, err := NewArchiver(io.Discard, dir, WithArchiverConcurrency(2), WithArchiverLargeFileParallelism(true))
+		require.NoError(t, err)
+		a.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			fw, err := flate.NewWriter(w, flate.DefaultCompression)
+			return struct{ io.WriteCloser }{fw}, err
+		})
+
+		assert.ErrorIs(t, a.Archive(context.Background(), files), ErrCompressorNotFlushable)
+	})
+}
+
+func TestArchiveWithInMemoryStaging(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: strings.Repeat("foo", 1000)},
+		"bar.go": {mode: 0666, contents: strings.Repeat("bar", 1000)},
+	}
+
+	files, chroot := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(chroot)
+
+	// staging to disk fails the preflight check, as the stage directory
+	// doesn't exist
+	stageDir := filepath.Join(t.TempDir(), "missing")
+
+	for _, inMemory := range []bool{false, true} {
+		f, err := ioutil.TempFile("", "fastzip-test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		a, err := NewArchiver(f, chroot,
+			WithStageDirectory(stageDir),
+			WithArchiverBufferSize(16),
+			WithArchiverConcurrency(2),
+			WithArchiverInMemoryStaging(inMemory))
+		if !inMemory {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		testExtract(t, f.Name(), testFiles)
+	}
+}
+
+func TestArchiveStageDirPreflight(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing")
+
+	_, err := NewArchiver(ioutil.Discard, dir, WithStageDirectory(missing), WithArchiverConcurrency(2))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// the stage directory is unused without concurrency
+	_, err = NewArchiver(ioutil.Discard, dir, WithStageDirectory(missing), WithArchiverConcurrency(1))
+	assert.NoError(t, err)
+
+	// the chroot isn't checked when it's the stage directory, as it may be
+	// read-only and never need staging
+	a, err := NewArchiver(ioutil.Discard, missing, WithArchiverConcurrency(2))
+	require.NoError(t, err)
+	assert.NoError(t, a.Reset(ioutil.Discard, dir))
+
+	// a stage directory that's been set is checked again on reset
+	stageDir := t.TempDir()
+	a, err = NewArchiver(ioutil.Discard, dir, WithStageDirectory(stageDir), WithArchiverConcurrency(2))
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(stageDir))
+	assert.ErrorIs(t, a.Reset(ioutil.Discard, dir), os.ErrNotExist)
+
+	// no files are left behind by the check
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestArchiveWithMaxTotalBufferMemory(t *testing.T) {
+	tests := []struct {
+		bufferSize  int
+		maxMemory   int
+		concurrency int
+		expected    int
+	}{
+		{-1, 0, 16, filepool.DefaultBufferSize},
+		{-1, 16 * 1024 * 1024, 16, 1024 * 1024},
+		{-1, 64 * 1024 * 1024, 16, filepool.DefaultBufferSize},
+		{-1, 1024 * 1024, 64, minBufferSize},
+		{1024, 1024 * 1024, 16, 1024},
+		{4 * 1024 * 1024, 8 * 1024 * 1024, 4, 2 * 1024 * 1024},
+	}
+
+	for _, test := range tests {
+		opts := []ArchiverOption{WithArchiverMaxTotalBufferMemory(test.maxMemory)}
+		if test.bufferSize >= 0 {
+			opts = append(opts, WithArchiverBufferSize(test.bufferSize))
+		}
+
+		a, err := NewArchiver(io.Discard, t.TempDir(), opts...)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, a.bufferSize(test.concurrency), "%+v", test)
+	}
+}
+
+func TestArchiveSmallArchiveThreshold(t *testing.T) {
+	random := make([]byte, 32*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"small":  {mode: 0666, contents: "small"},
+		"random": {mode: 0666, contents: string(random)},
+		"text":   {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 512)},
+	}
+
+	tests := []struct {
+		threshold int64
+		reduced   bool
+	}{
+		{0, false},
+		{1024, false},
+		{1024 * 1024, true},
+	}
+
+	for _, test := range tests {
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		f, err := ioutil.TempFile("", "fastzip-test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		a, err := NewArchiver(f, dir, WithArchiverConcurrency(2), WithArchiverSmallArchiveThreshold(test.threshold))
+		require.NoError(t, err)
+
+		size := a.smallBufferSize(files, filepool.DefaultBufferSize)
+		if test.reduced {
+			assert.Less(t, size, filepool.DefaultBufferSize)
+			assert.Greater(t, size, len(random))
+		} else {
+			assert.Equal(t, filepool.DefaultBufferSize, size)
+		}
+
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+		assert.EqualValues(t, 0, a.StagingStats().SpillCount)
+
+		testExtract(t, f.Name(), testFiles)
+	}
+}
+
+func TestArchiveStagingStats(t *testing.T) {
+	testFiles := map[string]testFile{
+		"small":  {mode: 0666, contents: "small"},
+		"large1": {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 1024)},
+		"large2": {mode: 0666, contents: strings.Repeat("zmkdldjsdfkjsdfsdfiqwpsdfaabcdef", 1024)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	f, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverBufferSize(16), WithArchiverConcurrency(2))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	stats := a.StagingStats()
+	assert.EqualValues(t, 2, stats.SpillCount)
+	assert.Greater(t, stats.SpillBytes, int64(0))
+
+	testExtract(t, f.Name(), testFiles)
+}
+
+func TestArchiveWithMaxStageFiles(t *testing.T) {
+	testFiles := map[string]testFile{
+		"small":  {mode: 0666, contents: "small"},
+		"large1": {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 1024)},
+		"large2": {mode: 0666, contents: strings.Repeat("zmkdldjsdfkjsdfsdfiqwpsdfaabcdef", 1024)},
+		"large3": {mode: 0666, contents: strings.Repeat("sdfsdfiqwpsdfaabcdefzmkdldjsdfkj", 1024)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	f, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stageDir := t.TempDir()
+	a, err := NewArchiver(f, dir, WithArchiverBufferSize(16), WithArchiverConcurrency(4), WithStageDirectory(stageDir), WithArchiverMaxStageFiles(1))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	assert.EqualValues(t, 3, a.StagingStats().SpillCount)
+
+	entries, err := os.ReadDir(stageDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	testExtract(t, f.Name(), testFiles)
+}
+
+func TestArchiveWithNoStaging(t *testing.T) {
+	testFiles := map[string]testFile{
+		"small": {mode: 0666, contents: "small"},
+		"large": {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 1024)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	// the stage directory doesn't exist, so would fail if staging was used
+	stageDir := filepath.Join(t.TempDir(), "missing")
+
+	pr, pw := io.Pipe()
+	a, err := NewArchiver(pw, dir, WithArchiverConcurrency(4), WithArchiverBufferSize(16), WithStageDirectory(stageDir), WithArchiverNoStaging(true))
+	require.NoError(t, err)
+	assert.Equal(t, 1, a.Concurrency())
+
+	go func() {
+		err := a.Archive(context.Background(), files)
+		if err == nil {
+			err = a.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	data, err := io.ReadAll(pr)
+	require.NoError(t, err)
+	assert.Zero(t, a.StagingStats().SpillCount)
+
+	archivePath := filepath.Join(t.TempDir(), "archive.zip")
+	require.NoError(t, os.WriteFile(archivePath, data, 0666))
+	testExtract(t, archivePath, testFiles)
+
+	for _, opt := range []ArchiverOption{
+		WithArchiverLargeFileParallelism(true),
+		WithArchiverInMemoryStaging(true),
+		WithArchiverMaxStageFiles(1),
+	} {
+		_, err := NewArchiver(io.Discard, dir, WithArchiverNoStaging(true), opt)
+		assert.ErrorIs(t, err, ErrStagingRequired)
+	}
+}
+
+func TestArchiveWithVerifyStaging(t *testing.T) {
+	testFiles := map[string]testFile{
+		"small": {mode: 0666, contents: "small"},
+		"large": {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 1024)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		testExtract(t, filename, testFiles)
+	}, WithArchiverBufferSize(16), WithArchiverVerifyStaging(true))
+
+	t.Run("corrupt", func(t *testing.T) {
+		stageDir := t.TempDir()
+		fp, err := filepool.New(stageDir, 1, 16)
+		require.NoError(t, err)
+		defer fp.Close()
+
+		f := fp.Get()
+		data := []byte(strings.Repeat("staged", 100))
+		_, err = f.Write(data)
+		require.NoError(t, err)
+
+		a, err := NewArchiver(io.Discard, dir)
+		require.NoError(t, err)
+
+		checksum := crc32.ChecksumIEEE(data)
+		require.NoError(t, a.verifyStaged(f, checksum))
+
+		// the data is readable again once verified
+		staged, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, data, staged)
+		f.Rewind()
+
+		entries, err := os.ReadDir(stageDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		sf, err := os.OpenFile(filepath.Join(stageDir, entries[0].Name()), os.O_WRONLY, 0)
+		require.NoError(t, err)
+		_, err = sf.WriteAt([]byte("corrupt"), 100)
+		require.NoError(t, err)
+		require.NoError(t, sf.Close())
+
+		assert.ErrorIs(t, a.verifyStaged(f, checksum), ErrStagingCorrupt)
+	})
+}
+
+func TestArchiveWithReadBufferSize(t *testing.T) {
+	testFiles := map[string]testFile{
+		"small": {mode: 0666, contents: "small"},
+		"large": {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 4096)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	for _, size := range []int{16, 1024 * 1024} {
+		testCreateArchive(t, dir, files, func(filename, chroot string) {
+			testExtract(t, filename, testFiles)
+		}, WithArchiverReadBufferSize(size))
+
+		a, err := NewArchiver(io.Discard, dir, WithArchiverReadBufferSize(size))
+		require.NoError(t, err)
+		br := a.readers.Get().(*bufio.Reader)
+		assert.Equal(t, size, br.Size())
+		a.readers.Put(br)
+	}
+
+	_, err := NewArchiver(io.Discard, dir, WithArchiverReadBufferSize(15))
+	assert.ErrorIs(t, err, ErrMinBufferSize)
+}
+
+func TestArchiverPoolsPerInstance(t *testing.T) {
+	dir := t.TempDir()
+
+	a1, err := NewArchiver(io.Discard, dir)
+	require.NoError(t, err)
+	a2, err := NewArchiver(io.Discard, dir, WithArchiverReadBufferSize(64*1024))
+	require.NoError(t, err)
+
+	assert.NotSame(t, a1.readers, a2.readers)
+	assert.Equal(t, defaultBufioSize, a1.readers.Get().(*bufio.Reader).Size())
+	assert.Equal(t, 64*1024, a2.readers.Get().(*bufio.Reader).Size())
+
+	// compressors, and the pools of writers they hold, are per archiver too
+	c1, err := a1.compressors[zip.Deflate](io.Discard)
+	require.NoError(t, err)
+	require.NoError(t, c1.Close())
+	c2, err := a2.compressors[zip.Deflate](io.Discard)
+	require.NoError(t, err)
+	assert.NotSame(t, c1, c2)
+	require.NoError(t, c2.Close())
+}
+
+func TestArchiveWithSkipHandler(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	testFiles := map[string]testFile{
+		"small": {mode: 0666, contents: "small"},
+		"large": {mode: 0666, contents: strings.Repeat("large", 100)},
+		"link":  {mode: os.ModeSymlink | symMode, contents: "small"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	skipped := make(map[string]os.FileMode)
+	a, err := NewArchiver(io.Discard, dir,
+		WithArchiverSymlinkMode(SymlinkSkip),
+		WithArchiverMaxFileSize(100),
+		WithArchiverSkipOversizedFiles(true),
+		WithArchiverSkipHandler(func(name string, fi os.FileInfo) {
+			skipped[name] = fi.Mode().Type()
+		}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	assert.Equal(t, map[string]os.FileMode{
+		filepath.Join(dir, "large"): 0,
+		filepath.Join(dir, "link"):  os.ModeSymlink,
+	}, skipped)
+}
+
+func TestArchiverReset(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: strings.Repeat("foo", 1000)},
+		"bar.go": {mode: 0666, contents: strings.Repeat("bar", 1000)},
+	}
+
+	files1, dir1 := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir1)
+	files2, dir2 := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir2)
+
+	f1, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f1.Name())
+	defer f1.Close()
+
+	f2, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f2.Name())
+	defer f2.Close()
+
+	a, err := NewArchiver(f1, dir1, WithArchiverMethod(ZipMethodBzip2))
+	require.NoError(t, err)
+	a.RegisterCompressor(ZipMethodBzip2, Bzip2Compressor(9))
+	require.NoError(t, a.Archive(context.Background(), files1))
+	require.NoError(t, a.Close())
+
+	require.NoError(t, a.Reset(f2, dir2))
+	assert.Equal(t, Progress{}, a.Progress())
+	assert.Equal(t, dir2, a.options.stageDir)
+
+	// files from the previous chroot are now outside of the chroot
+	require.Error(t, a.Archive(context.Background(), files1))
+
+	require.NoError(t, a.Reset(f2, dir2))
+	require.NoError(t, a.Archive(context.Background(), files2))
+	require.NoError(t, a.Close())
+
+	_, entries := a.Written()
+	assert.EqualValues(t, len(files2), entries)
+
+	for _, filename := range []string{f1.Name(), f2.Name()} {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		for _, file := range zr.File {
+			if !file.Mode().IsDir() {
+				assert.Equal(t, ZipMethodBzip2, file.Method)
+			}
+		}
+		require.NoError(t, zr.Close())
+
+		testExtract(t, filename, testFiles)
+	}
+}
+
+func TestArchiveWithSymlinkMode(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	testFiles := map[string]testFile{
+		"dir":     {mode: os.ModeDir | 0777},
+		"dir/a":   {mode: 0666, contents: "a"},
+		"link":    {mode: os.ModeSymlink | symMode, contents: "dir/a"},
+		"dirlink": {mode: os.ModeSymlink | symMode, contents: "dir"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	modes := func(filename string) map[string]os.FileMode {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		defer zr.Close()
+
+		result := make(map[string]os.FileMode)
+		for _, file := range zr.File {
+			result[file.Name] = file.Mode() &^ os.ModePerm
+		}
+		return result
+	}
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		m := modes(filename)
+		assert.Equal(t, os.ModeSymlink, m["link"])
+		assert.Equal(t, os.ModeSymlink, m["dirlink"])
+	}, WithArchiverSymlinkMode(SymlinkPreserve))
+
+	f, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverSymlinkMode(SymlinkSkip))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+	assert.EqualValues(t, len(files)-2, a.Progress().EntriesTotal)
+
+	m := modes(f.Name())
+	assert.NotContains(t, m, "link")
+	assert.NotContains(t, m, "dirlink")
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		m := modes(filename)
+		assert.Equal(t, os.FileMode(0), m["link"])
+		assert.Equal(t, os.ModeDir, m["dirlink/"])
+
+		e, err := NewExtractor(filename, t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, e.ExtractFile(context.Background(), "link", buf))
+		assert.Equal(t, "a", buf.String())
+	}, WithArchiverSymlinkMode(SymlinkDereference))
+
+	tests := map[string]testFile{
+		"loop":   {mode: os.ModeSymlink | symMode, contents: "loop"},
+		"escape": {mode: os.ModeSymlink | symMode, contents: ".."},
+	}
+	for name, tf := range tests {
+		files, dir := testCreateFiles(t, map[string]testFile{name: tf})
+		defer os.RemoveAll(dir)
+
+		a, err := NewArchiver(io.Discard, dir, WithArchiverSymlinkMode(SymlinkDereference))
+		require.NoError(t, err)
+		assert.Error(t, a.Archive(context.Background(), files), name)
+	}
+}
+
+func TestResolveSymlinkSafely(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	_, dir := testCreateFiles(t, map[string]testFile{
+		"dir":     {mode: os.ModeDir | 0777},
+		"dir/a":   {mode: 0666, contents: "a"},
+		"link":    {mode: os.ModeSymlink | symMode, contents: "dir/a"},
+		"chain":   {mode: os.ModeSymlink | symMode, contents: "link"},
+		"dirlink": {mode: os.ModeSymlink | symMode, contents: "dir"},
+		"escape":  {mode: os.ModeSymlink | symMode, contents: ".."},
+		"cycle1":  {mode: os.ModeSymlink | symMode, contents: "cycle2"},
+		"cycle2":  {mode: os.ModeSymlink | symMode, contents: "cycle1"},
+	})
+	defer os.RemoveAll(dir)
+
+	dir, err := filepath.EvalSymlinks(dir)
+	require.NoError(t, err)
+	a := filepath.Join(dir, "dir", "a")
+
+	for _, name := range []string{"link", "chain", filepath.Join("dirlink", "a")} {
+		resolved, err := resolveSymlinkSafely(filepath.Join(dir, name), dir)
+		require.NoError(t, err, name)
+		assert.Equal(t, a, resolved, name)
+	}
+
+	_, err = resolveSymlinkSafely(filepath.Join(dir, "escape"), dir)
+	assert.ErrorIs(t, err, ErrUnsafeSymlink)
+
+	_, err = resolveSymlinkSafely(filepath.Join(dir, "cycle1"), dir)
+	assert.ErrorIs(t, err, ErrSymlinkLoop)
+
+	_, err = resolveSymlinkSafely(filepath.Join(dir, "missing"), dir)
+	assert.True(t, os.IsNotExist(err))
+
+	// both dereferencing and rejecting unsafe symlinks report the cycle
+	files := map[string]os.FileInfo{}
+	for _, name := range []string{"cycle1", "cycle2"} {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		files[filepath.Join(dir, name)] = fi
+	}
+	for _, opt := range []ArchiverOption{WithArchiverSymlinkMode(SymlinkDereference), WithArchiverRejectUnsafeSymlinks(true)} {
+		ar, err := NewArchiver(io.Discard, dir, opt)
+		require.NoError(t, err)
+		assert.ErrorIs(t, ar.Archive(context.Background(), files), ErrSymlinkLoop)
+	}
+}
+
+func TestArchiveWithRejectUnsafeSymlinks(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	tests := map[string]struct {
+		target string
+		safe   bool
+	}{
+		"relative":    {target: "dir/a", safe: true},
+		"parent":      {target: "../dir/a", safe: true},
+		"chroot":      {target: "..", safe: true},
+		"absolute":    {target: "/etc/passwd", safe: false},
+		"escaping":    {target: "../../secret", safe: false},
+		"dot escaped": {target: "./../../../secret", safe: false},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			files, dir := testCreateFiles(t, map[string]testFile{
+				"dir":      {mode: os.ModeDir | 0777},
+				"dir/a":    {mode: 0666, contents: "a"},
+				"dir/link": {mode: os.ModeSymlink | symMode, contents: tc.target},
+			})
+			defer os.RemoveAll(dir)
+
+			for _, reject := range []bool{false, true} {
+				a, err := NewArchiver(io.Discard, dir, WithArchiverRejectUnsafeSymlinks(reject))
+				require.NoError(t, err)
+
+				err = a.Archive(context.Background(), files)
+				if reject && !tc.safe {
+					assert.ErrorIs(t, err, ErrUnsafeSymlink)
+				} else {
+					assert.NoError(t, err)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveStoredWithoutDataDescriptor(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	testFiles := map[string]testFile{
+		"empty":   {mode: 0666},
+		"stored":  {mode: 0666, contents: "stored"},
+		"deflate": {mode: 0666, contents: strings.Repeat("deflate", 100)},
+		"symlink": {mode: os.ModeSymlink | symMode, contents: "stored"},
+	}
+
+	for _, concurrency := range []int{1, 2} {
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		testCreateArchive(t, dir, files, func(filename, chroot string) {
+			zr, err := zip.OpenReader(filename)
+			require.NoError(t, err)
+			defer zr.Close()
+
+			for _, file := range zr.File {
+				switch file.Name {
+				case "empty", "stored", "symlink":
+					assert.Equal(t, zip.Store, file.Method, file.Name)
+					assert.Zero(t, file.Flags&0x8, "%s has data descriptor", file.Name)
+				case "deflate":
+					assert.NotZero(t, file.Flags&0x8, "%s has no data descriptor", file.Name)
+				}
+			}
+
+			testExtract(t, filename, testFiles)
+		}, WithArchiverConcurrency(concurrency), WithArchiverMethodFunc(func(path string, fi os.FileInfo) uint16 {
+			if fi.Name() == "stored" {
+				return zip.Store
+			}
+			return zip.Deflate
+		}))
+	}
+}
+
+// changingHash modifies the file being stored when it's first written to,
+// which happens between storeKnownSize's two reads.
+type changingHash struct {
+	hash.Hash
+	change func()
+}
+
+func (h *changingHash) Write(p []byte) (int, error) {
+	if h.change != nil {
+		h.change()
+		h.change = nil
+	}
+	return h.Hash.Write(p)
+}
+
+func TestArchiveStoredFileChanged(t *testing.T) {
+	tests := map[string]struct {
+		change func(f *os.File) error
+		err    error
+	}{
+		"shrunk": {
+			change: func(f *os.File) error { return f.Truncate(50) },
+			err:    ErrFileChanged,
+		},
+		"modified": {
+			change: func(f *os.File) error {
+				_, err := f.WriteAt([]byte("modified"), 10)
+				return err
+			},
+			err: ErrFileChanged,
+		},
+		// growth is seen by the first read, so the file is streamed instead
+		"grown": {
+			change: func(f *os.File) error {
+				_, err := f.WriteAt([]byte("grown"), 100)
+				return err
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "stored")
+			require.NoError(t, ioutil.WriteFile(path, bytes.Repeat([]byte("a"), 100), 0666))
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			require.NoError(t, err)
+			defer f.Close()
+
+			fi, err := f.Stat()
+			require.NoError(t, err)
+
+			a, err := NewArchiver(ioutil.Discard, dir)
+			require.NoError(t, err)
+			defer a.Close()
+
+			br := a.readers.Get().(*bufio.Reader)
+			defer a.readers.Put(br)
+
+			hdr := &zip.FileHeader{Name: "stored", Method: zip.Store, UncompressedSize64: 100}
+			digest := &changingHash{Hash: sha256.New(), change: func() {
+				require.NoError(t, tc.change(f))
+			}}
+
+			ok, err := a.storeKnownSize(context.Background(), br, f, fi, hdr, digest)
+			if tc.err == nil {
+				assert.False(t, ok)
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, ok)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func TestArchiveWithForceZip64(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: strings.Repeat("bar", 1000)},
+		"foo/baz": {mode: 0666, contents: "baz"},
+		"empty":   {mode: 0666},
+	}
+
+	for _, concurrency := range []int{1, 2} {
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		testCreateArchive(t, dir, files, func(filename, chroot string) {
+			data, err := os.ReadFile(filename)
+			require.NoError(t, err)
+
+			eocd := findDirectoryEnd(data)
+			require.GreaterOrEqual(t, eocd, directory64LocLen+directory64EndLen)
+			assert.EqualValues(t, directory64EndSignature, binary.LittleEndian.Uint32(data[eocd-directory64LocLen-directory64EndLen:]))
+			assert.EqualValues(t, directory64LocSignature, binary.LittleEndian.Uint32(data[eocd-directory64LocLen:]))
+
+			zr, err := zip.OpenReader(filename)
+			require.NoError(t, err)
+			defer zr.Close()
+
+			require.Len(t, zr.File, len(files))
+			for _, file := range zr.File {
+				fields, err := zipextra.Parse(file.Extra)
+				require.NoError(t, err)
+				assert.Contains(t, fields, uint16(zip64ExtraID), file.Name)
+			}
+
+			testExtract(t, filename, testFiles)
+		}, WithArchiverForceZip64(true), WithArchiverConcurrency(concurrency))
+	}
+}
+
+func TestArchiveWithRateLimit(t *testing.T) {
+	data := make([]byte, 256*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	testFiles := map[string]testFile{
+		"foo":     {mode: 0666, contents: string(data[:128*1024])},
+		"bar":     {mode: 0666, contents: string(data[128*1024:])},
+		"baz/qux": {mode: 0666, contents: "qux"},
+		"baz":     {mode: os.ModeDir | 0777},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	start := time.Now()
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		testExtract(t, filename, testFiles)
+	}, WithArchiverMethod(zip.Store), WithArchiverConcurrency(2), WithArchiverRateLimit(1024*1024))
+
+	// 256KiB at 1MiB/s with an initially empty bucket takes at least 250ms
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestArchiveWithRateLimitCancel(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo": {mode: 0666, contents: strings.Repeat("foo", 64*1024)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, "archive.zip"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverMethod(zip.Store), WithArchiverRateLimit(1024))
+	require.NoError(t, err)
+	defer a.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = a.Archive(ctx, files)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestArchiverAccessors(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := NewArchiver(ioutil.Discard, dir,
+		WithArchiverMethod(zstd.ZipMethodWinZip),
+		WithArchiverConcurrency(3),
+		WithArchiverOffset(512),
+	)
+	require.NoError(t, err)
+	defer a.Close()
+
+	abs, err := filepath.Abs(dir)
+	require.NoError(t, err)
+
+	assert.Equal(t, abs, a.Chroot())
+	assert.Equal(t, 3, a.Concurrency())
+	assert.EqualValues(t, zstd.ZipMethodWinZip, a.CompressionMethod())
+	assert.EqualValues(t, 512, a.Offset())
+}
+
+func TestArchivePaths(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	testFiles := map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/bar":     {mode: 0666, contents: "bar"},
+		"foo/symlink": {mode: os.ModeSymlink | symMode, contents: "bar"},
+		"baz":         {mode: 0666, contents: "baz"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+
+	f, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir)
+	require.NoError(t, err)
+	require.NoError(t, a.ArchivePaths(context.Background(), paths))
+	require.NoError(t, a.Close())
+
+	testExtract(t, f.Name(), testFiles)
+
+	a, err = NewArchiver(ioutil.Discard, dir)
+	require.NoError(t, err)
+	defer a.Close()
+
+	err = a.ArchivePaths(context.Background(), []string{filepath.Join(dir, "missing")})
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWalkDir(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	testFiles := map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/bar":     {mode: 0666, contents: "bar"},
+		"foo/baz":     {mode: os.ModeDir | 0777},
+		"foo/baz/qux": {mode: 0666, contents: "qux"},
+		"symlink":     {mode: os.ModeSymlink | symMode, contents: "foo"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	walked, err := WalkDir(dir)
+	require.NoError(t, err)
+
+	// the root is included, the symlink to a directory is not recursed into
+	require.Len(t, walked, len(testFiles)+1)
+	require.Contains(t, walked, dir)
+	for path := range files {
+		assert.Contains(t, walked, path)
+	}
+	assert.Equal(t, os.ModeSymlink, walked[filepath.Join(dir, "symlink")].Mode()&os.ModeSymlink)
+
+	testCreateArchive(t, dir, walked, func(filename, chroot string) {
+		testExtract(t, filename, testFiles)
+	})
+
+	_, err = WalkDir(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestArchiveWithOmitRootDir(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar"},
+		"baz":     {mode: 0666, contents: "baz"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+	require.Contains(t, files, dir)
+
+	for _, omit := range []bool{false, true} {
+		t.Run(fmt.Sprintf("omit %v", omit), func(t *testing.T) {
+			f, err := ioutil.TempFile("", "fastzip-test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			a, err := NewArchiver(f, dir, WithArchiverOmitRootDir(omit))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			progress := a.Progress()
+			assert.Equal(t, progress.EntriesTotal, progress.EntriesDone)
+
+			zr, err := zip.OpenReader(f.Name())
+			require.NoError(t, err)
+			defer zr.Close()
+
+			var names []string
+			for _, file := range zr.File {
+				names = append(names, file.Name)
+			}
+
+			if omit {
+				assert.ElementsMatch(t, []string{"foo/", "foo/bar", "baz"}, names)
+			} else {
+				assert.ElementsMatch(t, []string{"./", "foo/", "foo/bar", "baz"}, names)
+			}
+		})
+	}
+}
+
+func TestFileInfoHeaderNames(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), nil, 0666))
+
+	dirInfo, err := os.Stat(dir)
+	require.NoError(t, err)
+	fileInfo, err := os.Stat(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		prefix, name string
+		fi           os.FileInfo
+		expected     string
+	}{
+		{"", "a//b/", dirInfo, "a/b/"},
+		{"", "a//b//", dirInfo, "a/b/"},
+		{"", "/a/b", dirInfo, "a/b/"},
+		{"", "a//b/", fileInfo, "a/b"},
+		{"", ".", dirInfo, "./"},
+		{"prefix", "a//b", fileInfo, "prefix/a/b"},
+		{"prefix", ".", dirInfo, "prefix/"},
+		{"", "a/./b", fileInfo, ""},
+		{"", "a/../b", fileInfo, ""},
+		{"", "..", dirInfo, ""},
+		{"", "//", dirInfo, ""},
+	}
+
+	for _, tc := range tests {
+		var hdr zip.FileHeader
+		err := fileInfoHeader(tc.prefix, tc.name, tc.fi, &hdr)
+		if tc.expected == "" {
+			assert.ErrorIs(t, err, ErrInvalidName, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, hdr.Name, tc.name)
+	}
+
+	// entries with quirky names extract to the expected structure
+	archivePath := filepath.Join(t.TempDir(), "names.zip")
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+	zw := zip.NewWriter(f)
+	for _, entry := range []struct {
+		name string
+		fi   os.FileInfo
+	}{{"a", dirInfo}, {"a//b/", dirInfo}, {"a//b//file", fileInfo}} {
+		var hdr zip.FileHeader
+		require.NoError(t, fileInfoHeader("", entry.name, entry.fi, &hdr))
+		_, err := zw.CreateHeader(&hdr)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	testExtract(t, archivePath, map[string]testFile{
+		"a":        {mode: os.ModeDir | dirInfo.Mode().Perm()},
+		"a/b":      {mode: os.ModeDir | dirInfo.Mode().Perm()},
+		"a/b/file": {mode: fileInfo.Mode().Perm()},
+	})
+}
+
+func TestArchiveWithPrefix(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar"},
+		"baz":     {mode: 0666, contents: "baz"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+	require.Contains(t, files, dir)
+
+	f, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverPrefix("./release/1.2.3/"))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	progress := a.Progress()
+	assert.Equal(t, progress.EntriesTotal, progress.EntriesDone)
+
+	zr, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer zr.Close()
+
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	assert.ElementsMatch(t, []string{
+		"release/",
+		"release/1.2.3/",
+		"release/1.2.3/foo/",
+		"release/1.2.3/foo/bar",
+		"release/1.2.3/baz",
+	}, names)
+
+	for _, prefix := range []string{"/abs", "..", "../foo", "foo/../.."} {
+		_, err := NewArchiver(ioutil.Discard, dir, WithArchiverPrefix(prefix))
+		assert.ErrorIs(t, err, ErrInvalidPrefix, prefix)
+	}
+}
+
+func TestArchiveUnicodePath(t *testing.T) {
+	testFiles := map[string]testFile{
+		"héllo":       {mode: os.ModeDir | 0777},
+		"héllo/wörld": {mode: 0666, contents: "wörld"},
+		"ascii":       {mode: 0666, contents: "ascii"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			testCreateArchive(t, dir, files, func(filename, chroot string) {
+				zr, err := zip.OpenReader(filename)
+				require.NoError(t, err)
+				defer zr.Close()
+
+				for _, file := range zr.File {
+					fields, err := zipextra.Parse(file.Extra)
+					require.NoError(t, err)
+
+					field, ok := fields[extraFieldUnicodePath]
+					if file.Name == "ascii" || file.Name == "./" {
+						assert.False(t, ok, file.Name)
+						continue
+					}
+					require.True(t, ok, file.Name)
+					assert.Equal(t, file.Name, string(field[5:]))
+					assert.Equal(t, file.Name, unicodePath(file))
+				}
+
+				testExtract(t, filename, testFiles)
+			}, WithArchiverConcurrency(concurrency))
+		})
+	}
+}
+
+func TestArchiveDuplicateNames(t *testing.T) {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		t.Skip("filesystem may not allow names differing only in normalization")
+	}
+
+	nfc, nfd := norm.NFC.String("café"), norm.NFD.String("café")
+	testFiles := map[string]testFile{
+		nfc: {mode: 0666, contents: "nfc"},
+		nfd: {mode: 0666, contents: "nfd"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	// once normalized, both files have the same name
+	a, err := NewArchiver(io.Discard, dir, WithArchiverNormalizeNames(norm.NFC))
+	require.NoError(t, err)
+	assert.ErrorIs(t, a.Archive(context.Background(), files), ErrDuplicateName)
+
+	var buf bytes.Buffer
+	a, err = NewArchiver(&buf, dir, WithArchiverNormalizeNames(norm.NFC), WithArchiverAllowDuplicateNames(true))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	assert.Equal(t, []string{"./", nfc, nfc}, names)
+}
+
+func TestArchiveWithNormalizeNames(t *testing.T) {
+	nfd := norm.NFD.String("café")
+	testFiles := map[string]testFile{
+		nfd:                {mode: os.ModeDir | 0777},
+		nfd + "/" + "menu": {mode: 0666, contents: "menu"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		defer zr.Close()
+
+		var names []string
+		for _, file := range zr.File {
+			names = append(names, file.Name)
+		}
+		assert.ElementsMatch(t, []string{"./", "café/", "café/menu"}, names)
+	}, WithArchiverNormalizeNames(norm.NFC))
+}
+
+func TestArchiveWithLogger(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not supported on windows")
+	}
+
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"random":  {mode: 0666, contents: string(random)},
+		"text":    {mode: 0666, contents: strings.Repeat("text", 1000)},
+		"symlink": {mode: os.ModeSymlink | 0777, contents: "text"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	var (
+		mu       sync.Mutex
+		messages []string
+	)
+	logger := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, fmt.Sprintf(format, args...))
+	}
+
+	a, err := NewArchiver(ioutil.Discard, dir,
+		WithArchiverLogger(logger),
+		WithArchiverConcurrency(2),
+		WithArchiverSymlinkMode(SymlinkSkip),
+	)
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	require.Len(t, messages, 2)
+	assert.Contains(t, messages, "skipping symlink "+filepath.Join(dir, "symlink"))
+	assert.Contains(t, messages[0]+messages[1], "storing random, compressed size")
+}
+
+func TestArchiveWithMaxFileSize(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":       {mode: os.ModeDir | 0777},
+		"foo/small": {mode: 0666, contents: "small"},
+		"large":     {mode: 0666, contents: strings.Repeat("large", 100)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	t.Run("error", func(t *testing.T) {
+		a, err := NewArchiver(ioutil.Discard, dir, WithArchiverMaxFileSize(100))
+		require.NoError(t, err)
+
+		err = a.Archive(context.Background(), files)
+		assert.ErrorIs(t, err, ErrMaxFileSize)
+		assert.Contains(t, err.Error(), "large")
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "fastzip-test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		a, err := NewArchiver(f, dir, WithArchiverMaxFileSize(100), WithArchiverSkipOversizedFiles(true))
+		require.NoError(t, err)
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		progress := a.Progress()
+		assert.Equal(t, progress.EntriesTotal, progress.EntriesDone)
+
+		zr, err := zip.OpenReader(f.Name())
+		require.NoError(t, err)
+		defer zr.Close()
+
+		var names []string
+		for _, file := range zr.File {
+			names = append(names, file.Name)
+		}
+		assert.ElementsMatch(t, []string{"./", "foo/", "foo/small"}, names)
+	})
+}
+
+func TestArchiveErrorStopsWorkers(t *testing.T) {
+	random := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"a": {mode: 0666, contents: string(random)},
+		"b": {mode: 0666, contents: strings.Repeat("b", 512*1024)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	// "a" is queued to a worker, but writing it at the rate limit takes
+	// seconds, whereas "b" exceeds the maximum file size immediately
+	a, err := NewArchiver(ioutil.Discard, dir,
+		WithArchiverConcurrency(2),
+		WithArchiverRateLimit(64*1024),
+		WithArchiverMaxFileSize(384*1024),
+	)
+	require.NoError(t, err)
+
+	err = a.Archive(context.Background(), files)
+	assert.ErrorIs(t, err, ErrMaxFileSize)
+
+	// only the chroot's directory entry can have been written
+	_, entries := a.Written()
+	assert.LessOrEqual(t, entries, int64(1))
+}
+
+func TestArchiveWithStoreDirectories(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/bar":     {mode: 0666, contents: "bar"},
+		"foo/baz":     {mode: os.ModeDir | 0777},
+		"foo/baz/qux": {mode: 0666, contents: "qux"},
+		"empty":       {mode: os.ModeDir | 0777},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	f, err := ioutil.TempFile("", "fastzip-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	a, err := NewArchiver(f, dir, WithArchiverStoreDirectories(false))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	progress := a.Progress()
+	assert.EqualValues(t, 2, progress.EntriesTotal)
+	assert.EqualValues(t, 2, progress.EntriesDone)
+
+	zr, err := zip.OpenReader(f.Name())
+	require.NoError(t, err)
+	defer zr.Close()
+
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	assert.ElementsMatch(t, []string{"foo/bar", "foo/baz/qux"}, names)
+
+	// directories are implied by file paths, empty directories are lost
+	out := t.TempDir()
+	e, err := NewExtractor(f.Name(), out)
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.Extract(context.Background()))
+
+	contents, err := os.ReadFile(filepath.Join(out, "foo", "baz", "qux"))
+	require.NoError(t, err)
+	assert.Equal(t, "qux", string(contents))
+
+	_, err = os.Stat(filepath.Join(out, "empty"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestArchiveWithStoreOwnership(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ownership is not stored on windows")
+	}
+
+	testFiles := map[string]testFile{
+		"foo":       {mode: os.ModeDir | 0777},
+		"foo/bar":   {mode: 0666, contents: "bar"},
+		"foo/large": {mode: 0666, contents: strings.Repeat("large", 512*1024)},
+		"foo/link":  {mode: os.ModeSymlink | 0777, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	for _, store := range []bool{true, false} {
+		t.Run(fmt.Sprintf("store %v", store), func(t *testing.T) {
+			testCreateArchive(t, dir, files, func(filename, chroot string) {
+				zr, err := zip.OpenReader(filename)
+				require.NoError(t, err)
+				defer zr.Close()
+
+				for _, file := range zr.File {
+					fields, err := zipextra.Parse(file.Extra)
+					require.NoError(t, err)
+
+					_, ok := fields[zipextra.ExtraFieldUnixN]
+					assert.Equal(t, store, ok, "entry %v", file.Name)
+				}
+			}, WithArchiverStoreOwnership(store))
+		})
+	}
+}
+
+func TestArchiveWithDigest(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"foo":           {mode: os.ModeDir | 0777},
+		"foo/text":      {mode: 0666, contents: strings.Repeat("foo", 1000)},
+		"foo/random":    {mode: 0666, contents: string(random)},
+		"foo/large":     {mode: 0666, contents: strings.Repeat("large", 512*1024)},
+		"foo/stored.gz": {mode: 0666, contents: "stored"},
+		"empty":         {mode: 0666},
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			files, dir := testCreateFiles(t, testFiles)
+			defer os.RemoveAll(dir)
+
+			f, err := ioutil.TempFile("", "fastzip-test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			a, err := NewArchiver(f, dir,
+				WithArchiverConcurrency(concurrency),
+				WithArchiverDigest(crypto.SHA256),
+				WithArchiverSkipCompressedTypes(true),
+				WithArchiverLargeFileParallelism(true),
+			)
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			digests := a.Digests()
+			require.Len(t, digests, 5)
+			for name, tf := range testFiles {
+				if tf.mode.IsDir() {
+					continue
+				}
+				sum := sha256.Sum256([]byte(tf.contents))
+				assert.Equal(t, sum[:], digests[name], name)
+			}
+		})
+	}
+
+	_, err := NewArchiver(ioutil.Discard, t.TempDir(), WithArchiverDigest(crypto.MD4))
+	assert.ErrorIs(t, err, ErrHashUnavailable)
+}
+
+func TestArchiveEntryMethods(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"foo":           {mode: os.ModeDir | 0777},
+		"foo/text":      {mode: 0666, contents: strings.Repeat("foo", 1000)},
+		"foo/random":    {mode: 0666, contents: string(random)},
+		"foo/stored.gz": {mode: 0666, contents: "stored"},
+		"empty":         {mode: 0666},
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			files, dir := testCreateFiles(t, testFiles)
+			defer os.RemoveAll(dir)
+
+			f, err := ioutil.TempFile("", "fastzip-test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			a, err := NewArchiver(f, dir,
+				WithArchiverConcurrency(concurrency),
+				WithArchiverSkipCompressedTypes(true),
+			)
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			methods := a.EntryMethods()
+			require.Len(t, methods, 4)
+			assert.Equal(t, zip.Deflate, methods["foo/text"])
+			assert.Equal(t, zip.Store, methods["foo/stored.gz"])
+			if concurrency > 1 {
+				// only staged files fall back to Store when larger compressed
+				assert.Equal(t, zip.Store, methods["foo/random"])
+			}
+
+			zr, err := zip.OpenReader(f.Name())
+			require.NoError(t, err)
+			defer zr.Close()
+
+			for _, file := range zr.File {
+				if !file.Mode().IsRegular() {
+					continue
+				}
+				assert.Equal(t, file.Method, methods[file.Name], file.Name)
+			}
+
+			require.NoError(t, a.Reset(ioutil.Discard, dir))
+			assert.Empty(t, a.EntryMethods())
+		})
+	}
+}
+
+func TestArchiveSpanned(t *testing.T) {
+	random := make([]byte, 200*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"foo":        {mode: os.ModeDir | 0777},
+		"foo/random": {mode: 0666, contents: string(random[:150*1024])},
+		"foo/text":   {mode: 0666, contents: strings.Repeat("foo", 10000)},
+		"bar":        {mode: 0666, contents: string(random[150*1024:])},
+		"empty":      {mode: 0666},
+	}
+
+	tests := map[string][]ArchiverOption{
+		"default":    nil,
+		"zip64":      {WithArchiverForceZip64(true)},
+		"single":     nil,
+		"partSize":   nil,
+		"sequential": {WithArchiverConcurrency(1)},
+	}
+
+	for tn, opts := range tests {
+		t.Run(tn, func(t *testing.T) {
+			files, dir := testCreateFiles(t, testFiles)
+			defer os.RemoveAll(dir)
+
+			partSize := int64(MinPartSize)
+			if tn == "single" {
+				partSize = 1024 * 1024
+			}
+
+			out := t.TempDir()
+			base := filepath.Join(out, "archive")
+
+			if tn == "partSize" {
+				_, err := NewSpannedArchiver(base, dir, MinPartSize-1)
+				assert.ErrorIs(t, err, ErrMinPartSize)
+				return
+			}
+
+			a, err := NewSpannedArchiver(base+".zip", dir, partSize, opts...)
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			// parts other than the last are exactly the part size
+			var parts [][]byte
+			for i := 1; ; i++ {
+				data, err := os.ReadFile(fmt.Sprintf("%s.z%02d", base, i))
+				if os.IsNotExist(err) {
+					break
+				}
+				require.NoError(t, err)
+				assert.EqualValues(t, partSize, len(data))
+				parts = append(parts, data)
+			}
+			last, err := os.ReadFile(base + ".zip")
+			require.NoError(t, err)
+			parts = append(parts, last)
+
+			sig := uint32(spanSignature)
+			if tn == "single" {
+				require.Len(t, parts, 1)
+				sig = spanMarkerSignature
+			} else {
+				require.Greater(t, len(parts), 1)
+			}
+			assert.EqualValues(t, sig, binary.LittleEndian.Uint32(parts[0]))
+
+			eocd := findDirectoryEnd(last)
+			require.GreaterOrEqual(t, eocd, 0)
+			assert.EqualValues(t, len(parts)-1, binary.LittleEndian.Uint16(last[eocd+4:]))
+
+			// each entry's local file header is found at its part and offset
+			dirDisk := int(binary.LittleEndian.Uint16(last[eocd+6:]))
+			dirOffset := int64(binary.LittleEndian.Uint32(last[eocd+16:]))
+			dirSize := int64(binary.LittleEndian.Uint32(last[eocd+12:]))
+			if tn == "zip64" {
+				end64 := last[eocd-directory64LocLen-directory64EndLen:]
+				require.EqualValues(t, directory64EndSignature, binary.LittleEndian.Uint32(end64))
+				assert.EqualValues(t, len(parts)-1, binary.LittleEndian.Uint32(end64[16:]))
+				dirDisk = int(binary.LittleEndian.Uint32(end64[20:]))
+				dirOffset = int64(binary.LittleEndian.Uint64(end64[48:]))
+				dirSize = int64(binary.LittleEndian.Uint64(end64[40:]))
+			}
+
+			joined := bytes.Join(parts, nil)
+			dirStart := int64(dirDisk)*partSize + dirOffset
+			dir2 := joined[dirStart : dirStart+dirSize]
+
+			var names []string
+			for len(dir2) > 0 {
+				require.EqualValues(t, directoryHeaderSignature, binary.LittleEndian.Uint32(dir2))
+				nameLen := int(binary.LittleEndian.Uint16(dir2[28:]))
+				extraLen := int(binary.LittleEndian.Uint16(dir2[30:]))
+				commentLen := int(binary.LittleEndian.Uint16(dir2[32:]))
+				disk := int64(binary.LittleEndian.Uint16(dir2[34:]))
+				offset := int64(binary.LittleEndian.Uint32(dir2[42:]))
+				if offset == uint32max {
+					fields, err := zipextra.Parse(dir2[directoryHeaderLen+nameLen : directoryHeaderLen+nameLen+extraLen])
+					require.NoError(t, err)
+					offset = int64(binary.LittleEndian.Uint64(fields[zip64ExtraID][16:]))
+				}
+				require.Less(t, offset, partSize)
+
+				name := string(dir2[directoryHeaderLen : directoryHeaderLen+nameLen])
+				local := joined[disk*partSize+offset:]
+				assert.EqualValues(t, 0x04034b50, binary.LittleEndian.Uint32(local), name)
+				assert.Equal(t, name, string(local[30:30+nameLen]))
+
+				names = append(names, name)
+				dir2 = dir2[directoryHeaderLen+nameLen+extraLen+commentLen:]
+			}
+			assert.ElementsMatch(t, []string{"./", "foo/", "foo/random", "foo/text", "bar", "empty"}, names)
+		})
+	}
+}
+
+func TestArchiverCopyEntry(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	testFiles := map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/bar":     {mode: 0666, contents: strings.Repeat("bar", 1000)},
+		"foo/baz":     {mode: 0666, contents: "baz"},
+		"foo/symlink": {mode: os.ModeSymlink | symMode, contents: "bar"},
+		"empty":       {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		defer zr.Close()
+
+		f, err := ioutil.TempFile("", "fastzip-test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		a, err := NewArchiver(f, t.TempDir(), WithArchiverForceZip64(true))
+		require.NoError(t, err)
+		for _, file := range zr.File {
+			require.NoError(t, a.CopyEntry(context.Background(), file))
+		}
+		require.NoError(t, a.Close())
+
+		progress := a.Progress()
+		assert.EqualValues(t, len(zr.File), progress.EntriesDone)
+		assert.EqualValues(t, len(zr.File), progress.EntriesTotal)
+
+		copied, err := zip.OpenReader(f.Name())
+		require.NoError(t, err)
+		defer copied.Close()
+
+		require.Len(t, copied.File, len(zr.File))
+		for i, file := range copied.File {
+			src := zr.File[i]
+			assert.Equal(t, src.Name, file.Name)
+			assert.Equal(t, src.Method, file.Method)
+			assert.Equal(t, src.CRC32, file.CRC32)
+			assert.Equal(t, src.CompressedSize64, file.CompressedSize64)
+			assert.Equal(t, src.Mode(), file.Mode())
+			assert.True(t, src.Modified.Equal(file.Modified))
+		}
+
+		testExtract(t, f.Name(), testFiles)
+	}, WithArchiverMethod(zstd.ZipMethodWinZip))
+}
+
+func TestArchiverMerge(t *testing.T) {
+	archive := func(t *testing.T, testFiles map[string]testFile) string {
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		a, err := NewArchiver(f, dir, WithArchiverOmitRootDir(true))
+		require.NoError(t, err)
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		return f.Name()
+	}
+
+	shard1 := archive(t, map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/bar.txt": {mode: 0666, contents: "bar1"},
+		"foo/.hidden": {mode: 0666, contents: "hidden1"},
+		"one":         {mode: 0666, contents: "one"},
+	})
+	shard2 := archive(t, map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/bar.txt": {mode: 0666, contents: "bar2"},
+		"foo/.hidden": {mode: 0666, contents: "hidden2"},
+		"two":         {mode: 0666, contents: "two"},
+	})
+
+	tests := map[MergePolicy]map[string]string{
+		MergeError: nil,
+		MergeSkip: {
+			"foo/bar.txt": "bar1",
+			"foo/.hidden": "hidden1",
+			"one":         "one",
+			"two":         "two",
+		},
+		MergeRename: {
+			"foo/bar.txt":   "bar1",
+			"foo/.hidden":   "hidden1",
+			"foo/bar_1.txt": "bar2",
+			"foo/.hidden_1": "hidden2",
+			"one":           "one",
+			"two":           "two",
+		},
+	}
+
+	for policy, expected := range tests {
+		t.Run(fmt.Sprintf("policy %d", policy), func(t *testing.T) {
+			var extractors []*Extractor
+			for _, shard := range []string{shard1, shard2} {
+				e, err := NewExtractor(shard, t.TempDir())
+				require.NoError(t, err)
+				defer e.Close()
+				extractors = append(extractors, e)
+			}
+
+			f, err := os.Create(filepath.Join(t.TempDir(), "merged.zip"))
+			require.NoError(t, err)
+			defer f.Close()
+
+			a, err := NewArchiver(f, t.TempDir(), WithArchiverMergePolicy(policy))
+			require.NoError(t, err)
+
+			err = a.Merge(context.Background(), extractors...)
+			if expected == nil {
+				assert.ErrorIs(t, err, ErrDuplicateName)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, a.Close())
+
+			zr, err := zip.OpenReader(f.Name())
+			require.NoError(t, err)
+			defer zr.Close()
+
+			contents := make(map[string]string)
+			for _, file := range zr.File {
+				if file.Mode().IsDir() {
+					assert.Equal(t, "foo/", file.Name)
+					continue
+				}
+
+				rc, err := file.Open()
+				require.NoError(t, err)
+				data, err := io.ReadAll(rc)
+				rc.Close()
+				require.NoError(t, err)
+				contents[file.Name] = string(data)
+			}
+			assert.Equal(t, expected, contents)
+		})
+	}
+}
+
+func TestArchiverForAppend(t *testing.T) {
+	readArchive := func(t *testing.T, filename string) map[string]string {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		defer zr.Close()
+
+		contents := make(map[string]string)
+		for _, file := range zr.File {
+			rc, err := file.Open()
+			require.NoError(t, err)
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			require.NoError(t, err)
+			contents[file.Name] = string(data)
+		}
+		return contents
+	}
+
+	initial := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar1"},
+		"baz":     {mode: 0666, contents: strings.Repeat("baz", 1000)},
+	}
+	appended := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar2"},
+		"qux":     {mode: 0666, contents: strings.Repeat("qux", 1000)},
+	}
+
+	tests := map[string]struct {
+		opts     []ArchiverOption
+		expected map[string]string
+	}{
+		"error": {
+			opts: []ArchiverOption{WithArchiverMergePolicy(MergeError)},
+		},
+		"skip": {
+			opts: []ArchiverOption{WithArchiverMergePolicy(MergeSkip)},
+			expected: map[string]string{
+				"foo/": "", "foo/bar": "bar1", "baz": strings.Repeat("baz", 1000), "qux": strings.Repeat("qux", 1000),
+			},
+		},
+		"rename": {
+			opts: []ArchiverOption{WithArchiverMergePolicy(MergeRename)},
+			expected: map[string]string{
+				"foo/": "", "foo/bar": "bar1", "foo/bar_1": "bar2", "baz": strings.Repeat("baz", 1000), "qux": strings.Repeat("qux", 1000),
+			},
+		},
+		"zip64": {
+			opts: []ArchiverOption{WithArchiverMergePolicy(MergeSkip), WithArchiverForceZip64(true)},
+			expected: map[string]string{
+				"foo/": "", "foo/bar": "bar1", "baz": strings.Repeat("baz", 1000), "qux": strings.Repeat("qux", 1000),
+			},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			files, dir := testCreateFiles(t, initial)
+			defer os.RemoveAll(dir)
+
+			filename := filepath.Join(t.TempDir(), "archive.zip")
+			f, err := os.Create(filename)
+			require.NoError(t, err)
+
+			a, err := NewArchiver(f, dir, WithArchiverOmitRootDir(true))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+			require.NoError(t, f.Close())
+
+			files, dir = testCreateFiles(t, appended)
+			defer os.RemoveAll(dir)
+
+			opts := append([]ArchiverOption{WithArchiverOmitRootDir(true), WithArchiverConcurrency(2)}, tc.opts...)
+			a, err = NewArchiverForAppend(filename, dir, opts...)
+			require.NoError(t, err)
+
+			err = a.Archive(context.Background(), files)
+			if tc.expected == nil {
+				assert.ErrorIs(t, err, ErrDuplicateName)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, a.Close())
+
+			assert.Equal(t, tc.expected, readArchive(t, filename))
+
+			// the combined archive can be appended to again
+			files, dir = testCreateFiles(t, map[string]testFile{
+				"again": {mode: 0666, contents: "again"},
+			})
+			defer os.RemoveAll(dir)
+
+			a, err = NewArchiverForAppend(filename, dir, tc.opts...)
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			contents := readArchive(t, filename)
+			assert.Equal(t, "again", contents["again"])
+			assert.Len(t, contents, len(tc.expected)+2)
+		})
+	}
+}
+
+func TestArchiverForAppendCopyEntry(t *testing.T) {
+	createArchive := func(t *testing.T, filename, contents string) {
+		f, err := os.Create(filename)
+		require.NoError(t, err)
+		defer f.Close()
+
+		zw := zip.NewWriter(f)
+		w, err := zw.Create("foo")
+		require.NoError(t, err)
+		_, err = w.Write([]byte(contents))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+	}
+
+	src := filepath.Join(t.TempDir(), "src.zip")
+	createArchive(t, src, "foo2")
+
+	zr, err := zip.OpenReader(src)
+	require.NoError(t, err)
+	defer zr.Close()
+
+	for _, policy := range []MergePolicy{MergeError, MergeRename} {
+		filename := filepath.Join(t.TempDir(), "archive.zip")
+		createArchive(t, filename, "foo1")
+
+		a, err := NewArchiverForAppend(filename, t.TempDir(), WithArchiverMergePolicy(policy))
+		require.NoError(t, err)
+
+		err = a.CopyEntry(context.Background(), zr.File[0])
+		if policy == MergeError {
+			assert.ErrorIs(t, err, ErrDuplicateName)
+			require.NoError(t, a.Close())
+			continue
+		}
+		require.NoError(t, err)
+		require.NoError(t, a.Close())
+
+		ar, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		defer ar.Close()
+
+		var names []string
+		for _, file := range ar.File {
+			names = append(names, file.Name)
+		}
+		assert.Equal(t, []string{"foo", "foo_1"}, names)
+	}
+}
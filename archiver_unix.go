@@ -11,22 +11,54 @@ import (
 
 	"github.com/klauspost/compress/zip"
 	"github.com/saracen/zipextra"
+	"golang.org/x/sys/unix"
 )
 
+const irregularSupported = true
+
 func (a *Archiver) createHeader(fi os.FileInfo, hdr *zip.FileHeader) (io.Writer, error) {
-	stat, ok := fi.Sys().(*syscall.Stat_t)
-	if ok {
-		hdr.Extra = append(hdr.Extra, zipextra.NewInfoZIPNewUnix(big.NewInt(int64(stat.Uid)), big.NewInt(int64(stat.Gid))).Encode()...)
-	}
+	storeUnicodePath(hdr)
+
+	a.storeOwnership(fi, hdr)
 
 	return a.zw.CreateHeader(hdr)
 }
 
 func (a *Archiver) createRaw(fi os.FileInfo, hdr *zip.FileHeader) (io.Writer, error) {
+	a.storeOwnership(fi, hdr)
+
+	return a.zw.CreateRaw(hdr)
+}
+
+// storeOwnership appends the Info-ZIP Unix extra field, with the file's uid and
+// gid, unless storing ownership has been disabled.
+func (a *Archiver) storeOwnership(fi os.FileInfo, hdr *zip.FileHeader) {
+	if !a.options.storeOwnership {
+		return
+	}
+
 	stat, ok := fi.Sys().(*syscall.Stat_t)
 	if ok {
 		hdr.Extra = append(hdr.Extra, zipextra.NewInfoZIPNewUnix(big.NewInt(int64(stat.Uid)), big.NewInt(int64(stat.Gid))).Encode()...)
 	}
+}
 
-	return a.zw.CreateRaw(hdr)
+func getFileID(fi os.FileInfo) (fileID, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink <= 1 {
+		return fileID{}, false
+	}
+
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// deviceExtra returns the device number extra field for device files.
+func deviceExtra(fi os.FileInfo) []byte {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || fi.Mode()&os.ModeDevice == 0 {
+		return nil
+	}
+
+	rdev := uint64(stat.Rdev)
+	return encodeDevice(unix.Major(rdev), unix.Minor(rdev))
 }
@@ -10,10 +10,24 @@ import (
 	"github.com/klauspost/compress/zip"
 )
 
+const irregularSupported = false
+
 func (a *Archiver) createHeader(fi os.FileInfo, hdr *zip.FileHeader) (io.Writer, error) {
+	storeUnicodePath(hdr)
+
 	return a.zw.CreateHeader(hdr)
 }
 
 func (a *Archiver) createRaw(fi os.FileInfo, hdr *zip.FileHeader) (io.Writer, error) {
 	return a.zw.CreateRaw(hdr)
 }
+
+// getFileID is unsupported on Windows, as os.FileInfo doesn't provide the file
+// index, so hard links are archived as independent files.
+func getFileID(fi os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func deviceExtra(fi os.FileInfo) []byte {
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build linux || openbsd || dragonfly
+// +build linux openbsd dragonfly
+
+package fastzip
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(stat.Atim.Unix()), true
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !openbsd && !dragonfly && !darwin && !freebsd && !netbsd && !windows
+// +build !linux,!openbsd,!dragonfly,!darwin,!freebsd,!netbsd,!windows
+
+package fastzip
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime is unsupported on platforms where the access time isn't
+// available from the file info.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
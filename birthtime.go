@@ -0,0 +1,90 @@
+package fastzip
+
+import (
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/saracen/zipextra"
+)
+
+// storeCreationTime adds an NTFS extra field holding the file's creation time,
+// if the platform provides one.
+func storeCreationTime(fi os.FileInfo, hdr *zip.FileHeader) {
+	btime, ok := birthTime(fi)
+	if !ok {
+		return
+	}
+
+	hdr.Extra = append(hdr.Extra, zipextra.NewNTFS(zipextra.NTFSTimeAttribute{
+		MTime: hdr.Modified,
+		ATime: hdr.Modified,
+		CTime: btime,
+	}).Encode()...)
+}
+
+// storeNTFSTimes adds an NTFS extra field holding the file's modification,
+// access and creation times, with 100 nanosecond precision. The modification
+// time is used in place of the access or creation time, if the platform
+// doesn't provide them.
+func storeNTFSTimes(fi os.FileInfo, hdr *zip.FileHeader) {
+	mtime := fi.ModTime()
+
+	atime, ok := accessTime(fi)
+	if !ok {
+		atime = mtime
+	}
+
+	btime, ok := birthTime(fi)
+	if !ok {
+		btime = mtime
+	}
+
+	hdr.Extra = append(hdr.Extra, zipextra.NewNTFS(zipextra.NTFSTimeAttribute{
+		MTime: mtime,
+		ATime: atime,
+		CTime: btime,
+	}).Encode()...)
+}
+
+// ntfsModTime returns the modification time stored in an NTFS extra field.
+func ntfsModTime(fields map[uint16]zipextra.ExtraField) (time.Time, bool) {
+	field, ok := fields[zipextra.ExtraFieldNTFS]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	ntfs, err := field.NTFS()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	for _, attr := range ntfs.Attributes {
+		if t, ok := attr.(zipextra.NTFSTimeAttribute); ok && !t.MTime.IsZero() {
+			return t.MTime, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// creationTime returns the creation time stored in an NTFS extra field.
+func creationTime(fields map[uint16]zipextra.ExtraField) (time.Time, bool) {
+	field, ok := fields[zipextra.ExtraFieldNTFS]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	ntfs, err := field.NTFS()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	for _, attr := range ntfs.Attributes {
+		if t, ok := attr.(zipextra.NTFSTimeAttribute); ok && !t.CTime.IsZero() {
+			return t.CTime, true
+		}
+	}
+
+	return time.Time{}, false
+}
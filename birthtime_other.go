@@ -0,0 +1,19 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package fastzip
+
+import (
+	"os"
+	"time"
+)
+
+// birthTime is unsupported on platforms where the creation time is either not
+// available or not reliably settable, such as Linux.
+func birthTime(fi os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func setBirthTime(path string, mode os.FileMode, btime time.Time) error {
+	return nil
+}
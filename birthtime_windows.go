@@ -0,0 +1,44 @@
+//go:build windows
+// +build windows
+
+package fastzip
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileFlagOpenReparsePoint opens a symlink rather than its target.
+const fileFlagOpenReparsePoint = 0x00200000
+
+func birthTime(fi os.FileInfo) (time.Time, bool) {
+	data, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, data.CreationTime.Nanoseconds()), true
+}
+
+func setBirthTime(path string, mode os.FileMode, btime time.Time) error {
+	pathp, err := syscall.UTF16PtrFromString(longPath(path))
+	if err != nil {
+		return err
+	}
+
+	// backup semantics are required to open directories
+	flags := uint32(syscall.FILE_FLAG_BACKUP_SEMANTICS)
+	if mode&os.ModeSymlink != 0 {
+		flags |= fileFlagOpenReparsePoint
+	}
+
+	h, err := syscall.CreateFile(pathp, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, flags, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(h)
+
+	ctime := syscall.NsecToFiletime(btime.UnixNano())
+	return syscall.SetFileTime(h, &ctime, nil, nil)
+}
@@ -0,0 +1,92 @@
+package fastzip
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+// contextReaderAt is a ReaderAt whose reads return once either its own context
+// or the context of the extraction in progress is done.
+type contextReaderAt struct {
+	r   io.ReaderAt
+	ctx context.Context
+
+	// op holds the context of the extraction in progress, set by the
+	// extractor whilst reads may be in progress
+	op atomic.Value
+}
+
+// opContext wraps a context, as atomic.Value requires a consistent type.
+type opContext struct {
+	ctx context.Context
+}
+
+// ContextReaderAt returns a ReaderAt that reads from r, but returns the
+// context's error as soon as ctx is done, rather than waiting for a blocked
+// read to return. This is useful for slow sources, such as HTTP range
+// requests.
+//
+// When the ReaderAt returned is passed to NewExtractorFromReader, or
+// ResetFromReader, reads also return once the context passed to Extract,
+// ExtractGlob, ExtractFile or Verify is done.
+//
+// Each read is performed in its own goroutine, into its own buffer, so that
+// an abandoned read can't write to the caller's buffer after it has returned.
+// Reads are made directly when neither context can be cancelled.
+// An abandoned read continues until r returns, so r should still eventually
+// return, for example by also honoring ctx.
+func ContextReaderAt(ctx context.Context, r io.ReaderAt) io.ReaderAt {
+	cr := &contextReaderAt{r: r, ctx: ctx}
+	cr.op.Store(opContext{context.Background()})
+	return cr
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (r *contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	op := r.op.Load().(opContext).ctx
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := op.Err(); err != nil {
+		return 0, err
+	}
+
+	// neither context can be cancelled, so the read can't be abandoned
+	if r.ctx.Done() == nil && op.Done() == nil {
+		return r.r.ReadAt(p, off)
+	}
+
+	buf := make([]byte, len(p))
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := r.r.ReadAt(buf, off)
+		done <- readResult{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		return copy(p, buf[:res.n]), res.err
+
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+
+	case <-op.Done():
+		return 0, op.Err()
+	}
+}
+
+// setContext sets the context of the extraction in progress, returning a
+// function that clears it.
+func (r *contextReaderAt) setContext(ctx context.Context) func() {
+	if r == nil {
+		return func() {}
+	}
+
+	r.op.Store(opContext{ctx})
+	return func() { r.op.Store(opContext{context.Background()}) }
+}
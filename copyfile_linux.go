@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package fastzip
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyFileRangeChunk is the maximum number of bytes copied per call, so that
+// cancellation is checked regularly.
+const copyFileRangeChunk = 4 * 1024 * 1024
+
+// copyFileRange copies size bytes at offset of src to dst's current offset
+// using copy_file_range, adding the bytes copied to written. False is returned
+// if the kernel or filesystem doesn't support copying between the files, with
+// nothing having been copied.
+func copyFileRange(ctx context.Context, dst, src *os.File, offset, size int64, written *int64) (bool, error) {
+	var copied int64
+	for copied < size {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+
+		n := size - copied
+		if n > copyFileRangeChunk {
+			n = copyFileRangeChunk
+		}
+
+		m, err := unix.CopyFileRange(int(src.Fd()), &offset, int(dst.Fd()), nil, int(n), 0)
+		if err != nil {
+			if copied == 0 && (err == unix.EXDEV || err == unix.ENOSYS || err == unix.EINVAL || err == unix.EOPNOTSUPP) {
+				return false, nil
+			}
+			return true, err
+		}
+		if m == 0 {
+			return true, io.ErrUnexpectedEOF
+		}
+
+		copied += int64(m)
+		atomic.AddInt64(written, int64(m))
+	}
+
+	return true, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package fastzip
+
+import (
+	"context"
+	"os"
+)
+
+// copyFileRange is only supported on Linux.
+func copyFileRange(ctx context.Context, dst, src *os.File, offset, size int64, written *int64) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,5 @@
+package fastzip
+
+// dosAttributesMask is the hidden and system DOS attributes, which are
+// restored from an entry's external attributes.
+const dosAttributesMask = 0x02 | 0x04
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package fastzip
+
+import "os"
+
+const dosAttributesSupported = false
+
+func dosAttributes(fi os.FileInfo) (uint8, bool) {
+	return 0, false
+}
+
+func setDOSAttributes(path string, mode os.FileMode, attrs uint8) error {
+	return nil
+}
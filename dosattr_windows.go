@@ -0,0 +1,50 @@
+//go:build windows
+// +build windows
+
+package fastzip
+
+import (
+	"os"
+	"syscall"
+)
+
+const dosAttributesSupported = true
+
+// dosAttributes returns the DOS attributes of a file, which occupy the low 8
+// bits of a zip entry's external attributes.
+func dosAttributes(fi os.FileInfo) (uint8, bool) {
+	data, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return 0, false
+	}
+
+	return uint8(data.FileAttributes), true
+}
+
+// setDOSAttributes restores the hidden and system attributes of a file. The
+// read-only attribute is restored with the file's permissions.
+func setDOSAttributes(path string, mode os.FileMode, attrs uint8) error {
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	pathp, err := syscall.UTF16PtrFromString(longPath(path))
+	if err != nil {
+		return err
+	}
+
+	current, err := syscall.GetFileAttributes(pathp)
+	if err != nil {
+		return &os.PathError{Op: "getfileattributes", Path: path, Err: err}
+	}
+
+	updated := current&^dosAttributesMask | uint32(attrs)&dosAttributesMask
+	if updated == current {
+		return nil
+	}
+
+	if err := syscall.SetFileAttributes(pathp, updated); err != nil {
+		return &os.PathError{Op: "setfileattributes", Path: path, Err: err}
+	}
+	return nil
+}
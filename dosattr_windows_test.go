@@ -0,0 +1,66 @@
+//go:build windows
+// +build windows
+
+package fastzip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDOSAttributes(t *testing.T) {
+	testFiles := map[string]testFile{
+		"hidden": {mode: 0666, contents: "hidden"},
+		"plain":  {mode: 0666, contents: "plain"},
+	}
+
+	_, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	pathp, err := syscall.UTF16PtrFromString(filepath.Join(dir, "hidden"))
+	require.NoError(t, err)
+	require.NoError(t, syscall.SetFileAttributes(pathp, syscall.FILE_ATTRIBUTE_HIDDEN))
+
+	// re-stat the files, so the attributes are up to date
+	files := make(map[string]os.FileInfo)
+	err = filepath.Walk(dir, func(pathname string, fi os.FileInfo, err error) error {
+		files[pathname] = fi
+		return err
+	})
+	require.NoError(t, err)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		zr, err := zip.OpenReader(filename)
+		require.NoError(t, err)
+		for _, file := range zr.File {
+			switch file.Name {
+			case "hidden":
+				assert.NotZero(t, file.ExternalAttrs&syscall.FILE_ATTRIBUTE_HIDDEN)
+			case "plain":
+				assert.Zero(t, file.ExternalAttrs&syscall.FILE_ATTRIBUTE_HIDDEN)
+			}
+		}
+		require.NoError(t, zr.Close())
+
+		for _, restore := range []bool{true, false} {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out, WithExtractorRestoreDOSAttributes(restore))
+			require.NoError(t, err)
+			require.NoError(t, e.Extract(context.Background()))
+			require.NoError(t, e.Close())
+
+			pathp, err := syscall.UTF16PtrFromString(filepath.Join(out, "hidden"))
+			require.NoError(t, err)
+			attrs, err := syscall.GetFileAttributes(pathp)
+			require.NoError(t, err)
+			assert.Equal(t, restore, attrs&syscall.FILE_ATTRIBUTE_HIDDEN != 0)
+		}
+	})
+}
@@ -2,10 +2,14 @@ package fastzip
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -19,17 +23,24 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-var bufioWriterPool = sync.Pool{
-	New: func() interface{} {
-		return bufio.NewWriterSize(nil, 32*1024)
-	},
-}
-
 var (
-	defaultDecompressor     = FlateDecompressor()
-	defaultZstdDecompressor = ZstdDecompressor()
+	// ErrEntryNotFound is returned by ExtractFile and OpenRaw when the archive
+	// has no entry with the name provided.
+	ErrEntryNotFound = errors.New("entry not found")
+
+	// ErrNotRegularFile is returned by ExtractFile when the named entry is not
+	// a regular file.
+	ErrNotRegularFile = errors.New("entry is not a regular file")
+
+	// ErrSymlinkTargetTooLong is returned when a symlink's target exceeds the
+	// maximum length.
+	ErrSymlinkTargetTooLong = errors.New("symlink target too long")
 )
 
+// maxSymlinkTarget is the maximum length of a symlink's target, which is read
+// into memory. This is well beyond the path limits of supported platforms.
+const maxSymlinkTarget = 64 * 1024
+
 // Extractor is an opinionated Zip file extractor.
 //
 // Files are extracted in parallel. Only regular files, symlinks and directories
@@ -37,42 +48,110 @@ var (
 //
 // Access permissions, ownership (unix) and modification times are preserved.
 type Extractor struct {
-	// This 2 fields are accessed via atomic operations
+	// This 3 fields are accessed via atomic operations
 	// They are at the start of the struct so they are properly 8 byte aligned
-	written, entries int64
+	written, entries, uncompressed int64
 
 	zr      *zip.Reader
 	closer  io.Closer
+	src     *os.File
 	m       sync.Mutex
 	options extractorOptions
 	chroot  string
+	chown   bool
+	umask   os.FileMode
+
+	// flattened maps entry names to their flattened names, so that hard
+	// links find their targets when flattening
+	flattened map[string]string
+
+	decompressors map[uint16]zip.Decompressor
+	rl            *rateLimiter
+
+	// writers is the pool of buffered writers files are written with
+	writers *sync.Pool
+
+	// cr is the reader of the archive, if it's a ContextReaderAt, so that
+	// reads are canceled with the extraction
+	cr *contextReaderAt
+
+	// lzma indicates whether the default LZMA decompressor is in use
+	lzma bool
+
+	// placeholders indicates whether empty files are created in place of
+	// regular files, when extracting the structure
+	placeholders bool
 }
 
 // NewExtractor opens a zip file and returns a new extractor.
 //
+// Archives with data prepended, such as self-extracting archives, are
+// supported, whether or not their offsets account for the prepended data. The
+// archive is located from the end of central directory record, which is found
+// by scanning at most the last 65KiB of the file, so the cost doesn't depend on
+// the size of the prepended data.
+//
 // Close() should be called to close the extractor's underlying zip.Reader
 // when done.
 func NewExtractor(filename, chroot string, opts ...ExtractorOption) (*Extractor, error) {
-	zr, err := zip.OpenReader(filename)
+	zr, f, err := openZipFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := newExtractor(zr, f, chroot, opts)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
+	return e, nil
+}
+
+// openZipFile opens a zip file. Unlike zip.OpenReader, the file is returned,
+// so that stored entries can be copied from it directly.
+func openZipFile(filename string) (*zip.Reader, *os.File, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
 
-	return newExtractor(&zr.Reader, zr, chroot, opts)
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return zr, f, nil
 }
 
 // NewExtractor returns a new extractor, reading from the reader provided.
 //
-// The size of the archive should be provided.
+// The size of the archive should be provided. As with NewExtractor, archives
+// with data prepended are supported.
 //
 // Unlike with NewExtractor(), calling Close() on the extractor is unnecessary.
+//
+// Canceling the context passed to Extract only stops reads from r once they
+// return. To interrupt reads from slow sources, wrap r with ContextReaderAt.
 func NewExtractorFromReader(r io.ReaderAt, size int64, chroot string, opts ...ExtractorOption) (*Extractor, error) {
 	zr, err := zip.NewReader(r, size)
 	if err != nil {
 		return nil, err
 	}
 
-	return newExtractor(zr, nil, chroot, opts)
+	e, err := newExtractor(zr, nil, chroot, opts)
+	if err != nil {
+		return nil, err
+	}
+	e.cr, _ = r.(*contextReaderAt)
+
+	return e, nil
 }
 
 func newExtractor(r *zip.Reader, c io.Closer, chroot string, opts []ExtractorOption) (*Extractor, error) {
@@ -82,12 +161,21 @@ func newExtractor(r *zip.Reader, c io.Closer, chroot string, opts []ExtractorOpt
 	}
 
 	e := &Extractor{
-		chroot: chroot,
-		zr:     r,
-		closer: c,
+		chroot:        chroot,
+		zr:            r,
+		closer:        c,
+		decompressors: make(map[uint16]zip.Decompressor),
 	}
+	e.src, _ = c.(*os.File)
 
 	e.options.concurrency = runtime.GOMAXPROCS(0)
+	e.options.restoreDOSAttrs = dosAttributesSupported
+	e.options.fileModeMask = ^os.FileMode(0)
+	e.options.dirModeMask = ^os.FileMode(0)
+	e.options.flattenPolicy = MergeRename
+	e.options.writeBufferSize = defaultBufioSize
+	e.options.verifyStored = true
+	e.options.progressInterval = defaultProgressInterval
 	for _, o := range opts {
 		err := o(&e.options)
 		if err != nil {
@@ -95,16 +183,108 @@ func newExtractor(r *zip.Reader, c io.Closer, chroot string, opts []ExtractorOpt
 		}
 	}
 
-	e.RegisterDecompressor(zip.Deflate, defaultDecompressor)
-	e.RegisterDecompressor(zstd.ZipMethodWinZip, defaultZstdDecompressor)
+	// writers are pooled per extractor, as they're sized by its options
+	e.writers = &sync.Pool{
+		New: func() interface{} {
+			return bufio.NewWriterSize(nil, e.options.writeBufferSize)
+		},
+	}
+
+	if e.options.rateLimit > 0 {
+		e.rl = newRateLimiter(e.options.rateLimit)
+	}
+
+	if e.options.applyUmask {
+		e.umask = umask()
+	}
+
+	switch e.options.chownPolicy {
+	case ChownAuto:
+		e.chown = os.Geteuid() == 0
+	case ChownNever:
+		e.chown = false
+	default:
+		e.chown = true
+	}
+
+	e.RegisterDecompressor(zip.Deflate, FlateDecompressor())
+	e.RegisterDecompressor(zstd.ZipMethodWinZip, ZstdDecompressor())
+	e.RegisterDecompressor(ZipMethodBzip2, Bzip2Decompressor())
+	e.RegisterDecompressor(ZipMethodLZMA, LZMADecompressor())
+	e.RegisterDecompressor(ZipMethodDeflate64, Deflate64Decompressor())
+	e.lzma = true
 
 	return e, nil
 }
 
+// Reset closes the current archive and rebinds the Extractor to the zip file
+// and chroot provided, keeping the options and registered decompressors, and
+// resets the written and entries counters.
+//
+// Reset must not be called concurrently with Extract.
+func (e *Extractor) Reset(filename, chroot string) error {
+	zr, f, err := openZipFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := e.reset(zr, f, chroot); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// ResetFromReader is like Reset, but reads the archive from the reader
+// provided, as with NewExtractorFromReader.
+func (e *Extractor) ResetFromReader(r io.ReaderAt, size int64, chroot string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	if err := e.reset(zr, nil, chroot); err != nil {
+		return err
+	}
+	e.cr, _ = r.(*contextReaderAt)
+
+	return nil
+}
+
+func (e *Extractor) reset(r *zip.Reader, c io.Closer, chroot string) error {
+	chroot, err := filepath.Abs(chroot)
+	if err != nil {
+		return err
+	}
+
+	if err := e.Close(); err != nil {
+		return err
+	}
+
+	e.zr = r
+	e.closer = c
+	e.src, _ = c.(*os.File)
+	e.cr = nil
+	e.chroot = chroot
+	for method, dcomp := range e.decompressors {
+		e.zr.RegisterDecompressor(method, dcomp)
+	}
+
+	atomic.StoreInt64(&e.written, 0)
+	atomic.StoreInt64(&e.entries, 0)
+	atomic.StoreInt64(&e.uncompressed, 0)
+
+	return nil
+}
+
 // RegisterDecompressor allows custom decompressors for a specified method ID.
 // The common methods Store and Deflate are built in.
 func (e *Extractor) RegisterDecompressor(method uint16, dcomp zip.Decompressor) {
 	e.zr.RegisterDecompressor(method, dcomp)
+	e.decompressors[method] = dcomp
+	if method == ZipMethodLZMA {
+		e.lzma = false
+	}
 }
 
 // Files returns the file within the archive.
@@ -112,6 +292,51 @@ func (e *Extractor) Files() []*zip.File {
 	return e.zr.File
 }
 
+// EntryInfo describes an entry within the archive.
+type EntryInfo struct {
+	Name               string
+	UncompressedSize64 uint64
+	CompressedSize64   uint64
+	Mode               os.FileMode
+	Modified           time.Time
+	CRC32              uint32
+	Method             uint16
+}
+
+// Manifest returns information about each entry within the archive, without
+// extracting them.
+func (e *Extractor) Manifest() []EntryInfo {
+	entries := make([]EntryInfo, len(e.zr.File))
+	for i, file := range e.zr.File {
+		entries[i] = EntryInfo{
+			Name:               file.Name,
+			UncompressedSize64: file.UncompressedSize64,
+			CompressedSize64:   file.CompressedSize64,
+			Mode:               file.Mode(),
+			Modified:           file.Modified,
+			CRC32:              file.CRC32,
+			Method:             file.Method,
+		}
+	}
+	return entries
+}
+
+// Chroot returns the absolute path of the directory files are extracted to.
+func (e *Extractor) Chroot() string {
+	return e.chroot
+}
+
+// Concurrency returns the maximum number of files extracted concurrently.
+func (e *Extractor) Concurrency() int {
+	return e.options.concurrency
+}
+
+// Comment returns the archive's comment, from the end of central directory
+// record.
+func (e *Extractor) Comment() string {
+	return e.zr.Comment
+}
+
 // Close closes the underlying ZipReader.
 func (e *Extractor) Close() error {
 	if e.closer == nil {
@@ -126,39 +351,281 @@ func (e *Extractor) Written() (bytes, entries int64) {
 	return atomic.LoadInt64(&e.written), atomic.LoadInt64(&e.entries)
 }
 
+// Progress returns a snapshot of the extraction progress. EntriesTotal is the
+// number of entries in the archive.
+// Progress can be called whilst extraction is in progress.
+func (e *Extractor) Progress() Progress {
+	return Progress{
+		BytesWritten: atomic.LoadInt64(&e.written),
+		EntriesDone:  atomic.LoadInt64(&e.entries),
+		EntriesTotal: int64(len(e.zr.File)),
+	}
+}
+
+// defaultProgressInterval is the default minimum time between calls to the
+// progress handler.
+const defaultProgressInterval = 100 * time.Millisecond
+
+// reportProgress starts calling the progress handler, if set, at most once per
+// progress interval, skipping calls when no progress has been made since
+// reporting started or the last call. The function returned stops reporting,
+// calling the handler a final time if progress has been made since the last
+// call.
+func (e *Extractor) reportProgress() func() {
+	fn := e.options.progressHandler
+	if fn == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(e.options.progressInterval)
+		defer ticker.Stop()
+
+		last := e.Progress()
+		report := func() {
+			if p := e.Progress(); p != last {
+				last = p
+				fn(p)
+			}
+		}
+
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-stop:
+				report()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
 // Extract extracts files, creates symlinks and directories from the
 // archive.
 func (e *Extractor) Extract(ctx context.Context) (err error) {
+	return e.extract(ctx, nil)
+}
+
+// ExtractGlob extracts only the entries with names matching the pattern
+// provided, using the syntax of path.Match. Names are taken from the Unicode
+// Path extra field where present, as when extracting. The trailing slash of
+// directory entries is ignored when matching. Parent directories of matched entries are
+// created, but their metadata is only restored if they also match.
+func (e *Extractor) ExtractGlob(ctx context.Context, pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+
+	return e.extract(ctx, func(file *zip.File) bool {
+		matched, _ := path.Match(pattern, strings.TrimSuffix(unicodePath(file), "/"))
+		return matched
+	})
+}
+
+// ExtractStructure extracts the archive's structure, without decompressing
+// any file contents. Directories, symlinks and hard links are extracted as
+// usual, but each regular file is created as an empty placeholder, with the
+// file's permissions, timestamps and other metadata restored. This is much
+// faster than a full extraction, and is useful for previewing an archive's
+// layout.
+//
+// ExtractStructure must not be called concurrently with other extractions.
+func (e *Extractor) ExtractStructure(ctx context.Context) error {
+	e.placeholders = true
+	defer func() { e.placeholders = false }()
+
+	return e.extract(ctx, nil)
+}
+
+// extract extracts the entries for which match returns true, or all entries
+// if match is nil. With atomic extraction, the entries are extracted to a
+// temporary sibling of the chroot, which then replaces the chroot.
+func (e *Extractor) extract(ctx context.Context, match func(*zip.File) bool) (err error) {
+	defer e.cr.setContext(ctx)()
+	defer e.reportProgress()()
+
+	if !e.options.atomic {
+		return e.extractEntries(ctx, match)
+	}
+
+	chroot := e.chroot
+	parent := filepath.Dir(chroot)
+	if err := os.MkdirAll(parent, 0777); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(chroot)+".fastzip-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	// os.MkdirTemp creates the directory with restricted permissions, whereas
+	// the chroot would otherwise be created with the default permissions
+	if err := os.Chmod(tmp, 0777&^umask()); err != nil {
+		return err
+	}
+
+	e.chroot = tmp
+	err = e.extractEntries(ctx, match)
+	e.chroot = chroot
+	if err != nil {
+		return err
+	}
+
+	if err = replaceDir(tmp, chroot); err != nil {
+		return err
+	}
+
+	if e.options.fsync {
+		return syncDir(parent)
+	}
+	return nil
+}
+
+// replaceDir renames dir to target, replacing target if it exists. The
+// existing target is first moved aside, and restored if the rename fails.
+func replaceDir(dir, target string) error {
+	var old string
+	if _, err := os.Lstat(target); err == nil {
+		old = dir + ".old"
+		if err := os.Rename(target, old); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(dir, target); err != nil {
+		if old != "" {
+			os.Rename(old, target)
+		}
+		return err
+	}
+
+	if old != "" {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
+
+// extractEntries extracts the entries for which match returns true, or all
+// entries if match is nil, to the chroot.
+func (e *Extractor) extractEntries(ctx context.Context, match func(*zip.File) bool) (err error) {
+	// the central directory is fully parsed upfront, so an archive with too
+	// many entries can be rejected before anything is extracted
+	if max := e.options.maxEntries; max > 0 && len(e.zr.File) > max {
+		return ErrMaxEntries
+	}
+
+	if e.options.rejectDuplicates {
+		if err := e.checkDuplicateNames(match); err != nil {
+			return err
+		}
+	}
+
 	limiter := make(chan struct{}, e.options.concurrency)
+	atomic.StoreInt64(&e.uncompressed, 0)
 
-	wg, ctx := errgroup.WithContext(ctx)
+	// the errgroup's context is canceled once Wait returns, so the parent
+	// context is kept for the deferred symlink and directory phases
+	wg, gctx := errgroup.WithContext(ctx)
 	defer func() {
 		if werr := wg.Wait(); werr != nil {
 			err = werr
 		}
 	}()
 
+	var errs entryErrors
+	type deferredEntry struct {
+		path string
+		file *zip.File
+	}
+	var deferred, hardlinks []deferredEntry
+
+	var flattenedNames map[string]struct{}
+	if e.options.flatten {
+		flattenedNames = make(map[string]struct{})
+		e.flattened = make(map[string]string)
+	}
+
+	// directories that entries are extracted to, synced once extraction has
+	// finished
+	var dirs map[string]struct{}
+	if e.options.fsync {
+		dirs = make(map[string]struct{})
+	}
+
 	for i, file := range e.zr.File {
-		if file.Mode()&irregularModes != 0 {
+		if file.Mode()&irregularModes != 0 && !e.options.irregular {
+			e.logf("skipping irregular entry %s", file.Name)
 			continue
 		}
 
-		var path string
-		path, err = filepath.Abs(filepath.Join(e.chroot, file.Name))
-		if err != nil {
-			return err
+		if match != nil && !match(file) {
+			continue
 		}
 
-		if !strings.HasPrefix(path, e.chroot+string(filepath.Separator)) && path != e.chroot {
-			return fmt.Errorf("%s cannot be extracted outside of chroot (%s)", path, e.chroot)
+		name, ok := e.entryName(unicodePath(file))
+		if !ok {
+			e.logf("skipping entry %s, excluded by its name", file.Name)
+			continue
 		}
 
-		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
-			return err
+		if e.options.flatten {
+			var err error
+			name, ok, err = e.flatten(file, name, flattenedNames)
+			if err != nil {
+				if err = errs.handle(e.options.continueOnError, file.Name, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if !ok {
+				continue
+			}
 		}
 
-		if ctx.Err() != nil {
-			return ctx.Err()
+		path, err := e.entryPath(name)
+		if err == nil {
+			// the depth is checked before any parent directories are created
+			err = e.checkPathDepth(path)
+		}
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(path), 0777)
+		}
+		if err != nil {
+			if err = errs.handle(e.options.continueOnError, file.Name, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if gctx.Err() != nil {
+			return gctx.Err()
+		}
+
+		if dirs != nil {
+			for dir := filepath.Dir(path); within(e.chroot, dir); dir = filepath.Dir(dir) {
+				if _, ok := dirs[dir]; ok {
+					break
+				}
+				dirs[dir] = struct{}{}
+			}
 		}
 
 		switch {
@@ -166,10 +633,34 @@ func (e *Extractor) Extract(ctx context.Context) (err error) {
 			// defer the creation of symlinks
 			// this is to prevent a traversal vulnerability where a symlink is
 			// first created and then files are additional extracted into it
+			e.logf("deferring symlink %s", file.Name)
+			deferred = append(deferred, deferredEntry{path, file})
 			continue
 
 		case file.Mode().IsDir():
 			err = e.createDirectory(path, file)
+			if err == nil {
+				deferred = append(deferred, deferredEntry{path, file})
+			}
+
+		case file.Mode()&irregularModes != 0:
+			err = e.createIrregular(path, file)
+			if err == nil {
+				err = e.updateFileMetadata(path, file)
+			}
+
+		case isHardlink(file):
+			// defer the creation of hard links until their targets have been
+			// extracted
+			e.logf("deferring hard link %s", file.Name)
+			hardlinks = append(hardlinks, deferredEntry{path, file})
+			continue
+
+		case e.placeholders:
+			err = e.createPlaceholder(path)
+			if err == nil {
+				err = e.updateFileMetadata(path, file)
+			}
 
 		default:
 			limiter <- struct{}{}
@@ -177,15 +668,17 @@ func (e *Extractor) Extract(ctx context.Context) (err error) {
 			gf := e.zr.File[i]
 			wg.Go(func() error {
 				defer func() { <-limiter }()
-				err := e.createFile(ctx, path, gf)
-				if err == nil {
-					err = e.updateFileMetadata(path, gf)
+				err := e.extractFile(gctx, path, gf)
+				if err != nil && gctx.Err() == nil {
+					err = errs.handle(e.options.continueOnError, gf.Name, err)
 				}
 				return err
 			})
 		}
 		if err != nil {
-			return err
+			if err = errs.handle(e.options.continueOnError, file.Name, err); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -193,60 +686,507 @@ func (e *Extractor) Extract(ctx context.Context) (err error) {
 		return err
 	}
 
+	// handle deferred hard link creation, prior to any symlinks being created
+	for _, entry := range hardlinks {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err = e.createHardlink(entry.path, entry.file); err != nil {
+			if err = errs.handle(e.options.continueOnError, entry.file.Name, err); err != nil {
+				return err
+			}
+		}
+	}
+
 	// handle deferred symlink creation and update directory metadata
 	// (otherwise modification dates are incorrect)
-	for _, file := range e.zr.File {
-		if file.Mode()&os.ModeSymlink == 0 && !file.Mode().IsDir() {
-			continue
+	var symlinks []deferredEntry
+	for _, entry := range deferred {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 
-		path, err := filepath.Abs(filepath.Join(e.chroot, file.Name))
+		if entry.file.Mode()&os.ModeSymlink != 0 {
+			err = e.createSymlink(entry.path, entry.file)
+			if err == nil {
+				symlinks = append(symlinks, entry)
+			}
+		} else {
+			err = e.updateFileMetadata(entry.path, entry.file)
+		}
 		if err != nil {
-			return err
+			if err = errs.handle(e.options.continueOnError, entry.file.Name, err); err != nil {
+				return err
+			}
 		}
+	}
 
-		if file.Mode()&os.ModeSymlink != 0 {
-			if err := e.createSymlink(path, file); err != nil {
+	// a symlink created later can change where an earlier symlink resolves
+	// to, so each is checked again once they all exist
+	for _, entry := range symlinks {
+		if err = e.checkSymlink(entry.path, entry.file); err != nil {
+			if err = errs.handle(e.options.continueOnError, entry.file.Name, err); err != nil {
 				return err
 			}
-			continue
 		}
+	}
 
-		err = e.updateFileMetadata(path, file)
-		if err != nil {
+	// sync directories, now that their entries have been created
+	for dir := range dirs {
+		if err = syncDir(dir); err != nil {
 			return err
 		}
 	}
 
+	if len(errs.errs) > 0 {
+		return errs.errs
+	}
+
 	return nil
 }
 
-func (e *Extractor) createDirectory(path string, file *zip.File) error {
-	err := os.Mkdir(path, 0777)
-	if os.IsExist(err) {
-		err = nil
+// Verify reads the data of every entry through its decompressor, verifying its
+// checksum, without writing anything to disk, similar to "unzip -t". Entries
+// are verified concurrently. The error of the first entry to fail is returned
+// as an *EntryError, or with WithExtractorContinueOnError, a MultiError of
+// every failed entry.
+func (e *Extractor) Verify(ctx context.Context) error {
+	defer e.cr.setContext(ctx)()
+
+	limiter := make(chan struct{}, e.options.concurrency)
+	wg, gctx := errgroup.WithContext(ctx)
+
+	var errs entryErrors
+	for _, file := range e.zr.File {
+		if file.Mode().IsDir() {
+			continue
+		}
+
+		if gctx.Err() != nil {
+			break
+		}
+
+		limiter <- struct{}{}
+
+		file := file
+		wg.Go(func() error {
+			defer func() { <-limiter }()
+			err := e.verifyFile(gctx, file)
+			if err == nil || gctx.Err() != nil {
+				return err
+			}
+			if e.options.continueOnError {
+				return errs.handle(true, file.Name, err)
+			}
+			return &EntryError{Name: file.Name, Err: err}
+		})
 	}
-	incOnSuccess(&e.entries, err)
-	return err
-}
 
-func (e *Extractor) createSymlink(path string, file *zip.File) error {
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+	if err := wg.Wait(); err != nil {
 		return err
 	}
-
-	r, err := file.Open()
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	defer r.Close()
 
-	name, err := io.ReadAll(r)
-	if err != nil {
-		return err
+	if len(errs.errs) > 0 {
+		return errs.errs
 	}
 
-	if err := os.Symlink(string(name), path); err != nil {
+	return nil
+}
+
+func (e *Extractor) verifyFile(ctx context.Context, file *zip.File) (err error) {
+	r, err := e.open(file)
+	if err != nil {
+		return err
+	}
+	defer dclose(r, &err)
+
+	var read int64
+	_, err = io.Copy(countWriter{io.Discard, &read, ctx}, r)
+	return err
+}
+
+// checkDuplicateNames returns an error wrapping ErrDuplicateName if any of the
+// entries to be extracted have the same name, once normalized, stripped,
+// remapped and cleaned. Directories with the same name aren't duplicates, as
+// extracting them again is harmless.
+func (e *Extractor) checkDuplicateNames(match func(*zip.File) bool) error {
+	dirs := make(map[string]bool)
+	for _, file := range e.zr.File {
+		if file.Mode()&irregularModes != 0 && !e.options.irregular {
+			continue
+		}
+		if match != nil && !match(file) {
+			continue
+		}
+
+		name, ok := e.entryName(unicodePath(file))
+		if !ok {
+			continue
+		}
+		name = path.Clean("/" + name)
+
+		dir, ok := dirs[name]
+		if ok && !(dir && file.Mode().IsDir()) {
+			return fmt.Errorf("%s: %w", unicodePath(file), ErrDuplicateName)
+		}
+		dirs[name] = file.Mode().IsDir()
+	}
+
+	return nil
+}
+
+// entryName returns the name an entry is extracted as, and false if the entry
+// is to be skipped.
+func (e *Extractor) entryName(name string) (string, bool) {
+	if e.options.normalizeNames {
+		name = e.options.normalizeForm.String(name)
+	}
+
+	for i := 0; i < e.options.stripComponents; i++ {
+		idx := strings.IndexByte(name, '/')
+		if idx < 0 || idx == len(name)-1 {
+			return "", false
+		}
+		name = name[idx+1:]
+	}
+
+	if e.options.pathRemap != nil {
+		return e.options.pathRemap(name)
+	}
+	return name, true
+}
+
+// flatten returns an entry's name with its directory components removed,
+// applying the flatten policy if the name has already been used. Directories
+// and symlinks are skipped, as their structure and targets are meaningless
+// once flattened.
+func (e *Extractor) flatten(file *zip.File, name string, names map[string]struct{}) (string, bool, error) {
+	switch {
+	case file.Mode().IsDir():
+		return "", false, nil
+
+	case file.Mode()&os.ModeSymlink != 0:
+		e.logf("skipping symlink %s, flattening", file.Name)
+		return "", false, nil
+	}
+
+	flattened := path.Base(name)
+	if _, ok := names[flattened]; ok {
+		switch e.options.flattenPolicy {
+		case MergeSkip:
+			e.logf("skipping entry %s, flattened name %s already extracted", file.Name, flattened)
+			return "", false, nil
+
+		case MergeRename:
+			flattened = renameEntry(flattened, names)
+
+		default:
+			return "", false, fmt.Errorf("%s: %w", flattened, ErrDuplicateName)
+		}
+	}
+
+	names[flattened] = struct{}{}
+	e.flattened[name] = flattened
+
+	return flattened, true, nil
+}
+
+// entryPath returns the absolute path an entry is extracted to, returning an
+// error if the path is outside of the chroot.
+func (e *Extractor) entryPath(name string) (string, error) {
+	path, err := filepath.Abs(filepath.Join(e.chroot, name))
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(path, e.chroot+string(filepath.Separator)) && path != e.chroot {
+		return "", fmt.Errorf("%s cannot be extracted outside of chroot (%s)", path, e.chroot)
+	}
+
+	return path, nil
+}
+
+// checkPathDepth returns an error if path, relative to the chroot, has more
+// elements than the maximum path depth.
+func (e *Extractor) checkPathDepth(path string) error {
+	max := e.options.maxPathDepth
+	if max <= 0 || path == e.chroot {
+		return nil
+	}
+
+	rel := path[len(e.chroot)+1:]
+	if depth := strings.Count(rel, string(filepath.Separator)) + 1; depth > max {
+		return fmt.Errorf("%s has %d path elements: %w", rel, depth, ErrMaxPathDepth)
+	}
+	return nil
+}
+
+// resolvesWithin reports whether path, with all symlinks resolved, is within
+// the chroot. Elements of the path that don't exist yet are joined as they are.
+func (e *Extractor) resolvesWithin(path string) (bool, error) {
+	root, err := filepath.EvalSymlinks(e.chroot)
+	if err != nil {
+		return false, err
+	}
+
+	// a cycle of symlinks doesn't resolve anywhere, so can't escape
+	path, err = resolveExisting(path)
+	if errors.Is(err, ErrSymlinkLoop) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return within(root, path), nil
+}
+
+// open opens a file within the archive for reading.
+//
+// LZMA streams without an end-of-stream marker rely on the uncompressed size
+// to determine where the stream ends. This isn't available to a
+// zip.Decompressor, so when the default LZMA decompressor is in use, these are
+// decoded here instead.
+func (e *Extractor) open(file *zip.File) (io.ReadCloser, error) {
+	if !e.lzma || file.Method != ZipMethodLZMA || file.Flags&lzmaEOSFlag != 0 {
+		return file.Open()
+	}
+
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newLZMAReader(raw, int64(file.UncompressedSize64))
+	if err != nil {
+		return nil, err
+	}
+
+	return &checksumReader{r: r, hash: crc32.NewIEEE(), file: file}, nil
+}
+
+// ExtractFile extracts the contents of the named regular file entry to w. The
+// entry's checksum is verified once all of its contents have been read. The
+// maximum uncompressed size is enforced for each call separately, and bytes
+// written to w aren't included by Written, which only counts bytes written to
+// disk.
+func (e *Extractor) ExtractFile(ctx context.Context, name string, w io.Writer) (err error) {
+	defer e.cr.setContext(ctx)()
+
+	file := e.file(name)
+	switch {
+	case file == nil:
+		return fmt.Errorf("%s: %w", name, ErrEntryNotFound)
+	case !file.Mode().IsRegular():
+		return fmt.Errorf("%s: %w", name, ErrNotRegularFile)
+	}
+
+	if max := e.options.maxEntrySize; max > 0 && file.UncompressedSize64 > uint64(max) {
+		return fmt.Errorf("%s: %w", file.Name, ErrMaxEntrySize)
+	}
+
+	r, err := e.open(file)
+	if err != nil {
+		return err
+	}
+	defer dclose(r, &err)
+
+	var written, uncompressed int64
+	w = countWriter{w, &written, ctx}
+	if e.limited() {
+		w = &limitWriter{w: w, e: e, file: file, uncompressed: &uncompressed}
+	}
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// OpenRaw returns a reader of the named entry's data as stored in the archive,
+// without decompressing it, along with a copy of the entry's header. This is
+// useful for copying an entry to another archive without recompressing it.
+// As the data isn't decompressed, its checksum and sizes aren't verified, so
+// are the caller's responsibility. The reader is only valid until the
+// Extractor is closed.
+func (e *Extractor) OpenRaw(name string) (io.Reader, *zip.FileHeader, error) {
+	file := e.file(name)
+	if file == nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, ErrEntryNotFound)
+	}
+
+	r, err := file.OpenRaw()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hdr := file.FileHeader
+	return r, &hdr, nil
+}
+
+// file returns the first entry with the name provided, or nil if there's no
+// such entry. The name is matched against the entry's Unicode Path, as used
+// for the entry's path when extracting.
+func (e *Extractor) file(name string) *zip.File {
+	for _, f := range e.zr.File {
+		if unicodePath(f) == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (e *Extractor) createDirectory(path string, file *zip.File) error {
+	err := os.Mkdir(path, 0777)
+	if os.IsExist(err) {
+		err = nil
+	}
+	incOnSuccess(&e.entries, err)
+	return err
+}
+
+func isHardlink(file *zip.File) bool {
+	if file.UncompressedSize64 > 0 || !file.Mode().IsRegular() {
+		return false
+	}
+
+	_, ok := hardlinkTarget(file.Extra)
+	return ok
+}
+
+func (e *Extractor) createHardlink(path string, file *zip.File) error {
+	target, _ := hardlinkTarget(file.Extra)
+
+	target, ok := e.entryName(target)
+	if e.flattened != nil {
+		target, ok = e.flattened[target]
+	}
+	if !ok {
+		return fmt.Errorf("%s: hard link target is not extracted", file.Name)
+	}
+
+	targetPath, err := e.entryPath(target)
+	if err != nil {
+		return err
+	}
+
+	// entryPath only checks the names lexically, but either the link or its
+	// target could be beneath a symlink already on disk
+	for _, p := range []string{filepath.Dir(path), targetPath} {
+		ok, err := e.resolvesWithin(p)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s: %w", file.Name, ErrLinkTraversal)
+		}
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Link(targetPath, path)
+	incOnSuccess(&e.entries, err)
+
+	return err
+}
+
+// checkSymlink removes a symlink that resolves outside of the chroot, returning
+// an error wrapping ErrLinkTraversal.
+func (e *Extractor) checkSymlink(path string, file *zip.File) error {
+	ok, err := e.resolvesWithin(path)
+	if err == nil && ok {
+		return nil
+	}
+
+	if rerr := os.Remove(path); rerr != nil {
+		return rerr
+	}
+	atomic.AddInt64(&e.entries, -1)
+
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s: %w", file.Name, ErrLinkTraversal)
+}
+
+func (e *Extractor) createIrregular(path string, file *zip.File) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var major, minor uint32
+	if file.Mode()&os.ModeDevice != 0 {
+		fields, err := zipextra.Parse(file.Extra)
+		if err != nil {
+			return err
+		}
+
+		field, ok := fields[extraFieldDevice]
+		if !ok {
+			return fmt.Errorf("%s: device entry has no device number", file.Name)
+		}
+
+		if major, minor, err = decodeDevice(field); err != nil {
+			return err
+		}
+	}
+
+	err := mkspecial(path, file.Mode(), major, minor)
+	incOnSuccess(&e.entries, err)
+
+	return err
+}
+
+func (e *Extractor) createSymlink(path string, file *zip.File) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	r, err := e.open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// the target is decompressed into memory, so its length is bounded, as well
+	// as being subject to the extraction limits
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	if e.limited() {
+		w = &limitWriter{w: w, e: e, file: file}
+	}
+	n, err := io.Copy(w, io.LimitReader(r, maxSymlinkTarget+1))
+	if err != nil {
+		return err
+	}
+	if n > maxSymlinkTarget {
+		return fmt.Errorf("%s: %w", file.Name, ErrSymlinkTargetTooLong)
+	}
+	name := buf.Bytes()
+
+	// the symlink and its target are resolved through any symlinks already
+	// created, so that a chain of symlinks can't be used to escape the chroot.
+	// The target isn't joined with filepath.Join, as that would remove ".."
+	// elements before the symlinks preceding them are resolved.
+	target := filepath.FromSlash(string(name))
+	if !filepath.IsAbs(target) {
+		target = filepath.Dir(path) + string(filepath.Separator) + target
+	}
+	for _, p := range []string{filepath.Dir(path), target} {
+		ok, err := e.resolvesWithin(p)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s: %w", file.Name, ErrLinkTraversal)
+		}
+	}
+
+	if err := os.Symlink(string(name), path); err != nil {
 		return err
 	}
 
@@ -256,12 +1196,79 @@ func (e *Extractor) createSymlink(path string, file *zip.File) error {
 	return err
 }
 
+// handleCRCError calls the CRC error handler, serializing calls.
+func (e *Extractor) handleCRCError(file *zip.File, err error) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	return e.options.crcErrorHandler(file, err)
+}
+
+// extractFile creates a file and restores its metadata. Checksum mismatches
+// are passed to the CRC error handler, if set.
+func (e *Extractor) extractFile(ctx context.Context, path string, file *zip.File) (err error) {
+	if timeout := e.options.perEntryTimeout; timeout > 0 {
+		parent := ctx
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		// the entry is named if it timed out, rather than the parent context,
+		// unless errors are collected, as they're then named by EntryError
+		defer func() {
+			if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil && !e.options.continueOnError {
+				err = fmt.Errorf("%s: %w", file.Name, err)
+			}
+		}()
+	}
+
+	err = e.createFile(ctx, path, file)
+	if errors.Is(err, zip.ErrChecksum) && e.options.crcErrorHandler != nil {
+		if err = e.handleCRCError(file, err); err != nil {
+			return err
+		}
+		incOnSuccess(&e.entries, nil)
+
+		// the handler may have removed the file
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return e.updateFileMetadata(path, file)
+}
+
+// createPlaceholder creates an empty file in place of a regular file entry.
+func (e *Extractor) createPlaceholder(path string) (err error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer dclose(f, &err)
+
+	err = e.sync(f)
+	incOnSuccess(&e.entries, err)
+	return err
+}
+
 func (e *Extractor) createFile(ctx context.Context, path string, file *zip.File) (err error) {
+	if max := e.options.maxEntrySize; max > 0 && file.UncompressedSize64 > uint64(max) {
+		return fmt.Errorf("%s: %w", file.Name, ErrMaxEntrySize)
+	}
+
 	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	r, err := file.Open()
+	r, err := e.open(file)
 	if err != nil {
 		return err
 	}
@@ -273,34 +1280,264 @@ func (e *Extractor) createFile(ctx context.Context, path string, file *zip.File)
 	}
 	defer dclose(f, &err)
 
-	bw := bufioWriterPool.Get().(*bufio.Writer)
-	defer bufioWriterPool.Put(bw)
+	// the header's size is untrusted, but entries exceeding the maximum entry
+	// size, if set, have already been rejected, and the space is allocated
+	// without changing the file's size
+	if e.options.preallocate && !e.options.sparse && file.UncompressedSize64 > 0 {
+		if err := preallocate(f, int64(file.UncompressedSize64)); err != nil {
+			return err
+		}
+	}
+
+	// stored entries are copied directly from the archive file when there are
+	// no limits to enforce whilst writing
+	if file.Method == zip.Store && e.src != nil && e.rl == nil && !e.limited() && !e.options.sparse {
+		ok, err := e.copyStored(ctx, f, file)
+		if ok && err == nil {
+			err = e.sync(f)
+		}
+		if ok || err != nil {
+			incOnSuccess(&e.entries, err)
+			return err
+		}
+	}
+
+	bw := e.writers.Get().(*bufio.Writer)
+	defer e.writers.Put(bw)
+
+	var sw *sparseWriter
+	var w io.Writer = f
+	if e.options.sparse {
+		sw = &sparseWriter{f: f}
+		w = sw
+	}
 
-	bw.Reset(countWriter{f, &e.written, ctx})
+	w = countWriter{w, &e.written, ctx}
+	if e.rl != nil {
+		w = &rateLimitWriter{w: w, l: e.rl, ctx: ctx}
+	}
+	if e.limited() {
+		w = &limitWriter{w: w, e: e, file: file}
+	}
+
+	bw.Reset(w)
 	if _, err = bw.ReadFrom(r); err != nil {
+		// on a checksum mismatch, the data is complete, so is flushed for the
+		// CRC error handler
+		if errors.Is(err, zip.ErrChecksum) {
+			if ferr := bw.Flush(); ferr != nil {
+				return ferr
+			}
+			if sw != nil {
+				if ferr := sw.finish(); ferr != nil {
+					return ferr
+				}
+			}
+		}
 		return err
 	}
 
 	err = bw.Flush()
+	if err == nil && sw != nil {
+		err = sw.finish()
+	}
+	if err == nil {
+		err = e.sync(f)
+	}
 	incOnSuccess(&e.entries, err)
 
 	return err
 }
 
+// sync commits a file's contents to stable storage, if enabled.
+func (e *Extractor) sync(f *os.File) error {
+	if !e.options.fsync {
+		return nil
+	}
+	return f.Sync()
+}
+
+// copyStored copies a stored entry's data from the archive file to f without
+// it passing through user space, where supported, and then verifies the
+// checksum of the data copied, if enabled. False is returned if copying is unsupported,
+// with nothing having been written to f.
+func (e *Extractor) copyStored(ctx context.Context, f *os.File, file *zip.File) (bool, error) {
+	if file.CompressedSize64 != file.UncompressedSize64 {
+		return false, nil
+	}
+
+	offset, err := file.DataOffset()
+	if err != nil {
+		return false, err
+	}
+	size := int64(file.CompressedSize64)
+
+	ok, err := copyFileRange(ctx, f, e.src, offset, size, &e.written)
+	if !ok || err != nil {
+		return ok, err
+	}
+
+	if !e.options.verifyStored {
+		return true, nil
+	}
+
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(e.src, offset, size)); err != nil {
+		return true, err
+	}
+	if crc.Sum32() != file.CRC32 {
+		return true, zip.ErrChecksum
+	}
+
+	return true, nil
+}
+
+// limited returns whether limits are enforced whilst writing.
+func (e *Extractor) limited() bool {
+	return e.options.maxEntrySize > 0 || e.options.maxUncompressedSize > 0 || e.options.maxCompressionRatio > 0
+}
+
+// compressionRatioWarmup is the number of bytes of an entry written before the
+// maximum compression ratio is enforced.
+const compressionRatioWarmup = 64 * 1024
+
+// limitWriter enforces the maximum entry size, cumulative uncompressed size
+// and compression ratio limits whilst data is written. Sizes within an entry's
+// header cannot be trusted, so limits are enforced against the actual data
+// decompressed.
+type limitWriter struct {
+	w       io.Writer
+	e       *Extractor
+	file    *zip.File
+	written int64
+
+	// uncompressed is the cumulative size the maximum uncompressed size is
+	// enforced against, or the extractor's if nil
+	uncompressed *int64
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	size := int64(len(p))
+	if max := w.e.options.maxEntrySize; max > 0 && w.written+size > max {
+		return 0, fmt.Errorf("%s: %w", w.file.Name, ErrMaxEntrySize)
+	}
+	total := w.uncompressed
+	if total == nil {
+		total = &w.e.uncompressed
+	}
+	if max := w.e.options.maxUncompressedSize; max > 0 && atomic.AddInt64(total, size) > max {
+		return 0, fmt.Errorf("%s: %w", w.file.Name, ErrMaxUncompressedSize)
+	}
+	if max := w.e.options.maxCompressionRatio; max > 0 && w.written+size > compressionRatioWarmup {
+		compressed := w.file.CompressedSize64
+		if compressed == 0 {
+			compressed = 1
+		}
+		if float64(w.written+size)/float64(compressed) > max {
+			return 0, fmt.Errorf("%s: %w", w.file.Name, ErrMaxCompressionRatio)
+		}
+	}
+
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// logf logs a debug message with the logger, if set.
+func (e *Extractor) logf(format string, args ...interface{}) {
+	if e.options.logger != nil {
+		e.options.logger(format, args...)
+	}
+}
+
+// permModes are the mode bits affected by the mode masks.
+const permModes = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// mode returns the mode an entry is extracted with, after applying the
+// default permissions, if none are stored, the file or directory mode mask
+// and, if enabled, the umask.
+func (e *Extractor) mode(file *zip.File) os.FileMode {
+	mode := file.Mode()
+	mask := e.options.fileModeMask
+	if mode.IsDir() {
+		mask = e.options.dirModeMask
+	}
+
+	if mode.Perm() == 0 {
+		switch {
+		case mode.IsDir():
+			mode |= e.options.defaultDirMode
+		case mode.IsRegular():
+			mode |= e.options.defaultFileMode
+		}
+	}
+
+	return mode &^ (permModes &^ mask) &^ e.umask
+}
+
 func (e *Extractor) updateFileMetadata(path string, file *zip.File) error {
 	fields, err := zipextra.Parse(file.Extra)
 	if err != nil {
 		return err
 	}
 
-	if err := lchtimes(path, file.Mode(), time.Now(), file.Modified); err != nil {
+	if e.options.restoreXattrs {
+		if xattrfield, ok := fields[extraFieldXattr]; ok {
+			attrs, err := decodeXattrs(xattrfield)
+			if err != nil {
+				return err
+			}
+			if err := lsetxattrs(path, attrs); err != nil {
+				return err
+			}
+		}
+	}
+
+	// ownership is restored prior to permissions, as changing ownership
+	// clears the setuid and setgid bits. An ownership error is only returned
+	// once the remaining metadata has been restored.
+	chownErr := e.updateFileOwnership(path, file, fields)
+
+	if e.options.restoreCreationTime {
+		if btime, ok := creationTime(fields); ok {
+			if err := setBirthTime(path, file.Mode(), btime); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := lchtimes(path, file.Mode(), time.Now(), modTime(file, fields)); err != nil {
 		return err
 	}
 
-	if err := lchmod(path, file.Mode()); err != nil {
+	if err := lchmod(path, e.mode(file)); err != nil {
 		return err
 	}
 
+	if e.options.restoreDOSAttrs {
+		if err := setDOSAttributes(path, file.Mode(), uint8(file.ExternalAttrs)); err != nil {
+			return err
+		}
+	}
+
+	// file flags are restored last, as flags such as immutable prevent any
+	// further changes
+	if e.options.restoreFileFlags {
+		if flags, ok := storedFileFlags(fields); ok {
+			if err := setFileFlags(path, file.Mode(), flags); err != nil {
+				return err
+			}
+		}
+	}
+
+	return chownErr
+}
+
+func (e *Extractor) updateFileOwnership(path string, file *zip.File, fields map[uint16]zipextra.ExtraField) error {
+	if !e.chown {
+		return nil
+	}
+
 	unixfield, ok := fields[zipextra.ExtraFieldUnixN]
 	if !ok {
 		return nil
@@ -311,12 +1548,18 @@ func (e *Extractor) updateFileMetadata(path string, file *zip.File) error {
 		return err
 	}
 
-	err = lchown(path, int(unix.Uid.Int64()), int(unix.Gid.Int64()))
+	uid, gid := int(unix.Uid.Int64()), int(unix.Gid.Int64())
+	if e.options.ownerMapping != nil {
+		uid, gid = e.options.ownerMapping(uid, gid)
+	}
+
+	err = lchown(path, uid, gid)
 	if err == nil {
 		return nil
 	}
 
 	if e.options.chownErrorHandler == nil {
+		e.logf("ignoring ownership error for %s: %v", file.Name, err)
 		return nil
 	}
 
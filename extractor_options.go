@@ -1,11 +1,106 @@
 package fastzip
 
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zip"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	// ErrMaxEntrySize is returned when an entry exceeds the maximum entry size.
+	ErrMaxEntrySize = errors.New("maximum entry size exceeded")
+
+	// ErrMaxUncompressedSize is returned when the total uncompressed size of
+	// the extracted entries exceeds the maximum uncompressed size.
+	ErrMaxUncompressedSize = errors.New("maximum uncompressed size exceeded")
+
+	// ErrMaxCompressionRatio is returned when an entry's decompressed to
+	// compressed size ratio exceeds the maximum compression ratio.
+	ErrMaxCompressionRatio = errors.New("maximum compression ratio exceeded")
+
+	// ErrMinStripComponents is returned when the number of path components to
+	// strip is negative.
+	ErrMinStripComponents = errors.New("strip components must not be negative")
+
+	// ErrMaxEntries is returned when an archive has more entries than the
+	// maximum allowed.
+	ErrMaxEntries = errors.New("maximum number of entries exceeded")
+
+	// ErrMaxPathDepth is returned when an entry's name has more path elements
+	// than the maximum path depth.
+	ErrMaxPathDepth = errors.New("maximum path depth exceeded")
+
+	// ErrMinProgressInterval is returned when the progress interval is not
+	// greater than zero.
+	ErrMinProgressInterval = errors.New("progress interval must be greater than zero")
+
+	// ErrLinkTraversal is returned when a link, after resolving any symlinks
+	// leading to it, would be created or point outside of the chroot.
+	ErrLinkTraversal = errors.New("link resolves outside of chroot")
+)
+
+// ChownPolicy determines when ownership of extracted files is restored.
+type ChownPolicy int
+
+const (
+	// ChownAlways always attempts to restore ownership.
+	ChownAlways ChownPolicy = iota
+
+	// ChownAuto only attempts to restore ownership when running as root.
+	ChownAuto
+
+	// ChownNever never attempts to restore ownership.
+	ChownNever
+)
+
 // ExtractorOption is an option used when creating an extractor.
 type ExtractorOption func(*extractorOptions) error
 
 type extractorOptions struct {
-	concurrency       int
-	chownErrorHandler func(name string, err error) error
+	concurrency         int
+	chownErrorHandler   func(name string, err error) error
+	crcErrorHandler     func(file *zip.File, err error) error
+	restoreXattrs       bool
+	restoreCreationTime bool
+	restoreDOSAttrs     bool
+	restoreFileFlags    bool
+	chownPolicy         ChownPolicy
+	ownerMapping        func(uid, gid int) (int, int)
+	continueOnError     bool
+	irregular           bool
+	rateLimit           int
+	writeBufferSize     int
+	preallocate         bool
+	sparse              bool
+	verifyStored        bool
+	fsync               bool
+	atomic              bool
+	fileModeMask        os.FileMode
+	dirModeMask         os.FileMode
+	defaultFileMode     os.FileMode
+	defaultDirMode      os.FileMode
+	applyUmask          bool
+	normalizeNames      bool
+	normalizeForm       norm.Form
+	logger              func(format string, args ...interface{})
+	perEntryTimeout     time.Duration
+	progressHandler     func(p Progress)
+	progressInterval    time.Duration
+
+	maxUncompressedSize int64
+	maxEntrySize        int64
+	maxCompressionRatio float64
+	maxEntries          int
+	maxPathDepth        int
+	rejectDuplicates    bool
+
+	pathRemap       func(name string) (string, bool)
+	stripComponents int
+	flatten         bool
+	flattenPolicy   MergePolicy
 }
 
 // WithExtractorConcurrency will set the maximum number of files being
@@ -20,13 +115,440 @@ func WithExtractorConcurrency(n int) ExtractorOption {
 	}
 }
 
+// WithExtractorRateLimit limits the rate, in bytes per second, at which
+// extracted file data is written to disk. The limit applies to the aggregate
+// output of all concurrently extracted files. A value of 0 disables the limit.
+func WithExtractorRateLimit(bytesPerSec int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		if bytesPerSec < 0 {
+			bytesPerSec = 0
+		}
+		o.rateLimit = bytesPerSec
+		return nil
+	}
+}
+
+// WithExtractorWriteBufferSize sets the size of the buffer each file's data is
+// written to disk through. Larger buffers reduce the number of writes, which
+// can improve throughput on fast storage. Each file extracted concurrently
+// uses its own buffer. The default is 32 kibibytes, and the minimum is 16
+// bytes.
+func WithExtractorWriteBufferSize(n int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		if n < 16 {
+			return ErrMinBufferSize
+		}
+		o.writeBufferSize = n
+		return nil
+	}
+}
+
+// WithExtractorPreallocate sets whether disk space is preallocated for each
+// file, using the uncompressed size from the entry's header, before it's
+// extracted. This can reduce fragmentation of large files. The header's size
+// can't be trusted, so WithExtractorMaxEntrySize should also be set to bound
+// how much space can be preallocated for an entry. Preallocation is only
+// supported on Linux, and is skipped for filesystems that don't support it.
+func WithExtractorPreallocate(enabled bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.preallocate = enabled
+		return nil
+	}
+}
+
+// WithExtractorSparse sets whether extracted files are written sparsely, with
+// blocks of zeros skipped over rather than written, so that they don't use
+// disk space. Zero blocks are only skipped when aligned to 4 kibibytes.
+// Filesystems that don't support sparse files fill the skipped blocks with
+// zeros, so the contents are unchanged, but the full size is allocated. When
+// enabled, disk space isn't preallocated and stored entries aren't copied
+// directly from the archive file.
+func WithExtractorSparse(enabled bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.sparse = enabled
+		return nil
+	}
+}
+
+// WithExtractorVerifyStoredChecksums sets whether the checksum of a stored
+// entry is verified when it's copied directly from the archive file. Verifying
+// it requires the data to be read back through user space once copied, which
+// loses much of the benefit of the direct copy. It's enabled by default.
+func WithExtractorVerifyStoredChecksums(enabled bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.verifyStored = enabled
+		return nil
+	}
+}
+
+// WithExtractorFsync sets whether each extracted file is synced to stable
+// storage before it's closed, and each directory that entries were extracted
+// to is synced once extraction has finished, so that their creation survives a
+// crash or power loss. This has a substantial performance cost, and is
+// disabled by default. Directories are not synced on Windows.
+func WithExtractorFsync(enabled bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.fsync = enabled
+		return nil
+	}
+}
+
+// WithExtractorAtomic sets whether entries are extracted to a temporary
+// directory alongside the chroot, which replaces the chroot, and anything
+// already in it, only once extraction has succeeded. On error or
+// cancellation, the temporary directory is removed and the chroot is left
+// untouched.
+//
+// The temporary directory is created in the chroot's parent directory, so
+// that the final rename doesn't cross filesystems. If the chroot is itself a
+// mount point, or its parent is read-only, extraction fails. Replacing an
+// existing chroot takes two renames, so it briefly doesn't exist. Symlinks
+// with absolute targets are checked against the temporary directory, rather
+// than the chroot.
+func WithExtractorAtomic(enabled bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.atomic = enabled
+		return nil
+	}
+}
+
 // WithExtractorChownErrorHandler sets an error handler to be called if errors are
 // encountered when trying to preserve ownership of extracted files. Returning
 // nil will continue extraction, returning any error will cause Extract() to
-// error.
+// error. Calls to the handler are serialized.
 func WithExtractorChownErrorHandler(fn func(name string, err error) error) ExtractorOption {
 	return func(o *extractorOptions) error {
 		o.chownErrorHandler = fn
 		return nil
 	}
 }
+
+// WithExtractorCRCErrorHandler sets an error handler to be called if an
+// extracted file's checksum doesn't match the checksum stored in the archive.
+// The file's data has been fully written when the handler is called, allowing
+// it to be logged, kept or removed. Returning nil will continue extraction,
+// returning any error will cause Extract() to error. If the handler removes
+// the file, its metadata isn't restored. Calls to the handler are serialized.
+func WithExtractorCRCErrorHandler(fn func(file *zip.File, err error) error) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.crcErrorHandler = fn
+		return nil
+	}
+}
+
+// WithExtractorChownPolicy sets the policy used for restoring ownership of
+// extracted files. The default is ChownAlways. ChownAuto checks the effective
+// user id once and skips restoring ownership entirely if it isn't root.
+func WithExtractorChownPolicy(policy ChownPolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.chownPolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorOwnerMapping sets a function that maps the uid and gid stored in
+// the archive to those used when restoring ownership. This is useful when
+// extracting onto a host where ids correspond to different users. Ownership
+// is only restored according to the chown policy, and errors are still passed
+// to the chown error handler. Returning -1 for either id leaves it unchanged.
+func WithExtractorOwnerMapping(fn func(uid, gid int) (int, int)) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.ownerMapping = fn
+		return nil
+	}
+}
+
+// WithExtractorRestoreXattrs sets whether extended attributes stored in the
+// archive are restored. Extended attributes are only supported on Linux and
+// macOS, enabling this option on other platforms returns ErrXattrUnsupported.
+func WithExtractorRestoreXattrs(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		if restore && !xattrSupported {
+			return ErrXattrUnsupported
+		}
+		o.restoreXattrs = restore
+		return nil
+	}
+}
+
+// WithExtractorRestoreCreationTime sets whether file creation times stored in
+// the NTFS extra field are restored. Creation times are only restored on macOS
+// and Windows, on other platforms, such as Linux, where the creation time
+// cannot be reliably set, this option has no effect.
+func WithExtractorRestoreCreationTime(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.restoreCreationTime = restore
+		return nil
+	}
+}
+
+// WithExtractorRestoreDOSAttributes sets whether the hidden and system DOS
+// attributes stored in entries' external attributes are restored. The
+// read-only attribute is always restored from an entry's permissions. DOS
+// attributes are only restored on Windows, where this option is enabled by
+// default, on other platforms this option has no effect.
+func WithExtractorRestoreDOSAttributes(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.restoreDOSAttrs = restore
+		return nil
+	}
+}
+
+// WithExtractorRestoreFileFlags sets whether BSD file flags stored in the
+// archive are restored. Flags are restored after all other metadata, as flags
+// such as the immutable flag prevent further changes. File flags are only
+// restored on macOS and the BSDs, on other platforms this option has no effect.
+func WithExtractorRestoreFileFlags(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.restoreFileFlags = restore
+		return nil
+	}
+}
+
+// WithExtractorContinueOnError sets whether extraction continues past entries
+// that fail to extract. When enabled, Extract returns a MultiError containing
+// an *EntryError for each failed entry.
+func WithExtractorContinueOnError(enabled bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.continueOnError = enabled
+		return nil
+	}
+}
+
+// WithExtractorRestoreIrregular sets whether named pipes, sockets and device
+// files are recreated. Creating device files typically requires root. This is
+// only supported on unix platforms and is a no-op elsewhere.
+func WithExtractorRestoreIrregular(restore bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.irregular = restore && irregularSupported
+		return nil
+	}
+}
+
+// WithExtractorMaxUncompressedSize sets the maximum total number of bytes that
+// can be extracted by each call to Extract or ExtractFile, which return
+// ErrMaxUncompressedSize if this is exceeded. The default of zero is
+// unlimited.
+func WithExtractorMaxUncompressedSize(n int64) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.maxUncompressedSize = n
+		return nil
+	}
+}
+
+// WithExtractorMaxEntrySize sets the maximum number of bytes that can be
+// extracted for a single entry. Extract returns ErrMaxEntrySize if this is
+// exceeded. The default of zero is unlimited.
+func WithExtractorMaxEntrySize(n int64) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.maxEntrySize = n
+		return nil
+	}
+}
+
+// WithExtractorMaxCompressionRatio sets the maximum ratio of decompressed to
+// compressed bytes for an entry. The ratio is checked as data is extracted,
+// once a small amount of data has been written, and Extract returns
+// ErrMaxCompressionRatio if it is exceeded. The default of zero is unlimited.
+func WithExtractorMaxCompressionRatio(ratio float64) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.maxCompressionRatio = ratio
+		return nil
+	}
+}
+
+// WithExtractorMaxEntries sets the maximum number of entries an archive can
+// contain. Extract returns ErrMaxEntries if this is exceeded. The default of
+// zero is unlimited.
+func WithExtractorMaxEntries(n int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.maxEntries = n
+		return nil
+	}
+}
+
+// WithExtractorMaxPathDepth sets the maximum number of path elements an
+// entry's name can have, after any stripping, path remapping and flattening,
+// for example, "a/b/c.txt" has 3. An entry exceeding this fails with an error
+// wrapping ErrMaxPathDepth before any of its parent directories are created.
+// With WithExtractorContinueOnError, such entries are skipped and reported.
+// The default of zero is unlimited.
+func WithExtractorMaxPathDepth(n int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.maxPathDepth = n
+		return nil
+	}
+}
+
+// WithExtractorRejectDuplicateNames sets whether archives with more than one
+// entry of the same name are rejected, so that a later entry can't replace an
+// earlier one. Names are compared after any normalization, stripping and path
+// remapping, and cleaning, so "a//b" and "a/b/" are duplicates. Directories
+// with the same name aren't considered duplicates. The entries are checked
+// before anything is extracted, and Extract returns an error wrapping
+// ErrDuplicateName. The path remap function, if any, is called twice for each
+// entry.
+func WithExtractorRejectDuplicateNames(reject bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.rejectDuplicates = reject
+		return nil
+	}
+}
+
+// WithExtractorPathRemap sets a function that is called with each entry's name
+// to determine the name it is extracted as. Returning false skips the entry.
+// The remapped name is still restricted to the chroot directory.
+func WithExtractorPathRemap(fn func(name string) (string, bool)) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.pathRemap = fn
+		return nil
+	}
+}
+
+// WithExtractorStripComponents removes the first n path components from each
+// entry's name, similar to tar's --strip-components. Entries with n or fewer
+// components are skipped. Stripping is performed before any path remapping.
+func WithExtractorStripComponents(n int) ExtractorOption {
+	return func(o *extractorOptions) error {
+		if n < 0 {
+			return ErrMinStripComponents
+		}
+		o.stripComponents = n
+		return nil
+	}
+}
+
+// WithExtractorFlatten sets whether the directory components of each entry's
+// name are removed, so that every file is extracted directly to the chroot.
+// Directory entries are ignored, and symlinks are skipped, as their targets are
+// meaningless once flattened. Files with the same flattened name are handled
+// according to the flatten policy, see WithExtractorFlattenPolicy. Flattening
+// is performed after any stripping and path remapping.
+func WithExtractorFlatten(enabled bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.flatten = enabled
+		return nil
+	}
+}
+
+// WithExtractorFlattenPolicy sets how files with the same flattened name are
+// handled when flattening. The default is MergeRename, which adds a numeric
+// suffix to the later files' names. MergeSkip keeps the first file, and
+// MergeError returns an error wrapping ErrDuplicateName.
+func WithExtractorFlattenPolicy(policy MergePolicy) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.flattenPolicy = policy
+		return nil
+	}
+}
+
+// WithExtractorModeMask sets a mask that is ANDed with the permissions of
+// every extracted file and directory, for example, 0755 prevents archives from
+// creating group or world writable files. The mask applies to the permission,
+// setuid, setgid and sticky bits.
+func WithExtractorModeMask(mask os.FileMode) ExtractorOption {
+	return WithExtractorModeMasks(mask, mask)
+}
+
+// WithExtractorModeMasks is like WithExtractorModeMask, but with separate
+// masks for files and directories.
+func WithExtractorModeMasks(fileMask, dirMask os.FileMode) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.fileModeMask = fileMask
+		o.dirModeMask = dirMask
+		return nil
+	}
+}
+
+// WithExtractorDefaultFileMode sets the permissions that files are extracted
+// with when the archive stores none, such as archives created by tools that
+// don't store Unix modes correctly, which would otherwise be extracted
+// inaccessible. The default of zero extracts the permissions as stored. Mode
+// masks and the umask, if enabled, are applied to the default permissions.
+func WithExtractorDefaultFileMode(mode os.FileMode) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.defaultFileMode = mode.Perm()
+		return nil
+	}
+}
+
+// WithExtractorDefaultDirMode is like WithExtractorDefaultFileMode, but sets
+// the permissions of directories.
+func WithExtractorDefaultDirMode(mode os.FileMode) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.defaultDirMode = mode.Perm()
+		return nil
+	}
+}
+
+// WithExtractorApplyUmask sets whether the process's umask is applied to the
+// permissions of extracted files and directories. By default, the exact
+// permissions stored in the archive are preserved, regardless of the umask.
+// The umask is read when the extractor is created. This option has no effect
+// on Windows.
+func WithExtractorApplyUmask(enabled bool) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.applyUmask = enabled
+		return nil
+	}
+}
+
+// WithExtractorNormalizeNames applies the Unicode normalization form to entry
+// names before they're extracted. This is useful for extracting archives
+// created on macOS, where filenames are typically decomposed (NFD), onto
+// systems that use the composed form (NFC). By default, names are extracted as
+// they're stored.
+func WithExtractorNormalizeNames(form norm.Form) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.normalizeNames = true
+		o.normalizeForm = form
+		return nil
+	}
+}
+
+// WithExtractorLogger sets a function used to log debug messages, such as when
+// an entry is skipped or an ownership error is ignored. It may be called
+// concurrently. By default, nothing is logged.
+func WithExtractorLogger(fn func(format string, args ...interface{})) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.logger = fn
+		return nil
+	}
+}
+
+// WithExtractorPerEntryTimeout sets the maximum time spent extracting each
+// file, preventing a single stalled entry from blocking extraction
+// indefinitely. The timeout is checked as data is written, and entries that
+// exceed it fail with an error wrapping context.DeadlineExceeded. The default
+// of zero is unlimited.
+func WithExtractorPerEntryTimeout(d time.Duration) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.perEntryTimeout = d
+		return nil
+	}
+}
+
+// WithExtractorProgressHandler sets a function called with the extraction's
+// progress whilst Extract, ExtractGlob or ExtractStructure is running. Updates
+// are coalesced, the function is called at most once per progress interval,
+// only when progress has been made, and a final time once extraction stops.
+// Calls are never concurrent, and a slow function delays the next update
+// rather than extraction.
+func WithExtractorProgressHandler(fn func(p Progress)) ExtractorOption {
+	return func(o *extractorOptions) error {
+		o.progressHandler = fn
+		return nil
+	}
+}
+
+// WithExtractorProgressInterval sets the minimum time between calls to the
+// progress handler. The default is 100 milliseconds.
+func WithExtractorProgressInterval(d time.Duration) ExtractorOption {
+	return func(o *extractorOptions) error {
+		if d <= 0 {
+			return ErrMinProgressInterval
+		}
+		o.progressInterval = d
+		return nil
+	}
+}
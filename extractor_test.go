@@ -1,17 +1,31 @@
 package fastzip
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/zip"
 	"github.com/klauspost/compress/zstd"
+	"github.com/saracen/zipextra"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz/lzma"
+	"golang.org/x/text/unicode/norm"
 )
 
 func testExtract(t *testing.T, filename string, files map[string]testFile) map[string]os.FileInfo {
@@ -26,6 +40,10 @@ func testExtract(t *testing.T, filename string, files map[string]testFile) map[s
 
 	require.NoError(t, e.Extract(context.Background()))
 
+	progress := e.Progress()
+	assert.EqualValues(t, len(e.Files()), progress.EntriesDone)
+	assert.EqualValues(t, len(e.Files()), progress.EntriesTotal)
+
 	result := make(map[string]os.FileInfo)
 	err = filepath.Walk(dir, func(pathname string, fi os.FileInfo, err error) error {
 		if err != nil {
@@ -103,6 +121,43 @@ func TestExtractCancelContext(t *testing.T) {
 	})
 }
 
+// lateCancelContext reports being canceled without ever closing its Done
+// channel, so cancellation is only observed where Err is checked directly.
+type lateCancelContext struct {
+	context.Context
+}
+
+func (lateCancelContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (lateCancelContext) Err() error {
+	return context.Canceled
+}
+
+func TestExtractCancelContextDeferredPhase(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar"},
+		"symlink": {mode: os.ModeSymlink | 0777, contents: "foo/bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out)
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.EqualError(t, e.Extract(lateCancelContext{context.Background()}), "context canceled")
+
+		_, err = os.Lstat(filepath.Join(out, "symlink"))
+		assert.True(t, os.IsNotExist(err), "symlink should not have been created")
+	})
+}
+
 func TestExtractorWithDecompressor(t *testing.T) {
 	testFiles := map[string]testFile{
 		"foo.go": {mode: 0666},
@@ -174,6 +229,236 @@ func TestExtractorWithChownErrorHandler(t *testing.T) {
 	})
 }
 
+func TestExtractorWithChownPolicy(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666},
+		"bar.go": {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	tests := map[ChownPolicy]bool{
+		ChownAlways: true,
+		ChownAuto:   os.Geteuid() == 0,
+		ChownNever:  false,
+	}
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		for policy, chown := range tests {
+			e, err := NewExtractor(filename, t.TempDir(), WithExtractorChownPolicy(policy), WithExtractorChownErrorHandler(func(name string, err error) error {
+				assert.True(t, chown, "chown should not have been attempted")
+				return nil
+			}))
+			require.NoError(t, err)
+			assert.Equal(t, chown, e.chown)
+			assert.NoError(t, e.Extract(context.Background()))
+			require.NoError(t, e.Close())
+		}
+	})
+}
+
+func TestExtractorSpecialPermissionBits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("special permission bits are not supported on windows")
+	}
+
+	testFiles := map[string]testFile{
+		"setuid": {mode: os.ModeSetuid | 0755, contents: "setuid"},
+		"setgid": {mode: os.ModeSetgid | 0755, contents: "setgid"},
+		"sticky": {mode: os.ModeDir | os.ModeSticky | 0777},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out)
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		for name, tf := range testFiles {
+			fi, err := os.Lstat(filepath.Join(out, name))
+			require.NoError(t, err)
+			assert.Equal(t, tf.mode, fi.Mode(), name)
+		}
+	})
+}
+
+func TestExtractorChownErrorRestoresMetadata(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("chown errors only occur for non-root users on unix")
+	}
+
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0640, contents: "foo"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Chmod(filepath.Join(dir, "foo.go"), 0640))
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		chownErr := errors.New("chown failed")
+
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out, WithExtractorOwnerMapping(func(uid, gid int) (int, int) {
+			return 0, 0
+		}), WithExtractorChownErrorHandler(func(name string, err error) error {
+			return chownErr
+		}))
+		require.NoError(t, err)
+		defer e.Close()
+		require.ErrorIs(t, e.Extract(context.Background()), chownErr)
+
+		// the permissions and modification time are restored regardless
+		fi, err := os.Lstat(filepath.Join(out, "foo.go"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), fi.Mode())
+		assert.Equal(t, fixedModTime.Unix(), fi.ModTime().Unix())
+	})
+}
+
+func TestExtractorBzip2(t *testing.T) {
+	// testdata/bzip2.zip was created with "zip -Z bzip2"
+	testExtract(t, filepath.Join("testdata", "bzip2.zip"), map[string]testFile{
+		"small.txt": {mode: 0644, contents: "small\n"},
+		"hello.txt": {mode: 0644, contents: strings.Repeat("hello bzip2\n", 50)},
+	})
+}
+
+func TestExtractorLZMA(t *testing.T) {
+	contents := strings.Repeat("hello lzma\n", 50)
+
+	t.Run("eos marker", func(t *testing.T) {
+		// testdata/lzma.zip was created with Python's zipfile and has the
+		// end-of-stream marker flag set
+		testExtract(t, filepath.Join("testdata", "lzma.zip"), map[string]testFile{
+			"hello.txt": {mode: 0644, contents: contents},
+		})
+	})
+
+	t.Run("no eos marker", func(t *testing.T) {
+		var buf bytes.Buffer
+		lw, err := lzma.WriterConfig{Size: int64(len(contents))}.NewWriter(&buf)
+		require.NoError(t, err)
+		_, err = io.WriteString(lw, contents)
+		require.NoError(t, err)
+		require.NoError(t, lw.Close())
+
+		// convert classic lzma header to zip lzma header
+		data := append([]byte{0x10, 0x02, 0x05, 0x00}, buf.Bytes()[:5]...)
+		data = append(data, buf.Bytes()[lzma.HeaderLen:]...)
+
+		archivePath := filepath.Join(t.TempDir(), "lzma.zip")
+		f, err := os.Create(archivePath)
+		require.NoError(t, err)
+		zw := zip.NewWriter(f)
+
+		hdr := &zip.FileHeader{
+			Name:               "hello.txt",
+			Method:             ZipMethodLZMA,
+			CRC32:              crc32.ChecksumIEEE([]byte(contents)),
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(contents)),
+		}
+		hdr.SetMode(0644)
+		w, err := zw.CreateRaw(hdr)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		require.NoError(t, f.Close())
+
+		testExtract(t, archivePath, map[string]testFile{
+			"hello.txt": {mode: 0644, contents: contents},
+		})
+	})
+}
+
+func TestExtractorDeflate64(t *testing.T) {
+	// deflate streams without matches of length 258 are also valid deflate64
+	// streams, which a small alphabet of random data doesn't produce
+	rnd := rand.New(rand.NewSource(0))
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = "abcd"[rnd.Intn(4)]
+	}
+	contents := string(data)
+
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestSpeed)
+	require.NoError(t, err)
+	_, err = io.WriteString(fw, contents)
+	require.NoError(t, err)
+	require.NoError(t, fw.Close())
+
+	archivePath := filepath.Join(t.TempDir(), "deflate64.zip")
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+	zw := zip.NewWriter(f)
+
+	hdr := &zip.FileHeader{
+		Name:               "hello.txt",
+		Method:             ZipMethodDeflate64,
+		CRC32:              crc32.ChecksumIEEE([]byte(contents)),
+		CompressedSize64:   uint64(buf.Len()),
+		UncompressedSize64: uint64(len(contents)),
+	}
+	hdr.SetMode(0644)
+	w, err := zw.CreateRaw(hdr)
+	require.NoError(t, err)
+	_, err = w.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	testExtract(t, archivePath, map[string]testFile{
+		"hello.txt": {mode: 0644, contents: contents},
+	})
+}
+
+func TestExtractorManifest(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: "foo"},
+		"bar":    {mode: os.ModeDir | 0777},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		f, err := os.Open(filename)
+		require.NoError(t, err)
+		defer f.Close()
+
+		fi, err := f.Stat()
+		require.NoError(t, err)
+
+		e, err := NewExtractorFromReader(f, fi.Size(), t.TempDir())
+		require.NoError(t, err)
+
+		manifest := e.Manifest()
+		require.Len(t, manifest, len(e.Files()))
+
+		entries := make(map[string]EntryInfo)
+		for _, entry := range manifest {
+			entries[entry.Name] = entry
+		}
+
+		require.Contains(t, entries, "foo.go")
+		assert.EqualValues(t, 3, entries["foo.go"].UncompressedSize64)
+		assert.Equal(t, crc32.ChecksumIEEE([]byte("foo")), entries["foo.go"].CRC32)
+		assert.Equal(t, fixedModTime.Unix(), entries["foo.go"].Modified.Unix())
+		assert.True(t, entries["foo.go"].Mode.IsRegular())
+
+		require.Contains(t, entries, "bar/")
+		assert.True(t, entries["bar/"].Mode.IsDir())
+	})
+}
+
 func TestExtractorFromReader(t *testing.T) {
 	testFiles := map[string]testFile{
 		"foo.go": {mode: 0666},
@@ -227,122 +512,2363 @@ func TestExtractorDetectSymlinkTraversal(t *testing.T) {
 	require.Error(t, e.Extract(context.Background()))
 }
 
-func aopts(options ...ArchiverOption) []ArchiverOption {
-	return options
-}
+func TestExtractorContinueOnError(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "errors.zip")
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+	zw := zip.NewWriter(f)
 
-func benchmarkExtractOptions(b *testing.B, stdDeflate bool, ao []ArchiverOption, eo ...ExtractorOption) {
-	files := make(map[string]os.FileInfo)
-	filepath.Walk(*archiveDir, func(filename string, fi os.FileInfo, err error) error {
-		files[filename] = fi
-		return nil
+	for _, name := range []string{"good1", "../escape", "good2"} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, name)
+		require.NoError(t, err)
+	}
+
+	// unsupported compression method
+	_, err = zw.CreateRaw(&zip.FileHeader{Name: "unsupported", Method: 0xffff})
+	require.NoError(t, err)
+
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	t.Run("disabled", func(t *testing.T) {
+		e, err := NewExtractor(archivePath, t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+
+		err = e.Extract(context.Background())
+		require.Error(t, err)
+		assert.NotContains(t, err.Error(), "good")
+
+		var entryErr *EntryError
+		assert.False(t, errors.As(err, &entryErr))
 	})
 
-	dir := b.TempDir()
-	archiveName := filepath.Join(dir, "fastzip-benchmark-extract.zip")
-	f, err := os.Create(archiveName)
-	require.NoError(b, err)
-	defer os.Remove(f.Name())
+	t.Run("enabled", func(t *testing.T) {
+		out := t.TempDir()
+		e, err := NewExtractor(archivePath, out, WithExtractorContinueOnError(true))
+		require.NoError(t, err)
+		defer e.Close()
 
-	ao = append(ao, WithStageDirectory(dir))
-	a, err := NewArchiver(f, *archiveDir, ao...)
-	require.NoError(b, err)
+		err = e.Extract(context.Background())
+		require.Error(t, err)
 
-	err = a.Archive(context.Background(), files)
-	require.NoError(b, err)
-	require.NoError(b, a.Close())
-	require.NoError(b, f.Close())
-	b.ReportAllocs()
-	b.ResetTimer()
+		var merr MultiError
+		require.True(t, errors.As(err, &merr))
+		require.Len(t, merr, 2)
 
-	fi, _ := os.Stat(archiveName)
-	b.SetBytes(fi.Size())
-	for n := 0; n < b.N; n++ {
-		e, err := NewExtractor(archiveName, dir, eo...)
-		if stdDeflate {
-			e.RegisterDecompressor(zip.Deflate, StdFlateDecompressor())
+		names := make([]string, 0, len(merr))
+		for _, err := range merr {
+			var entryErr *EntryError
+			require.True(t, errors.As(err, &entryErr))
+			names = append(names, entryErr.Name)
 		}
-		require.NoError(b, err)
-		require.NoError(b, e.Extract(context.Background()))
-	}
+		assert.ElementsMatch(t, []string{"../escape", "unsupported"}, names)
+		assert.True(t, errors.Is(err, zip.ErrAlgorithm))
+		assert.Len(t, strings.Split(err.Error(), "\n"), 2)
+		assert.Equal(t, []error(merr), merr.Unwrap())
+
+		var entryErr *EntryError
+		assert.True(t, errors.As(err, &entryErr))
+
+		for _, name := range []string{"good1", "good2"} {
+			contents, err := os.ReadFile(filepath.Join(out, name))
+			require.NoError(t, err)
+			assert.Equal(t, name, string(contents))
+		}
+	})
 }
 
-func BenchmarkExtractStore_1(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(1))
-}
+func TestExtractorMaxSizes(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo": {mode: 0666, contents: strings.Repeat("a", 600)},
+		"bar": {mode: 0666, contents: strings.Repeat("b", 600)},
+	}
 
-func BenchmarkExtractStore_2(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(2))
-}
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
 
-func BenchmarkExtractStore_4(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(4))
-}
+	tests := map[string]struct {
+		opts []ExtractorOption
+		err  error
+	}{
+		"unlimited":                {nil, nil},
+		"within limits":            {[]ExtractorOption{WithExtractorMaxEntrySize(600), WithExtractorMaxUncompressedSize(1200)}, nil},
+		"entry size exceeded":      {[]ExtractorOption{WithExtractorMaxEntrySize(599)}, ErrMaxEntrySize},
+		"cumulative size exceeded": {[]ExtractorOption{WithExtractorMaxUncompressedSize(1000)}, ErrMaxUncompressedSize},
+	}
 
-func BenchmarkExtractStore_8(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(8))
-}
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		for tn, tc := range tests {
+			t.Run(tn, func(t *testing.T) {
+				e, err := NewExtractor(filename, t.TempDir(), tc.opts...)
+				require.NoError(t, err)
+				defer e.Close()
+
+				err = e.Extract(context.Background())
+				if tc.err == nil {
+					assert.NoError(t, err)
+				} else {
+					assert.ErrorIs(t, err, tc.err)
+				}
+			})
+		}
+	})
 
-func BenchmarkExtractStore_16(b *testing.B) {
-	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(16))
-}
+	t.Run("header size exceeded", func(t *testing.T) {
+		testFiles := map[string]testFile{
+			"large": {mode: 0666, contents: strings.Repeat("a", 1024*1024)},
+		}
 
-func BenchmarkExtractStandardFlate_1(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(1))
-}
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
 
-func BenchmarkExtractStandardFlate_2(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(2))
-}
+		testCreateArchive(t, dir, files, func(filename, chroot string) {
+			e, err := NewExtractor(filename, t.TempDir(), WithExtractorMaxEntrySize(1000))
+			require.NoError(t, err)
+			defer e.Close()
 
-func BenchmarkExtractStandardFlate_4(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(4))
-}
+			assert.ErrorIs(t, e.Extract(context.Background()), ErrMaxEntrySize)
 
-func BenchmarkExtractStandardFlate_8(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(8))
-}
+			bytes, _ := e.Written()
+			assert.Zero(t, bytes)
+		})
+	})
 
-func BenchmarkExtractStandardFlate_16(b *testing.B) {
-	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(16))
-}
+	t.Run("symlink target", func(t *testing.T) {
+		archivePath := filepath.Join(t.TempDir(), "symlinks.zip")
+		f, err := os.Create(archivePath)
+		require.NoError(t, err)
 
-func BenchmarkExtractNonStandardFlate_1(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(1))
-}
+		zw := zip.NewWriter(f)
+		for name, size := range map[string]int{"long": 1000, "bomb": 10 * 1024 * 1024} {
+			hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+			hdr.SetMode(os.ModeSymlink | 0777)
+			w, err := zw.CreateHeader(hdr)
+			require.NoError(t, err)
+			_, err = io.WriteString(w, strings.Repeat("a", size))
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+		require.NoError(t, f.Close())
+
+		tests := map[string]struct {
+			opts []ExtractorOption
+			err  error
+		}{
+			"unlimited":           {nil, ErrSymlinkTargetTooLong},
+			"entry size exceeded": {[]ExtractorOption{WithExtractorMaxEntrySize(100)}, ErrMaxEntrySize},
+		}
 
-func BenchmarkExtractNonStandardFlate_2(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(2))
-}
+		for tn, tc := range tests {
+			t.Run(tn, func(t *testing.T) {
+				opts := append([]ExtractorOption{WithExtractorContinueOnError(true)}, tc.opts...)
+				e, err := NewExtractor(archivePath, t.TempDir(), opts...)
+				require.NoError(t, err)
+				defer e.Close()
 
-func BenchmarkExtractNonStandardFlate_4(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(4))
+				assert.ErrorIs(t, e.Extract(context.Background()), tc.err)
+			})
+		}
+	})
 }
 
-func BenchmarkExtractNonStandardFlate_8(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(8))
-}
+func TestExtractorMaxCompressionRatio(t *testing.T) {
+	random := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0)).Read(random)
 
-func BenchmarkExtractNonStandardFlate_16(b *testing.B) {
-	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(16))
-}
+	testFiles := map[string]testFile{
+		"bomb":   {mode: 0666, contents: strings.Repeat("0", 10*1024*1024)},
+		"random": {mode: 0666, contents: string(random)},
+		"small":  {mode: 0666, contents: strings.Repeat("0", 1024)},
+	}
 
-func BenchmarkExtractZstd_1(b *testing.B) {
-	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(1))
-}
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
 
-func BenchmarkExtractZstd_2(b *testing.B) {
-	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(2))
-}
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		for _, name := range []string{"random", "small"} {
+			e, err := NewExtractor(filename, t.TempDir(), WithExtractorMaxCompressionRatio(100))
+			require.NoError(t, err)
 
-func BenchmarkExtractZstd_4(b *testing.B) {
-	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(4))
-}
+			for _, file := range e.Files() {
+				if file.Name == name {
+					assert.NoError(t, e.createFile(context.Background(), filepath.Join(t.TempDir(), name), file))
+				}
+			}
+			require.NoError(t, e.Close())
+		}
 
-func BenchmarkExtractZstd_8(b *testing.B) {
+		e, err := NewExtractor(filename, t.TempDir(), WithExtractorMaxCompressionRatio(100))
+		require.NoError(t, err)
+		defer e.Close()
+
+		assert.ErrorIs(t, e.Extract(context.Background()), ErrMaxCompressionRatio)
+	})
+}
+
+func TestExtractorMaxEntries(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666},
+		"bar.go": {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		for _, max := range []int{0, 2, 3} {
+			f, err := os.Open(filename)
+			require.NoError(t, err)
+			defer f.Close()
+
+			fi, err := f.Stat()
+			require.NoError(t, err)
+
+			out := t.TempDir()
+			e, err := NewExtractorFromReader(f, fi.Size(), out, WithExtractorMaxEntries(max))
+			require.NoError(t, err)
+
+			err = e.Extract(context.Background())
+			if max > 0 && max < len(files) {
+				assert.ErrorIs(t, err, ErrMaxEntries)
+
+				entries, err := os.ReadDir(out)
+				require.NoError(t, err)
+				assert.Empty(t, entries)
+			} else {
+				assert.NoError(t, err)
+			}
+		}
+	})
+}
+
+func TestExtractorMaxPathDepth(t *testing.T) {
+	testFiles := map[string]testFile{
+		"root.go":           {mode: 0666, contents: "root"},
+		"a":                 {mode: os.ModeDir | 0777},
+		"a/a.go":            {mode: 0666, contents: "a"},
+		"a/b":               {mode: os.ModeDir | 0777},
+		"a/b/b.go":          {mode: 0666, contents: "b"},
+		"a/b/c":             {mode: os.ModeDir | 0777},
+		"a/b/c/d":           {mode: os.ModeDir | 0777},
+		"a/b/c/d/deep.go":   {mode: 0666, contents: "deep"},
+		"a/b/c/d/deeper.go": {mode: 0666, contents: "deeper"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		t.Run("error", func(t *testing.T) {
+			e, err := NewExtractor(filename, t.TempDir(), WithExtractorMaxPathDepth(3))
+			require.NoError(t, err)
+			defer e.Close()
+
+			assert.ErrorIs(t, e.Extract(context.Background()), ErrMaxPathDepth)
+		})
+
+		t.Run("continue on error", func(t *testing.T) {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out, WithExtractorMaxPathDepth(3), WithExtractorContinueOnError(true))
+			require.NoError(t, err)
+			defer e.Close()
+
+			err = e.Extract(context.Background())
+			require.ErrorIs(t, err, ErrMaxPathDepth)
+
+			var merr MultiError
+			require.ErrorAs(t, err, &merr)
+			assert.Len(t, merr, 3)
+
+			for _, name := range []string{"root.go", "a/a.go", "a/b/b.go"} {
+				contents, err := os.ReadFile(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, testFiles[name].contents, string(contents))
+			}
+
+			// the directories of rejected entries are never created
+			_, err = os.Stat(filepath.Join(out, "a", "b", "c", "d"))
+			assert.True(t, os.IsNotExist(err))
+		})
+
+		t.Run("unlimited", func(t *testing.T) {
+			e, err := NewExtractor(filename, t.TempDir(), WithExtractorMaxPathDepth(0))
+			require.NoError(t, err)
+			defer e.Close()
+
+			assert.NoError(t, e.Extract(context.Background()))
+		})
+	})
+}
+
+func TestExtractorRejectDuplicateNames(t *testing.T) {
+	createArchive := func(t *testing.T, names ...string) string {
+		archivePath := filepath.Join(t.TempDir(), "duplicates.zip")
+		f, err := os.Create(archivePath)
+		require.NoError(t, err)
+		zw := zip.NewWriter(f)
+		for _, name := range names {
+			hdr := &zip.FileHeader{Name: name}
+			if strings.HasSuffix(name, "/") {
+				hdr.SetMode(os.ModeDir | 0777)
+				_, err := zw.CreateHeader(hdr)
+				require.NoError(t, err)
+				continue
+			}
+
+			hdr.SetMode(0666)
+			w, err := zw.CreateHeader(hdr)
+			require.NoError(t, err)
+			_, err = io.WriteString(w, name)
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+		require.NoError(t, f.Close())
+		return archivePath
+	}
+
+	tests := map[string]struct {
+		names     []string
+		opts      []ExtractorOption
+		duplicate bool
+	}{
+		"unique":         {names: []string{"dir/", "dir/a", "dir/b"}},
+		"directories":    {names: []string{"dir/", "dir/a", "dir/"}},
+		"files":          {names: []string{"dir/", "dir/a", "dir/a"}, duplicate: true},
+		"cleaned":        {names: []string{"dir/", "dir/a", "dir//a"}, duplicate: true},
+		"file and dir":   {names: []string{"dir/", "dir/a", "dir/a/"}, duplicate: true},
+		"stripped":       {names: []string{"x/a", "y/a"}, opts: []ExtractorOption{WithExtractorStripComponents(1)}, duplicate: true},
+		"normalized":     {names: []string{"caf\u00e9", "cafe\u0301"}, opts: []ExtractorOption{WithExtractorNormalizeNames(norm.NFC)}, duplicate: true},
+		"not normalized": {names: []string{"caf\u00e9", "cafe\u0301"}},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			archivePath := createArchive(t, tc.names...)
+
+			for _, reject := range []bool{false, true} {
+				out := t.TempDir()
+				e, err := NewExtractor(archivePath, out, append(tc.opts, WithExtractorRejectDuplicateNames(reject))...)
+				require.NoError(t, err)
+
+				err = e.Extract(context.Background())
+				require.NoError(t, e.Close())
+				if !reject || !tc.duplicate {
+					assert.NoError(t, err)
+					continue
+				}
+
+				assert.ErrorIs(t, err, ErrDuplicateName)
+				entries, err := os.ReadDir(out)
+				require.NoError(t, err)
+				assert.Empty(t, entries)
+			}
+		})
+	}
+}
+
+func TestExtractorPathRemap(t *testing.T) {
+	testFiles := map[string]testFile{
+		"repo-sha":            {mode: os.ModeDir | 0777},
+		"repo-sha/foo.go":     {mode: 0666, contents: "foo"},
+		"repo-sha/bar":        {mode: os.ModeDir | 0777},
+		"repo-sha/bar/bar.go": {mode: 0666, contents: "bar"},
+		"repo-sha/skip.go":    {mode: 0666, contents: "skip"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		t.Run("strip prefix", func(t *testing.T) {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out, WithExtractorPathRemap(func(name string) (string, bool) {
+				if name == "repo-sha/skip.go" {
+					return "", false
+				}
+				return strings.TrimPrefix(name, "repo-sha/"), true
+			}))
+			require.NoError(t, err)
+			defer e.Close()
+			require.NoError(t, e.Extract(context.Background()))
+
+			for _, name := range []string{"foo.go", "bar/bar.go"} {
+				contents, err := os.ReadFile(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, testFiles["repo-sha/"+name].contents, string(contents))
+			}
+
+			for _, name := range []string{"skip.go", "repo-sha"} {
+				_, err = os.Lstat(filepath.Join(out, name))
+				assert.True(t, os.IsNotExist(err), name)
+			}
+		})
+
+		t.Run("escape chroot", func(t *testing.T) {
+			e, err := NewExtractor(filename, t.TempDir(), WithExtractorPathRemap(func(name string) (string, bool) {
+				return "../" + name, true
+			}))
+			require.NoError(t, err)
+			defer e.Close()
+			require.Error(t, e.Extract(context.Background()))
+		})
+	})
+}
+
+func TestExtractorStripComponents(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	testFiles := map[string]testFile{
+		"top":                 {mode: os.ModeDir | 0777},
+		"top/root.go":         {mode: 0666, contents: "root"},
+		"top/sub":             {mode: os.ModeDir | 0777},
+		"top/sub/foo.go":      {mode: 0666, contents: "foo"},
+		"top/sub/deep":        {mode: os.ModeDir | 0777},
+		"top/sub/deep/bar.go": {mode: 0666, contents: "bar"},
+		"top/sub/symlink":     {mode: os.ModeSymlink | symMode, contents: "foo.go"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	tests := map[int][]string{
+		0: {"top", "top/root.go", "top/sub", "top/sub/foo.go", "top/sub/deep", "top/sub/deep/bar.go", "top/sub/symlink"},
+		1: {"root.go", "sub", "sub/foo.go", "sub/deep", "sub/deep/bar.go", "sub/symlink"},
+		2: {"foo.go", "deep", "deep/bar.go", "symlink"},
+		3: {"bar.go"},
+		4: {},
+	}
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		for n, expected := range tests {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out, WithExtractorStripComponents(n))
+			require.NoError(t, err)
+			require.NoError(t, e.Extract(context.Background()))
+			require.NoError(t, e.Close())
+
+			var extracted []string
+			err = filepath.Walk(out, func(pathname string, fi os.FileInfo, err error) error {
+				rel, err := filepath.Rel(out, pathname)
+				if rel != "." {
+					extracted = append(extracted, filepath.ToSlash(rel))
+				}
+				return err
+			})
+			require.NoError(t, err)
+			assert.ElementsMatch(t, expected, extracted, "strip %d", n)
+		}
+	})
+
+	_, err := NewExtractor(filepath.Join("testdata", "bzip2.zip"), t.TempDir(), WithExtractorStripComponents(-1))
+	assert.ErrorIs(t, err, ErrMinStripComponents)
+}
+
+func aopts(options ...ArchiverOption) []ArchiverOption {
+	return options
+}
+
+func benchmarkExtractOptions(b *testing.B, stdDeflate bool, ao []ArchiverOption, eo ...ExtractorOption) {
+	files := make(map[string]os.FileInfo)
+	filepath.Walk(*archiveDir, func(filename string, fi os.FileInfo, err error) error {
+		files[filename] = fi
+		return nil
+	})
+
+	dir := b.TempDir()
+	archiveName := filepath.Join(dir, "fastzip-benchmark-extract.zip")
+	f, err := os.Create(archiveName)
+	require.NoError(b, err)
+	defer os.Remove(f.Name())
+
+	ao = append(ao, WithStageDirectory(dir))
+	a, err := NewArchiver(f, *archiveDir, ao...)
+	require.NoError(b, err)
+
+	err = a.Archive(context.Background(), files)
+	require.NoError(b, err)
+	require.NoError(b, a.Close())
+	require.NoError(b, f.Close())
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	fi, _ := os.Stat(archiveName)
+	b.SetBytes(fi.Size())
+	for n := 0; n < b.N; n++ {
+		e, err := NewExtractor(archiveName, dir, eo...)
+		if stdDeflate {
+			e.RegisterDecompressor(zip.Deflate, StdFlateDecompressor())
+		}
+		require.NoError(b, err)
+		require.NoError(b, e.Extract(context.Background()))
+	}
+}
+
+func BenchmarkExtractStore_1(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(1))
+}
+
+func BenchmarkExtractStore_2(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(2))
+}
+
+func BenchmarkExtractStore_4(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(4))
+}
+
+func BenchmarkExtractStore_8(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(8))
+}
+
+func BenchmarkExtractStore_16(b *testing.B) {
+	benchmarkExtractOptions(b, true, aopts(WithArchiverMethod(zip.Store)), WithExtractorConcurrency(16))
+}
+
+func BenchmarkExtractStandardFlate_1(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(1))
+}
+
+func BenchmarkExtractStandardFlate_2(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(2))
+}
+
+func BenchmarkExtractStandardFlate_4(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(4))
+}
+
+func BenchmarkExtractStandardFlate_8(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(8))
+}
+
+func BenchmarkExtractStandardFlate_16(b *testing.B) {
+	benchmarkExtractOptions(b, true, nil, WithExtractorConcurrency(16))
+}
+
+func BenchmarkExtractNonStandardFlate_1(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(1))
+}
+
+func BenchmarkExtractNonStandardFlate_2(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(2))
+}
+
+func BenchmarkExtractNonStandardFlate_4(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(4))
+}
+
+func BenchmarkExtractNonStandardFlate_8(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(8))
+}
+
+func BenchmarkExtractNonStandardFlate_16(b *testing.B) {
+	benchmarkExtractOptions(b, false, nil, WithExtractorConcurrency(16))
+}
+
+func BenchmarkExtractZstd_1(b *testing.B) {
+	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(1))
+}
+
+func BenchmarkExtractZstd_2(b *testing.B) {
+	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(2))
+}
+
+func BenchmarkExtractZstd_4(b *testing.B) {
+	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(4))
+}
+
+func BenchmarkExtractZstd_8(b *testing.B) {
 	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(8))
 }
 
 func BenchmarkExtractZstd_16(b *testing.B) {
 	benchmarkExtractOptions(b, false, aopts(WithArchiverMethod(zstd.ZipMethodWinZip)), WithExtractorConcurrency(16))
 }
+
+func TestExtractorCreationTime(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out, WithExtractorRestoreCreationTime(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		for _, f := range e.Files() {
+			fields, err := zipextra.Parse(f.Extra)
+			require.NoError(t, err)
+
+			expected, ok := birthTime(files[filepath.Join(dir, f.Name)])
+			btime, found := creationTime(fields)
+			require.Equal(t, ok, found, f.Name)
+			if ok {
+				assert.Equal(t, expected.UnixNano()/100, btime.UnixNano()/100, f.Name)
+			}
+		}
+
+		require.NoError(t, e.Extract(context.Background()))
+
+		for name, fi := range files {
+			rel, err := filepath.Rel(dir, name)
+			require.NoError(t, err)
+
+			expected, ok := birthTime(fi)
+			if !ok {
+				continue
+			}
+
+			efi, err := os.Lstat(filepath.Join(out, rel))
+			require.NoError(t, err)
+
+			btime, ok := birthTime(efi)
+			require.True(t, ok)
+			assert.Equal(t, expected.UnixNano()/100, btime.UnixNano()/100, rel)
+		}
+	}, WithArchiverStoreCreationTime(true))
+}
+
+func TestExtractorNTFSTimes(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar"},
+	}
+
+	mtime := fixedModTime.Add(123456700 * time.Nanosecond)
+	atime := fixedModTime.Add(time.Hour + 987654300*time.Nanosecond)
+
+	for _, store := range []bool{false, true} {
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		bar := filepath.Join(dir, "foo", "bar")
+		require.NoError(t, os.Chtimes(bar, atime, mtime))
+		fi, err := os.Lstat(bar)
+		require.NoError(t, err)
+		files[bar] = fi
+
+		testCreateArchive(t, dir, files, func(filename, chroot string) {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out)
+			require.NoError(t, err)
+			defer e.Close()
+
+			for _, f := range e.Files() {
+				if f.Name != "foo/bar" {
+					continue
+				}
+
+				fields, err := zipextra.Parse(f.Extra)
+				require.NoError(t, err)
+				require.Equal(t, store, fields[zipextra.ExtraFieldNTFS] != nil)
+				if !store {
+					continue
+				}
+
+				ntfs, err := fields[zipextra.ExtraFieldNTFS].NTFS()
+				require.NoError(t, err)
+				require.Len(t, ntfs.Attributes, 1)
+				attr := ntfs.Attributes[0].(zipextra.NTFSTimeAttribute)
+				assert.True(t, mtime.Equal(attr.MTime))
+				if _, ok := accessTime(fi); ok {
+					assert.True(t, atime.Equal(attr.ATime))
+				}
+			}
+
+			require.NoError(t, e.Extract(context.Background()))
+
+			efi, err := os.Lstat(filepath.Join(out, "foo", "bar"))
+			require.NoError(t, err)
+			if store {
+				// times are set with microsecond precision on some platforms
+				assert.WithinDuration(t, mtime, efi.ModTime(), time.Microsecond)
+			} else {
+				assert.True(t, mtime.Truncate(time.Second).Equal(efi.ModTime()), efi.ModTime())
+			}
+		}, WithArchiverStoreNTFSTimes(store))
+	}
+}
+
+func TestExtractorPreciseModTime(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("nanosecond times are only asserted on linux")
+	}
+
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	mtime := fixedModTime.Add(123456789 * time.Nanosecond)
+	for _, name := range []string{"foo", "foo/bar"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+		fi, err := os.Lstat(path)
+		require.NoError(t, err)
+		require.True(t, mtime.Equal(fi.ModTime()), "filesystem lacks nanosecond precision")
+		files[path] = fi
+	}
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out)
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		for _, name := range []string{"foo", "foo/bar"} {
+			fi, err := os.Lstat(filepath.Join(out, name))
+			require.NoError(t, err)
+			assert.True(t, mtime.Equal(fi.ModTime()), "%s: %v", name, fi.ModTime())
+		}
+	}, WithArchiverStorePreciseModTime(true))
+}
+
+func TestExtractorExtractFile(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	testFiles := map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/bar":     {mode: 0666, contents: strings.Repeat("bar", 1000)},
+		"foo/symlink": {mode: os.ModeSymlink | symMode, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out)
+		require.NoError(t, err)
+		defer e.Close()
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, e.ExtractFile(context.Background(), "foo/bar", buf))
+		assert.Equal(t, testFiles["foo/bar"].contents, buf.String())
+
+		// nothing is written to disk
+		written, entries := e.Written()
+		assert.EqualValues(t, 0, written)
+		assert.EqualValues(t, 0, entries)
+
+		assert.ErrorIs(t, e.ExtractFile(context.Background(), "foo/missing", io.Discard), ErrEntryNotFound)
+		assert.ErrorIs(t, e.ExtractFile(context.Background(), "foo/", io.Discard), ErrNotRegularFile)
+		assert.ErrorIs(t, e.ExtractFile(context.Background(), "foo/symlink", io.Discard), ErrNotRegularFile)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.ErrorIs(t, e.ExtractFile(ctx, "foo/bar", io.Discard), context.Canceled)
+
+		extracted, err := os.ReadDir(out)
+		require.NoError(t, err)
+		assert.Empty(t, extracted)
+
+		// the maximum uncompressed size applies to each call
+		e, err = NewExtractor(filename, out, WithExtractorMaxUncompressedSize(3000))
+		require.NoError(t, err)
+		defer e.Close()
+
+		for i := 0; i < 2; i++ {
+			buf := new(bytes.Buffer)
+			require.NoError(t, e.ExtractFile(context.Background(), "foo/bar", buf))
+			assert.Equal(t, testFiles["foo/bar"].contents, buf.String())
+		}
+	})
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "bad",
+		Method:             zip.Store,
+		CRC32:              1,
+		CompressedSize64:   4,
+		UncompressedSize64: 4,
+	})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	e, err := NewExtractorFromReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), t.TempDir())
+	require.NoError(t, err)
+	assert.ErrorIs(t, e.ExtractFile(context.Background(), "bad", io.Discard), zip.ErrChecksum)
+}
+
+func TestExtractorWriteBufferSize(t *testing.T) {
+	testFiles := map[string]testFile{
+		"small": {mode: 0666, contents: "small"},
+		"large": {mode: 0666, contents: strings.Repeat("abcdefzmkdldjsdfkjsdfsdfiqwpsdfa", 4096)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		for _, size := range []int{16, 1024 * 1024} {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out, WithExtractorWriteBufferSize(size))
+			require.NoError(t, err)
+			defer e.Close()
+
+			bw := e.writers.Get().(*bufio.Writer)
+			assert.Equal(t, size, bw.Size())
+			e.writers.Put(bw)
+
+			require.NoError(t, e.Extract(context.Background()))
+			for name, tf := range testFiles {
+				contents, err := os.ReadFile(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, tf.contents, string(contents))
+			}
+		}
+
+		_, err := NewExtractor(filename, t.TempDir(), WithExtractorWriteBufferSize(15))
+		assert.ErrorIs(t, err, ErrMinBufferSize)
+	})
+}
+
+func TestExtractorOpenRaw(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: strings.Repeat("bar", 1000)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		e, err := NewExtractor(filename, t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+
+		r, hdr, err := e.OpenRaw("foo/bar")
+		require.NoError(t, err)
+		assert.Equal(t, "foo/bar", hdr.Name)
+		assert.Equal(t, zip.Deflate, hdr.Method)
+		assert.Less(t, hdr.CompressedSize64, hdr.UncompressedSize64)
+
+		// the compressed data can be copied to another archive as is
+		archivePath := filepath.Join(t.TempDir(), "copy.zip")
+		f, err := os.Create(archivePath)
+		require.NoError(t, err)
+		zw := zip.NewWriter(f)
+		hdr.Name = "bar"
+		w, err := zw.CreateRaw(hdr)
+		require.NoError(t, err)
+		n, err := io.Copy(w, r)
+		require.NoError(t, err)
+		assert.EqualValues(t, hdr.CompressedSize64, n)
+		require.NoError(t, zw.Close())
+		require.NoError(t, f.Close())
+
+		testExtract(t, archivePath, map[string]testFile{
+			"bar": testFiles["foo/bar"],
+		})
+
+		_, _, err = e.OpenRaw("foo/missing")
+		assert.ErrorIs(t, err, ErrEntryNotFound)
+	})
+}
+
+func TestExtractorExtractGlob(t *testing.T) {
+	testFiles := map[string]testFile{
+		"src":            {mode: os.ModeDir | 0777},
+		"src/main.go":    {mode: 0666, contents: "main"},
+		"src/README":     {mode: 0666, contents: "readme"},
+		"src/pkg":        {mode: os.ModeDir | 0777},
+		"src/pkg/foo.go": {mode: 0666, contents: "foo"},
+		"src/pkg/foo.c":  {mode: 0666, contents: "foo"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	tests := map[string][]string{
+		"src/*.go":   {"src", "src/main.go"},
+		"src/*/*.go": {"src", "src/pkg", "src/pkg/foo.go"},
+		"src/pkg":    {"src", "src/pkg"},
+		"*.txt":      nil,
+	}
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		for pattern, expected := range tests {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out)
+			require.NoError(t, err)
+			require.NoError(t, e.ExtractGlob(context.Background(), pattern))
+			require.NoError(t, e.Close())
+
+			var extracted []string
+			err = filepath.Walk(out, func(pathname string, fi os.FileInfo, err error) error {
+				rel, err := filepath.Rel(out, pathname)
+				if rel != "." {
+					extracted = append(extracted, filepath.ToSlash(rel))
+				}
+				return err
+			})
+			require.NoError(t, err)
+			assert.ElementsMatch(t, expected, extracted, "pattern %q", pattern)
+		}
+
+		e, err := NewExtractor(filename, t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+		assert.ErrorIs(t, e.ExtractGlob(context.Background(), "["), path.ErrBadPattern)
+	})
+}
+
+func TestExtractorExtractStructure(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":             {mode: os.ModeDir | 0777},
+		"foo/bar.go":      {mode: 0666, contents: strings.Repeat("bar", 1000)},
+		"foo/baz":         {mode: os.ModeDir | 0700},
+		"foo/baz/exec.sh": {mode: 0755, contents: "#!/bin/sh"},
+		"foo/link":        {mode: os.ModeSymlink | 0777, contents: "bar.go"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out)
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.ExtractStructure(context.Background()))
+		_, entries := e.Written()
+		assert.Equal(t, int64(len(files)), entries)
+
+		for name, tf := range testFiles {
+			pathname := filepath.Join(out, filepath.FromSlash(name))
+			fi, err := os.Lstat(pathname)
+			require.NoError(t, err)
+
+			switch {
+			case tf.mode.IsDir():
+				assert.True(t, fi.IsDir(), "%v is not a directory", name)
+			case tf.mode&os.ModeSymlink != 0:
+				link, err := os.Readlink(pathname)
+				require.NoError(t, err)
+				assert.Equal(t, tf.contents, link)
+			default:
+				assert.True(t, fi.Mode().IsRegular(), "%v is not a regular file", name)
+				assert.Equal(t, int64(0), fi.Size(), "%v is not empty", name)
+				assert.Equal(t, fixedModTime.Unix(), fi.ModTime().Unix(), "%v mod time not equal", name)
+				if runtime.GOOS != "windows" {
+					assert.Equal(t, tf.mode.Perm(), fi.Mode().Perm(), "%v mode not equal", name)
+				}
+			}
+		}
+
+		// a regular extraction afterwards populates the placeholders
+		require.NoError(t, e.Extract(context.Background()))
+		contents, err := os.ReadFile(filepath.Join(out, "foo", "bar.go"))
+		require.NoError(t, err)
+		assert.Equal(t, testFiles["foo/bar.go"].contents, string(contents))
+	})
+}
+
+func TestExtractorReset(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: strings.Repeat("foo", 1000)},
+		"bar.go": {mode: 0666, contents: strings.Repeat("bar", 1000)},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		var calls int
+		dcomp := FlateDecompressor()
+
+		out1 := t.TempDir()
+		e, err := NewExtractor(filename, out1, WithExtractorConcurrency(1))
+		require.NoError(t, err)
+		defer e.Close()
+
+		e.RegisterDecompressor(zip.Deflate, func(r io.Reader) io.ReadCloser {
+			calls++
+			return dcomp(r)
+		})
+		require.NoError(t, e.Extract(context.Background()))
+		assert.Equal(t, 2, calls)
+
+		out2 := t.TempDir()
+		require.NoError(t, e.Reset(filename, out2))
+		assert.Equal(t, Progress{EntriesTotal: int64(len(files))}, e.Progress())
+		require.NoError(t, e.Extract(context.Background()))
+		assert.Equal(t, 4, calls)
+
+		data, err := os.ReadFile(filename)
+		require.NoError(t, err)
+
+		out3 := t.TempDir()
+		require.NoError(t, e.ResetFromReader(bytes.NewReader(data), int64(len(data)), out3))
+		require.NoError(t, e.Extract(context.Background()))
+		assert.Equal(t, 6, calls)
+
+		for _, out := range []string{out1, out2, out3} {
+			for name, tf := range testFiles {
+				contents, err := os.ReadFile(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, tf.contents, string(contents))
+			}
+		}
+
+		assert.Error(t, e.Reset(filepath.Join(out1, "missing.zip"), out1))
+	})
+}
+
+func TestExtractorCRCErrorHandler(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"bad", "removed"} {
+		hdr := &zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			CRC32:              1,
+			CompressedSize64:   4,
+			UncompressedSize64: 4,
+		}
+		hdr.SetMode(0600)
+		w, err := zw.CreateRaw(hdr)
+		require.NoError(t, err)
+		_, err = w.Write([]byte("data"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	t.Run("default", func(t *testing.T) {
+		e, err := NewExtractorFromReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), t.TempDir())
+		require.NoError(t, err)
+		assert.ErrorIs(t, e.Extract(context.Background()), zip.ErrChecksum)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		errAbort := errors.New("abort")
+		e, err := NewExtractorFromReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), t.TempDir(), WithExtractorCRCErrorHandler(func(file *zip.File, err error) error {
+			return errAbort
+		}))
+		require.NoError(t, err)
+		assert.ErrorIs(t, e.Extract(context.Background()), errAbort)
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		dir := t.TempDir()
+		var handled []string
+
+		// calls are serialized, so the handler doesn't need its own lock
+		e, err := NewExtractorFromReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dir, WithExtractorCRCErrorHandler(func(file *zip.File, err error) error {
+			assert.ErrorIs(t, err, zip.ErrChecksum)
+
+			handled = append(handled, file.Name)
+
+			if file.Name == "removed" {
+				return os.Remove(filepath.Join(dir, file.Name))
+			}
+			return nil
+		}))
+		require.NoError(t, err)
+		require.NoError(t, e.Extract(context.Background()))
+		assert.ElementsMatch(t, []string{"bad", "removed"}, handled)
+
+		_, entries := e.Written()
+		assert.EqualValues(t, 2, entries)
+
+		data, err := os.ReadFile(filepath.Join(dir, "bad"))
+		require.NoError(t, err)
+		assert.Equal(t, "data", string(data))
+
+		fi, err := os.Stat(filepath.Join(dir, "bad"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+		_, err = os.Stat(filepath.Join(dir, "removed"))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestExtractorOwnerMapping(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ownership isn't stored on windows")
+	}
+
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666},
+		"bar.go": {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		var m sync.Mutex
+		var mapped int
+
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out, WithExtractorOwnerMapping(func(uid, gid int) (int, int) {
+			assert.Equal(t, os.Getuid(), uid)
+			assert.Equal(t, os.Getgid(), gid)
+
+			m.Lock()
+			mapped++
+			m.Unlock()
+
+			return -1, os.Getgid()
+		}), WithExtractorChownErrorHandler(func(name string, err error) error {
+			return err
+		}))
+		require.NoError(t, err)
+		require.NoError(t, e.Extract(context.Background()))
+		require.NoError(t, e.Close())
+		assert.Equal(t, len(files), mapped)
+
+		// mapping to an id the user can't chown to is passed to the error
+		// handler
+		if os.Geteuid() != 0 {
+			var handled int
+			e, err = NewExtractor(filename, t.TempDir(), WithExtractorOwnerMapping(func(uid, gid int) (int, int) {
+				return 0, 0
+			}), WithExtractorConcurrency(1), WithExtractorChownErrorHandler(func(name string, err error) error {
+				handled++
+				return nil
+			}))
+			require.NoError(t, err)
+			require.NoError(t, e.Extract(context.Background()))
+			require.NoError(t, e.Close())
+			assert.Equal(t, len(files), handled)
+		}
+
+		// mapping isn't consulted when ownership isn't restored
+		e, err = NewExtractor(filename, t.TempDir(), WithExtractorChownPolicy(ChownNever), WithExtractorOwnerMapping(func(uid, gid int) (int, int) {
+			assert.Fail(t, "owner mapping should not have been consulted")
+			return uid, gid
+		}))
+		require.NoError(t, err)
+		require.NoError(t, e.Extract(context.Background()))
+		require.NoError(t, e.Close())
+	})
+}
+
+func TestExtractorRateLimit(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: 0666, contents: strings.Repeat("foo", 48*1024)},
+		"bar":     {mode: 0666, contents: strings.Repeat("bar", 48*1024)},
+		"baz/qux": {mode: 0666, contents: "qux"},
+		"baz":     {mode: os.ModeDir | 0777},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		e, err := NewExtractor(filename, t.TempDir(), WithExtractorConcurrency(2), WithExtractorRateLimit(1024*1024))
+		require.NoError(t, err)
+		defer e.Close()
+
+		start := time.Now()
+		require.NoError(t, e.Extract(context.Background()))
+
+		// 288KiB at 1MiB/s with an initially empty bucket takes at least 281ms
+		assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+	})
+}
+
+func TestExtractorPerEntryTimeout(t *testing.T) {
+	testFiles := map[string]testFile{
+		"slow": {mode: 0666, contents: strings.Repeat("slow", 64*1024)},
+		"fast": {mode: 0666, contents: "fast"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		// 256KiB at 64KiB/s takes far longer than the timeout
+		e, err := NewExtractor(filename, t.TempDir(),
+			WithExtractorRateLimit(64*1024),
+			WithExtractorPerEntryTimeout(100*time.Millisecond),
+			WithExtractorContinueOnError(true),
+		)
+		require.NoError(t, err)
+		defer e.Close()
+
+		err = e.Extract(context.Background())
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		var merr MultiError
+		require.ErrorAs(t, err, &merr)
+		require.Len(t, merr, 1)
+		assert.Equal(t, "slow: context deadline exceeded", merr[0].Error())
+
+		e, err = NewExtractor(filename, t.TempDir(),
+			WithExtractorRateLimit(64*1024),
+			WithExtractorPerEntryTimeout(100*time.Millisecond),
+		)
+		require.NoError(t, err)
+		defer e.Close()
+
+		err = e.Extract(context.Background())
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, "slow: context deadline exceeded", err.Error())
+	})
+}
+
+func TestExtractorProgressHandler(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: 0666, contents: strings.Repeat("foo", 48*1024)},
+		"bar":     {mode: 0666, contents: strings.Repeat("bar", 48*1024)},
+		"baz/qux": {mode: 0666, contents: "qux"},
+		"baz":     {mode: os.ModeDir | 0777},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		var updates []Progress
+		interval := 50 * time.Millisecond
+
+		e, err := NewExtractor(filename, t.TempDir(),
+			WithExtractorRateLimit(1024*1024),
+			WithExtractorProgressInterval(interval),
+			WithExtractorProgressHandler(func(p Progress) {
+				updates = append(updates, p)
+			}),
+		)
+		require.NoError(t, err)
+		defer e.Close()
+
+		start := time.Now()
+		require.NoError(t, e.Extract(context.Background()))
+		elapsed := time.Since(start)
+
+		// rate limited extraction takes several intervals, updates are
+		// coalesced to at most one per interval, plus the final update
+		require.Greater(t, len(updates), 1)
+		assert.LessOrEqual(t, len(updates), int(elapsed/interval)+1)
+		assert.Equal(t, e.Progress(), updates[len(updates)-1])
+
+		for i := 1; i < len(updates); i++ {
+			assert.NotEqual(t, updates[i-1], updates[i])
+			assert.GreaterOrEqual(t, updates[i].BytesWritten, updates[i-1].BytesWritten)
+			assert.GreaterOrEqual(t, updates[i].EntriesDone, updates[i-1].EntriesDone)
+		}
+
+		// nothing is extracted by an empty glob, so there's no progress to report
+		updates = nil
+		require.NoError(t, e.ExtractGlob(context.Background(), "nothing"))
+		assert.Empty(t, updates)
+
+		_, err = NewExtractor(filename, t.TempDir(), WithExtractorProgressInterval(0))
+		assert.ErrorIs(t, err, ErrMinProgressInterval)
+	})
+}
+
+func TestExtractorSelfExtracting(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: strings.Repeat("bar", 1000)},
+		"baz":     {mode: 0666, contents: "baz"},
+		"empty":   {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	stub := make([]byte, 128*1024)
+	rand.New(rand.NewSource(0)).Read(stub)
+
+	// with offset, the archive's offsets account for the stub, otherwise
+	// they're relative to the start of the archive, as when concatenated
+	for _, offset := range []bool{false, true} {
+		t.Run(fmt.Sprintf("offset %v", offset), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			buf.Write(stub)
+
+			var opts []ArchiverOption
+			if offset {
+				opts = append(opts, WithArchiverOffset(int64(len(stub))))
+			}
+
+			a, err := NewArchiver(buf, dir, opts...)
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			filename := filepath.Join(t.TempDir(), "sfx.exe")
+			require.NoError(t, os.WriteFile(filename, buf.Bytes(), 0666))
+
+			testExtract(t, filename, testFiles)
+
+			e, err := NewExtractorFromReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), t.TempDir())
+			require.NoError(t, err)
+			require.NoError(t, e.Extract(context.Background()))
+		})
+	}
+}
+
+func TestExtractorAccessors(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo": {mode: 0666, contents: "foo"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		dir := t.TempDir()
+
+		e, err := NewExtractor(filename, dir, WithExtractorConcurrency(3))
+		require.NoError(t, err)
+		defer e.Close()
+
+		abs, err := filepath.Abs(dir)
+		require.NoError(t, err)
+
+		assert.Equal(t, abs, e.Chroot())
+		assert.Equal(t, 3, e.Concurrency())
+	})
+}
+
+func TestExtractorVerify(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"bad", "good", "worse"} {
+		contents := []byte(name)
+		crc := crc32.ChecksumIEEE(contents)
+		if name != "good" {
+			crc++
+		}
+
+		hdr := &zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			CRC32:              crc,
+			CompressedSize64:   uint64(len(contents)),
+			UncompressedSize64: uint64(len(contents)),
+		}
+		hdr.SetMode(0600)
+		w, err := zw.CreateRaw(hdr)
+		require.NoError(t, err)
+		_, err = w.Write(contents)
+		require.NoError(t, err)
+	}
+	_, err := zw.Create("dir/")
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	t.Run("first", func(t *testing.T) {
+		dir := t.TempDir()
+		e, err := NewExtractorFromReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dir, WithExtractorConcurrency(1))
+		require.NoError(t, err)
+
+		err = e.Verify(context.Background())
+		assert.ErrorIs(t, err, zip.ErrChecksum)
+
+		var entryErr *EntryError
+		require.True(t, errors.As(err, &entryErr))
+		assert.Equal(t, "bad", entryErr.Name)
+
+		// nothing is written to disk
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+
+		written, _ := e.Written()
+		assert.Zero(t, written)
+	})
+
+	t.Run("all", func(t *testing.T) {
+		e, err := NewExtractorFromReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), t.TempDir(), WithExtractorContinueOnError(true))
+		require.NoError(t, err)
+
+		err = e.Verify(context.Background())
+		var merr MultiError
+		require.True(t, errors.As(err, &merr))
+
+		var names []string
+		for _, err := range merr {
+			assert.ErrorIs(t, err, zip.ErrChecksum)
+			names = append(names, err.(*EntryError).Name)
+		}
+		assert.ElementsMatch(t, []string{"bad", "worse"}, names)
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		testFiles := map[string]testFile{
+			"foo":     {mode: os.ModeDir | 0777},
+			"foo/bar": {mode: 0666, contents: strings.Repeat("bar", 1000)},
+			"baz":     {mode: 0666, contents: "baz"},
+		}
+
+		files, dir := testCreateFiles(t, testFiles)
+		defer os.RemoveAll(dir)
+
+		testCreateArchive(t, dir, files, func(filename, chroot string) {
+			e, err := NewExtractor(filename, t.TempDir())
+			require.NoError(t, err)
+			defer e.Close()
+
+			assert.NoError(t, e.Verify(context.Background()))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			assert.ErrorIs(t, e.Verify(ctx), context.Canceled)
+		})
+	})
+}
+
+func TestExtractorSpanned(t *testing.T) {
+	random := make([]byte, 200*1024)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	testFiles := map[string]testFile{
+		"foo":        {mode: os.ModeDir | 0777},
+		"foo/random": {mode: 0666, contents: string(random[:150*1024])},
+		"foo/text":   {mode: 0666, contents: strings.Repeat("foo", 10000)},
+		"bar":        {mode: 0666, contents: string(random[150*1024:])},
+		"empty":      {mode: 0666},
+	}
+
+	for _, zip64 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("zip64 %v", zip64), func(t *testing.T) {
+			files, dir := testCreateFiles(t, testFiles)
+			defer os.RemoveAll(dir)
+
+			base := filepath.Join(t.TempDir(), "archive")
+			a, err := NewSpannedArchiver(base, dir, MinPartSize, WithArchiverForceZip64(zip64))
+			require.NoError(t, err)
+			require.NoError(t, a.Archive(context.Background(), files))
+			require.NoError(t, a.Close())
+
+			out := t.TempDir()
+			e, err := NewSpannedExtractor(base+".zip", out)
+			require.NoError(t, err)
+			require.Len(t, e.Files(), len(files))
+			require.NoError(t, e.Extract(context.Background()))
+			require.NoError(t, e.Close())
+
+			for name, tf := range testFiles {
+				if tf.mode.IsDir() {
+					continue
+				}
+				contents, err := os.ReadFile(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, tf.contents, string(contents), name)
+			}
+
+			// a missing part is reported by name
+			require.NoError(t, os.Remove(base+".z02"))
+			_, err = NewSpannedExtractor(base, t.TempDir())
+			assert.ErrorIs(t, err, ErrMissingPart)
+			assert.Contains(t, err.Error(), "archive.z02")
+		})
+	}
+}
+
+func TestExtractorPreallocate(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: strings.Repeat("bar", 100000)},
+		"baz":     {mode: 0666, contents: "baz"},
+		"empty":   {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		// with and without the preallocated size being bounded
+		for _, max := range []int64{0, 1 << 20} {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out, WithExtractorPreallocate(true), WithExtractorMaxEntrySize(max))
+			require.NoError(t, err)
+			defer e.Close()
+			require.NoError(t, e.Extract(context.Background()))
+
+			for name, tf := range testFiles {
+				if tf.mode.IsDir() {
+					continue
+				}
+				contents, err := os.ReadFile(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, tf.contents, string(contents), name)
+			}
+		}
+	})
+}
+
+func TestExtractorFsync(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":         {mode: os.ModeDir | 0777},
+		"foo/bar":     {mode: 0666, contents: strings.Repeat("bar", 100000)},
+		"foo/baz":     {mode: os.ModeDir | 0777},
+		"foo/baz/qux": {mode: 0666, contents: "qux"},
+		"stored":      {mode: 0666, contents: "stored"},
+		"empty":       {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out, WithExtractorFsync(true))
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		for name, tf := range testFiles {
+			if tf.mode.IsDir() {
+				continue
+			}
+			contents, err := os.ReadFile(filepath.Join(out, name))
+			require.NoError(t, err)
+			assert.Equal(t, tf.contents, string(contents), name)
+		}
+	})
+}
+
+func TestExtractorAtomic(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: strings.Repeat("bar", 1000)},
+		"baz":     {mode: 0666, contents: "baz"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		parent := t.TempDir()
+		out := filepath.Join(parent, "out")
+		require.NoError(t, os.Mkdir(out, 0777))
+		require.NoError(t, os.WriteFile(filepath.Join(out, "stale"), []byte("stale"), 0666))
+
+		// a failed extraction leaves the existing chroot untouched
+		e, err := NewExtractor(filename, out, WithExtractorAtomic(true), WithExtractorMaxEntrySize(100))
+		require.NoError(t, err)
+		assert.ErrorIs(t, e.Extract(context.Background()), ErrMaxEntrySize)
+		require.NoError(t, e.Close())
+
+		entries, err := os.ReadDir(parent)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.FileExists(t, filepath.Join(out, "stale"))
+		assert.NoFileExists(t, filepath.Join(out, "baz"))
+
+		// a successful extraction replaces the existing chroot
+		e, err = NewExtractor(filename, out, WithExtractorAtomic(true))
+		require.NoError(t, err)
+		require.NoError(t, e.Extract(context.Background()))
+		require.NoError(t, e.Close())
+		assert.Equal(t, out, e.Chroot())
+
+		entries, err = os.ReadDir(parent)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.NoFileExists(t, filepath.Join(out, "stale"))
+
+		for name, tf := range testFiles {
+			if tf.mode.IsDir() {
+				continue
+			}
+			contents, err := os.ReadFile(filepath.Join(out, name))
+			require.NoError(t, err)
+			assert.Equal(t, tf.contents, string(contents), name)
+		}
+	})
+}
+
+func TestExtractorFlatten(t *testing.T) {
+	testFiles := map[string]testFile{
+		"a":         {mode: os.ModeDir | 0777},
+		"a/foo.txt": {mode: 0666, contents: "a"},
+		"b":         {mode: os.ModeDir | 0777},
+		"b/foo.txt": {mode: 0666, contents: "b"},
+		"b/c":       {mode: os.ModeDir | 0777},
+		"b/c/bar":   {mode: 0666, contents: "bar"},
+	}
+	if runtime.GOOS != "windows" {
+		testFiles["link"] = testFile{mode: os.ModeSymlink | 0777, contents: "a/foo.txt"}
+	}
+
+	tests := map[string]struct {
+		opts     []ExtractorOption
+		expected map[string]string
+		err      error
+	}{
+		"rename": {nil, map[string]string{"foo.txt": "a", "foo_1.txt": "b", "bar": "bar"}, nil},
+		"skip":   {[]ExtractorOption{WithExtractorFlattenPolicy(MergeSkip)}, map[string]string{"foo.txt": "a", "bar": "bar"}, nil},
+		"error":  {[]ExtractorOption{WithExtractorFlattenPolicy(MergeError)}, nil, ErrDuplicateName},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		for tn, tc := range tests {
+			t.Run(tn, func(t *testing.T) {
+				out := t.TempDir()
+				e, err := NewExtractor(filename, out, append(tc.opts, WithExtractorFlatten(true))...)
+				require.NoError(t, err)
+				defer e.Close()
+
+				err = e.Extract(context.Background())
+				if tc.err != nil {
+					assert.ErrorIs(t, err, tc.err)
+					return
+				}
+				require.NoError(t, err)
+
+				entries, err := os.ReadDir(out)
+				require.NoError(t, err)
+				assert.Len(t, entries, len(tc.expected))
+
+				for name, contents := range tc.expected {
+					data, err := os.ReadFile(filepath.Join(out, name))
+					require.NoError(t, err)
+					assert.Equal(t, contents, string(data), name)
+				}
+			})
+		}
+	})
+}
+
+func TestExtractorComment(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	_, err := zw.Create("foo")
+	require.NoError(t, err)
+	require.NoError(t, zw.SetComment("build 1234"))
+	require.NoError(t, zw.Close())
+
+	e, err := NewExtractorFromReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), t.TempDir())
+	require.NoError(t, err)
+	assert.Equal(t, "build 1234", e.Comment())
+}
+
+// blockingReaderAt blocks reads once blocked is closed, until released is
+// closed.
+type blockingReaderAt struct {
+	r        io.ReaderAt
+	blocked  chan struct{}
+	released chan struct{}
+}
+
+func (r *blockingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	select {
+	case <-r.blocked:
+		<-r.released
+	default:
+	}
+	return r.r.ReadAt(p, off)
+}
+
+func TestExtractorContextReaderAt(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: "foo"},
+		"bar.go": {mode: 0666, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		data, err := os.ReadFile(filename)
+		require.NoError(t, err)
+
+		br := &blockingReaderAt{r: bytes.NewReader(data), blocked: make(chan struct{}), released: make(chan struct{})}
+		defer close(br.released)
+
+		e, err := NewExtractorFromReader(ContextReaderAt(context.Background(), br), int64(len(data)), t.TempDir())
+		require.NoError(t, err)
+
+		// reads blocked on the source are interrupted by Extract's context
+		close(br.blocked)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, e.Extract(ctx), context.DeadlineExceeded)
+		assert.ErrorIs(t, e.Verify(ctx), context.DeadlineExceeded)
+
+		// and by the reader's own context
+		ctx, cancel = context.WithCancel(context.Background())
+		cancel()
+		_, err = ContextReaderAt(ctx, br).ReadAt(make([]byte, 1), 0)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// the context of concurrent extractions is set whilst others read
+		e, err = NewExtractorFromReader(ContextReaderAt(context.Background(), bytes.NewReader(data)), int64(len(data)), t.TempDir())
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				assert.NoError(t, e.ExtractFile(ctx, "foo.go", io.Discard))
+			}()
+		}
+		wg.Wait()
+	})
+
+	// reads that can't be cancelled are made directly into the caller's buffer
+	t.Run("uncancellable", func(t *testing.T) {
+		var got []byte
+		r := readerAtFunc(func(p []byte, off int64) (int, error) {
+			got = p
+			return len(p), nil
+		})
+
+		buf := make([]byte, 4)
+		_, err := ContextReaderAt(context.Background(), r).ReadAt(buf, 0)
+		require.NoError(t, err)
+		assert.True(t, &got[0] == &buf[0])
+	})
+}
+
+type readerAtFunc func(p []byte, off int64) (int, error)
+
+func (fn readerAtFunc) ReadAt(p []byte, off int64) (int, error) {
+	return fn(p, off)
+}
+
+func TestExtractorStoredCopy(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: strings.Repeat("bar", 100000)},
+		"baz":     {mode: 0666, contents: "baz"},
+		"empty":   {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		testExtract(t, filename, testFiles)
+
+		e, err := NewExtractor(filename, t.TempDir())
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		written, _ := e.Written()
+		assert.EqualValues(t, 300003, written)
+	}, WithArchiverMethod(zip.Store))
+
+	createBad := func(t *testing.T, crc uint32) string {
+		f, err := os.Create(filepath.Join(t.TempDir(), "archive.zip"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		zw := zip.NewWriter(f)
+		hdr := &zip.FileHeader{
+			Name:               "bad",
+			Method:             zip.Store,
+			CRC32:              crc,
+			CompressedSize64:   4,
+			UncompressedSize64: 4,
+		}
+		hdr.SetMode(0600)
+		w, err := zw.CreateRaw(hdr)
+		require.NoError(t, err)
+		_, err = w.Write([]byte("data"))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		return f.Name()
+	}
+
+	// a checksum of zero is verified like any other when copied directly
+	for _, crc := range []uint32{1, 0} {
+		t.Run(fmt.Sprintf("checksum %d", crc), func(t *testing.T) {
+			if crc == 0 && runtime.GOOS != "linux" {
+				t.Skip("stored entries are only copied directly on linux")
+			}
+
+			dir := t.TempDir()
+			e, err := NewExtractor(createBad(t, crc), dir)
+			require.NoError(t, err)
+			defer e.Close()
+			assert.ErrorIs(t, e.Extract(context.Background()), zip.ErrChecksum)
+
+			// the data is complete for the CRC error handler
+			data, err := os.ReadFile(filepath.Join(dir, "bad"))
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(data))
+		})
+	}
+
+	t.Run("checksum unverified", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("stored entries are only copied directly on linux")
+		}
+
+		dir := t.TempDir()
+		e, err := NewExtractor(createBad(t, 1), dir, WithExtractorVerifyStoredChecksums(false))
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		data, err := os.ReadFile(filepath.Join(dir, "bad"))
+		require.NoError(t, err)
+		assert.Equal(t, "data", string(data))
+	})
+}
+
+func TestExtractorModeMask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission masks are not supported on windows")
+	}
+
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar"},
+		"foo/exe": {mode: 0777, contents: "exe"},
+		"baz":     {mode: 0646, contents: "baz"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	// set the exact permissions, regardless of umask
+	for name, tf := range testFiles {
+		require.NoError(t, os.Chmod(filepath.Join(dir, name), tf.mode.Perm()))
+	}
+
+	tests := map[string]struct {
+		opt   ExtractorOption
+		modes map[string]os.FileMode
+	}{
+		"mask": {
+			WithExtractorModeMask(0755),
+			map[string]os.FileMode{
+				"foo":     os.ModeDir | 0755,
+				"foo/bar": 0644,
+				"foo/exe": 0755,
+				"baz":     0644,
+			},
+		},
+		"masks": {
+			WithExtractorModeMasks(0644, 0700),
+			map[string]os.FileMode{
+				"foo":     os.ModeDir | 0700,
+				"foo/bar": 0644,
+				"foo/exe": 0644,
+				"baz":     0644,
+			},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			testCreateArchive(t, dir, files, func(filename, chroot string) {
+				out := t.TempDir()
+				e, err := NewExtractor(filename, out, tc.opt)
+				require.NoError(t, err)
+				defer e.Close()
+				require.NoError(t, e.Extract(context.Background()))
+
+				for name, mode := range tc.modes {
+					fi, err := os.Lstat(filepath.Join(out, name))
+					require.NoError(t, err)
+					assert.Equal(t, mode, fi.Mode(), name)
+				}
+			})
+		})
+	}
+}
+
+func TestExtractorDefaultModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not supported on windows")
+	}
+
+	entries := map[string]os.FileMode{
+		"dir/":         os.ModeDir,
+		"dir/file":     0,
+		"dir/setuid":   os.ModeSetuid,
+		"private/":     os.ModeDir | 0700,
+		"private/file": 0600,
+	}
+
+	filename := filepath.Join(t.TempDir(), "modes.zip")
+	f, err := os.Create(filename)
+	require.NoError(t, err)
+
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"dir/", "dir/file", "dir/setuid", "private/", "private/file"} {
+		hdr := &zip.FileHeader{Name: name, Method: zip.Store}
+		hdr.SetMode(entries[name])
+		_, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	tests := map[string]struct {
+		opts  []ExtractorOption
+		modes map[string]os.FileMode
+	}{
+		"stored": {
+			nil,
+			map[string]os.FileMode{
+				"dir":          os.ModeDir,
+				"dir/file":     0,
+				"private":      os.ModeDir | 0700,
+				"private/file": 0600,
+			},
+		},
+		"defaults": {
+			[]ExtractorOption{WithExtractorDefaultDirMode(0755), WithExtractorDefaultFileMode(0644)},
+			map[string]os.FileMode{
+				"dir":          os.ModeDir | 0755,
+				"dir/file":     0644,
+				"dir/setuid":   os.ModeSetuid | 0644,
+				"private":      os.ModeDir | 0700,
+				"private/file": 0600,
+			},
+		},
+		"defaults with mask": {
+			[]ExtractorOption{WithExtractorDefaultDirMode(0777), WithExtractorDefaultFileMode(0666), WithExtractorModeMask(0755)},
+			map[string]os.FileMode{
+				"dir":      os.ModeDir | 0755,
+				"dir/file": 0644,
+			},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			out := t.TempDir()
+			defer os.Chmod(filepath.Join(out, "dir"), 0777)
+
+			e, err := NewExtractor(filename, out, tc.opts...)
+			require.NoError(t, err)
+			defer e.Close()
+			require.NoError(t, e.Extract(context.Background()))
+
+			for name, mode := range tc.modes {
+				fi, err := os.Lstat(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, mode, fi.Mode(), name)
+			}
+		})
+	}
+}
+
+func TestExtractorApplyUmask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("umask is not supported on windows")
+	}
+
+	testFiles := map[string]testFile{
+		"foo":     {mode: os.ModeDir | 0777},
+		"foo/bar": {mode: 0666, contents: "bar"},
+		"baz":     {mode: 0777, contents: "baz"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	for name, tf := range testFiles {
+		require.NoError(t, os.Chmod(filepath.Join(dir, name), tf.mode.Perm()))
+	}
+
+	mask := umask()
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out, WithExtractorApplyUmask(true))
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		for name, tf := range testFiles {
+			fi, err := os.Lstat(filepath.Join(out, name))
+			require.NoError(t, err)
+			assert.Equal(t, tf.mode&^mask, fi.Mode(), name)
+		}
+	})
+}
+
+func TestExtractorUnicodePath(t *testing.T) {
+	unicodeExtra := func(name, unicode string) []byte {
+		buf := zipextra.NewBuffer([]byte{})
+		done := buf.WriteHeader(extraFieldUnicodePath)
+		buf.Write8(1)
+		buf.Write32(crc32.ChecksumIEEE([]byte(name)))
+		buf.WriteBytes([]byte(unicode))
+		done()
+		return buf.Bytes()
+	}
+
+	archive := filepath.Join(t.TempDir(), "unicode.zip")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+
+	zw := zip.NewWriter(f)
+	for _, entry := range []struct {
+		name, unicode, stale string
+	}{
+		// CP437 encoded "héllo"
+		{name: "h\x82llo", unicode: "héllo"},
+		// the field's CRC doesn't match the header's name, so it's ignored
+		{name: "stale", unicode: "renamed", stale: "original"},
+	} {
+		crcName := entry.name
+		if entry.stale != "" {
+			crcName = entry.stale
+		}
+
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:    entry.name,
+			NonUTF8: true,
+			Extra:   unicodeExtra(crcName, entry.unicode),
+		})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(entry.unicode))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archive, dir)
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.Extract(context.Background()))
+
+	contents, err := os.ReadFile(filepath.Join(dir, "héllo"))
+	require.NoError(t, err)
+	assert.Equal(t, "héllo", string(contents))
+
+	contents, err = os.ReadFile(filepath.Join(dir, "stale"))
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", string(contents))
+
+	// entries are matched by the name they're extracted as
+	dir = t.TempDir()
+	e, err = NewExtractor(archive, dir)
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.ExtractGlob(context.Background(), "h?llo"))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "héllo", entries[0].Name())
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, e.ExtractFile(context.Background(), "héllo", buf))
+	assert.Equal(t, "héllo", buf.String())
+	assert.ErrorIs(t, e.ExtractFile(context.Background(), "h\x82llo", io.Discard), ErrEntryNotFound)
+}
+
+func TestExtractorNormalizeNames(t *testing.T) {
+	nfd := norm.NFD.String("café")
+
+	archive := filepath.Join(t.TempDir(), "nfd.zip")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+
+	zw := zip.NewWriter(f)
+	_, err = zw.Create(nfd + "/")
+	require.NoError(t, err)
+	w, err := zw.Create(nfd + "/menu")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("menu"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	dir := t.TempDir()
+	e, err := NewExtractor(archive, dir, WithExtractorNormalizeNames(norm.NFC))
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.Extract(context.Background()))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "café", entries[0].Name())
+
+	contents, err := os.ReadFile(filepath.Join(dir, "café", "menu"))
+	require.NoError(t, err)
+	assert.Equal(t, "menu", string(contents))
+}
+
+func TestExtractorLogger(t *testing.T) {
+	symMode := os.FileMode(0777)
+	if runtime.GOOS == "windows" {
+		symMode = 0666
+	}
+
+	testFiles := map[string]testFile{
+		"top":         {mode: os.ModeDir | 0777},
+		"top/foo":     {mode: 0666, contents: "foo"},
+		"top/symlink": {mode: os.ModeSymlink | symMode, contents: "foo"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		var (
+			mu       sync.Mutex
+			messages []string
+		)
+		logger := func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			messages = append(messages, fmt.Sprintf(format, args...))
+		}
+
+		e, err := NewExtractor(filename, t.TempDir(),
+			WithExtractorLogger(logger),
+			WithExtractorStripComponents(1),
+		)
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		assert.ElementsMatch(t, []string{
+			"skipping entry ./, excluded by its name",
+			"skipping entry top/, excluded by its name",
+			"deferring symlink top/symlink",
+		}, messages)
+	})
+}
+
+func TestExtractorHardlinkTraversal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not supported on windows")
+	}
+
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600))
+
+	archive := filepath.Join(t.TempDir(), "hardlink.zip")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+
+	zw := zip.NewWriter(f)
+	for name, target := range map[string]string{
+		"link":          "evil/secret",
+		"evil/via-link": "target",
+		"target":        "",
+	} {
+		hdr := &zip.FileHeader{Name: name}
+		hdr.SetMode(0666)
+		if target != "" {
+			hdr.Extra = encodeHardlink(target)
+		}
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		if target == "" {
+			_, err = w.Write([]byte("target"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	// a symlink already in the destination points outside of it
+	dir := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "evil")))
+
+	e, err := NewExtractor(archive, dir, WithExtractorContinueOnError(true))
+	require.NoError(t, err)
+	defer e.Close()
+
+	err = e.Extract(context.Background())
+	require.ErrorIs(t, err, ErrLinkTraversal)
+
+	var merr MultiError
+	require.ErrorAs(t, err, &merr)
+	assert.Len(t, merr, 2)
+
+	_, err = os.Lstat(filepath.Join(dir, "link"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(outside, "via-link"))
+	assert.True(t, os.IsNotExist(err))
+
+	contents, err := os.ReadFile(filepath.Join(dir, "target"))
+	require.NoError(t, err)
+	assert.Equal(t, "target", string(contents))
+}
+
+func TestExtractorSymlinkChainTraversal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not supported on windows")
+	}
+
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600))
+
+	dir := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "evil")))
+
+	escape, err := filepath.Rel(dir, outside)
+	require.NoError(t, err)
+
+	archive := filepath.Join(t.TempDir(), "symlinks.zip")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+
+	zw := zip.NewWriter(f)
+	for _, link := range []struct{ name, target string }{
+		// a two-hop chain, a -> b -> outside
+		{"a", "b"},
+		{"b", escape},
+		// the second hop is a symlink already in the destination
+		{"c", "evil/secret"},
+		{"d", "sub/../e"},
+	} {
+		hdr := &zip.FileHeader{Name: link.name}
+		hdr.SetMode(os.ModeSymlink | 0777)
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(link.target))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	e, err := NewExtractor(archive, dir, WithExtractorContinueOnError(true))
+	require.NoError(t, err)
+	defer e.Close()
+
+	err = e.Extract(context.Background())
+	require.ErrorIs(t, err, ErrLinkTraversal)
+
+	var merr MultiError
+	require.ErrorAs(t, err, &merr)
+	require.Len(t, merr, 2)
+	assert.Equal(t, "b", merr[0].(*EntryError).Name)
+	assert.Equal(t, "c", merr[1].(*EntryError).Name)
+
+	for name, exists := range map[string]bool{"a": true, "b": false, "c": false, "d": true} {
+		_, err := os.Lstat(filepath.Join(dir, name))
+		assert.Equal(t, exists, err == nil, name)
+	}
+}
+
+func TestExtractorSymlinkDotDotTraversal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not supported on windows")
+	}
+
+	// b -> c/.. is within the chroot lexically, but c -> . makes it resolve to
+	// the chroot's parent. Whether c is created before or after b, b must be
+	// rejected.
+	for name, links := range map[string][][2]string{
+		"link first":  {{"c", "."}, {"b", "c/.."}},
+		"link second": {{"b", "c/.."}, {"c", "."}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "symlinks.zip")
+			f, err := os.Create(archive)
+			require.NoError(t, err)
+
+			zw := zip.NewWriter(f)
+			for _, link := range links {
+				hdr := &zip.FileHeader{Name: link[0]}
+				hdr.SetMode(os.ModeSymlink | 0777)
+				w, err := zw.CreateHeader(hdr)
+				require.NoError(t, err)
+				_, err = w.Write([]byte(link[1]))
+				require.NoError(t, err)
+			}
+			require.NoError(t, zw.Close())
+			require.NoError(t, f.Close())
+
+			dir := t.TempDir()
+			e, err := NewExtractor(archive, dir, WithExtractorContinueOnError(true))
+			require.NoError(t, err)
+			defer e.Close()
+
+			err = e.Extract(context.Background())
+			require.ErrorIs(t, err, ErrLinkTraversal)
+
+			var merr MultiError
+			require.ErrorAs(t, err, &merr)
+			require.Len(t, merr, 1)
+			assert.Equal(t, "b", merr[0].(*EntryError).Name)
+
+			_, err = os.Lstat(filepath.Join(dir, "b"))
+			assert.True(t, os.IsNotExist(err))
+			_, err = os.Lstat(filepath.Join(dir, "c"))
+			assert.NoError(t, err)
+
+			_, entries := e.Written()
+			assert.EqualValues(t, 1, entries)
+		})
+	}
+}
+
+func TestExtractorRestoreFileFlags(t *testing.T) {
+	fields, err := zipextra.Parse(encodeFileFlags(0x1234))
+	require.NoError(t, err)
+	flags, ok := storedFileFlags(fields)
+	require.True(t, ok)
+	assert.Equal(t, uint32(0x1234), flags)
+
+	testFiles := map[string]testFile{
+		"nodump": {mode: 0666, contents: "nodump"},
+		"plain":  {mode: 0666, contents: "plain"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	// UF_NODUMP has the same value on macOS and the BSDs, and can be set by
+	// the file's owner
+	const nodump = 0x1
+	require.NoError(t, setFileFlags(filepath.Join(dir, "nodump"), 0, nodump))
+	fi, err := os.Lstat(filepath.Join(dir, "nodump"))
+	require.NoError(t, err)
+	if _, ok := fileFlags(fi); !ok {
+		t.Skip("file flags are not supported on this platform")
+	}
+	files[filepath.Join(dir, "nodump")] = fi
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out, WithExtractorRestoreFileFlags(true))
+		require.NoError(t, err)
+		defer e.Close()
+		require.NoError(t, e.Extract(context.Background()))
+
+		fi, err := os.Lstat(filepath.Join(out, "nodump"))
+		require.NoError(t, err)
+		flags, ok := fileFlags(fi)
+		require.True(t, ok)
+		assert.Equal(t, uint32(nodump), flags&nodump)
+
+		fi, err = os.Lstat(filepath.Join(out, "plain"))
+		require.NoError(t, err)
+		_, ok = fileFlags(fi)
+		assert.False(t, ok)
+	}, WithArchiverStoreFileFlags(true))
+}
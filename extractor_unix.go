@@ -10,6 +10,41 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// unixMode translates the permission and special bits of an os.FileMode to
+// their unix equivalent.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unix.S_ISVTX
+	}
+	return m
+}
+
+// umask returns the process's file mode creation mask. The mask can only be
+// read by setting it, so it's briefly changed and then restored.
+func umask() os.FileMode {
+	mask := unix.Umask(0)
+	unix.Umask(mask)
+	return os.FileMode(mask) & os.ModePerm
+}
+
+// syncDir commits a directory's entries to stable storage.
+func syncDir(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
 func lchmod(name string, mode os.FileMode) error {
 	var flags int
 	if runtime.GOOS == "linux" {
@@ -20,7 +55,7 @@ func lchmod(name string, mode os.FileMode) error {
 		flags = unix.AT_SYMLINK_NOFOLLOW
 	}
 
-	err := unix.Fchmodat(unix.AT_FDCWD, name, uint32(mode), flags)
+	err := unix.Fchmodat(unix.AT_FDCWD, name, unixMode(mode), flags)
 	if err != nil {
 		return &os.PathError{Op: "lchmod", Path: name, Err: err}
 	}
@@ -28,12 +63,43 @@ func lchmod(name string, mode os.FileMode) error {
 	return nil
 }
 
+// mkspecial creates a named pipe, socket or device file.
+func mkspecial(path string, mode os.FileMode, major, minor uint32) error {
+	perm := uint32(mode.Perm())
+
+	var dev uint64
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		perm |= unix.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		perm |= unix.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		perm |= unix.S_IFCHR
+		dev = unix.Mkdev(major, minor)
+	case mode&os.ModeDevice != 0:
+		perm |= unix.S_IFBLK
+		dev = unix.Mkdev(major, minor)
+	}
+
+	return mknod(path, perm, dev)
+}
+
 func lchtimes(name string, mode os.FileMode, atime, mtime time.Time) error {
-	at := unix.NsecToTimeval(atime.UnixNano())
-	mt := unix.NsecToTimeval(mtime.UnixNano())
-	tv := [2]unix.Timeval{at, mt}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
 
-	err := unix.Lutimes(name, tv[:])
+	// utimensat sets times with nanosecond precision, but isn't available on
+	// older systems, where lutimes only has microsecond precision
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+	if err == unix.ENOSYS {
+		tv := []unix.Timeval{
+			unix.NsecToTimeval(atime.UnixNano()),
+			unix.NsecToTimeval(mtime.UnixNano()),
+		}
+		err = unix.Lutimes(name, tv)
+	}
 	if err != nil {
 		return &os.PathError{Op: "lchtimes", Path: name, Err: err}
 	}
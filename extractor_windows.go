@@ -4,9 +4,41 @@ package fastzip
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+// maxDirPath is the legacy path length limit for creating directories, which
+// is MAX_PATH (260) less room for an 8.3 filename. Files use the same limit,
+// for simplicity.
+const maxDirPath = 248
+
+// longPath returns path with the extended-length prefix, if it's an absolute
+// path exceeding the legacy length limit. The os package does this itself, so
+// it's only needed for paths passed directly to syscalls. Prefixed paths aren't
+// normalized by Windows, so path must already be clean, and shouldn't be used
+// for comparisons against the chroot.
+func longPath(path string) string {
+	if len(path) < maxDirPath || !filepath.IsAbs(path) || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+
+	if strings.HasPrefix(path, `\\`) {
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
+
+func umask() os.FileMode {
+	return 0
+}
+
+// syncDir is a no-op, as directories cannot be synced on Windows.
+func syncDir(path string) error {
+	return nil
+}
+
 func lchmod(name string, mode os.FileMode) error {
 	if mode&os.ModeSymlink != 0 {
 		return nil
@@ -15,6 +47,10 @@ func lchmod(name string, mode os.FileMode) error {
 	return os.Chmod(name, mode)
 }
 
+func mkspecial(path string, mode os.FileMode, major, minor uint32) error {
+	return nil
+}
+
 func lchtimes(name string, mode os.FileMode, atime, mtime time.Time) error {
 	if mode&os.ModeSymlink != 0 {
 		return nil
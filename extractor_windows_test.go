@@ -0,0 +1,83 @@
+//go:build windows
+// +build windows
+
+package fastzip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLongPath(t *testing.T) {
+	long := strings.Repeat(`\segment`, 40)
+
+	tests := map[string]string{
+		`C:\short`:                    `C:\short`,
+		`relative` + long:             `relative` + long,
+		`C:` + long:                   `\\?\C:` + long,
+		`\\?\C:` + long:               `\\?\C:` + long,
+		`\\server\share` + long:       `\\?\UNC\server\share` + long,
+		`\\?\UNC\server\share` + long: `\\?\UNC\server\share` + long,
+	}
+
+	for path, expected := range tests {
+		assert.Equal(t, expected, longPath(path))
+	}
+}
+
+func TestExtractorLongPaths(t *testing.T) {
+	deep := strings.Repeat("directory/", 30)
+	testFiles := map[string]testFile{
+		"short": {mode: 0666, contents: "short"},
+	}
+	for dir := strings.TrimSuffix(deep, "/"); dir != "."; dir = filepath.ToSlash(filepath.Dir(dir)) {
+		testFiles[dir] = testFile{mode: os.ModeDir | 0777}
+	}
+	testFiles[deep+"long"] = testFile{mode: 0666, contents: "long"}
+
+	_, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	// the hidden attribute and creation time are restored with syscalls that
+	// the os package doesn't add the extended-length prefix for
+	pathp, err := syscall.UTF16PtrFromString(longPath(filepath.Join(dir, filepath.FromSlash(deep), "long")))
+	require.NoError(t, err)
+	require.NoError(t, syscall.SetFileAttributes(pathp, syscall.FILE_ATTRIBUTE_HIDDEN))
+
+	// re-stat the files, so the attributes are up to date
+	files := make(map[string]os.FileInfo)
+	err = filepath.Walk(dir, func(pathname string, fi os.FileInfo, err error) error {
+		files[pathname] = fi
+		return err
+	})
+	require.NoError(t, err)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		out := t.TempDir()
+		e, err := NewExtractor(filename, out, WithExtractorRestoreCreationTime(true))
+		require.NoError(t, err)
+		defer e.Close()
+
+		require.NoError(t, e.Extract(context.Background()))
+
+		path := filepath.Join(out, filepath.FromSlash(deep), "long")
+		require.Greater(t, len(path), 260)
+
+		contents, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "long", string(contents))
+
+		pathp, err := syscall.UTF16PtrFromString(longPath(path))
+		require.NoError(t, err)
+		attrs, err := syscall.GetFileAttributes(pathp)
+		require.NoError(t, err)
+		assert.NotZero(t, attrs&syscall.FILE_ATTRIBUTE_HIDDEN)
+	})
+}
@@ -0,0 +1,28 @@
+package fastzip
+
+import (
+	"github.com/saracen/zipextra"
+)
+
+// extraFieldFileFlags is the extra field identifier used for BSD file flags,
+// as set by chflags. The field holds the flags as a uint32.
+const extraFieldFileFlags uint16 = 0x6c66
+
+func encodeFileFlags(flags uint32) []byte {
+	buf := zipextra.NewBuffer([]byte{})
+	defer buf.WriteHeader(extraFieldFileFlags)()
+
+	buf.Write32(flags)
+
+	return buf.Bytes()
+}
+
+// storedFileFlags returns the file flags stored in an extra field.
+func storedFileFlags(fields map[uint16]zipextra.ExtraField) (uint32, bool) {
+	field, ok := fields[extraFieldFileFlags]
+	if !ok || len(field) != 4 {
+		return 0, false
+	}
+
+	return zipextra.NewBuffer(field).Read32(), true
+}
@@ -0,0 +1,34 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package fastzip
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func fileFlags(fi os.FileInfo) (uint32, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat.Flags == 0 {
+		return 0, false
+	}
+
+	return uint32(stat.Flags), true
+}
+
+// setFileFlags sets a file's flags. Symlinks are skipped, as chflags follows
+// them.
+func setFileFlags(path string, mode os.FileMode, flags uint32) error {
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	if err := unix.Chflags(path, int(flags)); err != nil {
+		return &os.PathError{Op: "chflags", Path: path, Err: err}
+	}
+
+	return nil
+}
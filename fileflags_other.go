@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package fastzip
+
+import "os"
+
+// fileFlags is unsupported on platforms without chflags, such as Linux and
+// Windows.
+func fileFlags(fi os.FileInfo) (uint32, bool) {
+	return 0, false
+}
+
+func setFileFlags(path string, mode os.FileMode, flags uint32) error {
+	return nil
+}
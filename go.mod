@@ -3,11 +3,14 @@ module github.com/saracen/fastzip
 go 1.18
 
 require (
+	github.com/dsnet/compress v0.0.1
 	github.com/klauspost/compress v1.16.5
 	github.com/saracen/zipextra v0.0.0-20220303013732-0187cb0159ea
 	github.com/stretchr/testify v1.8.3
+	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/sync v0.2.0
 	golang.org/x/sys v0.8.0
+	golang.org/x/text v0.13.0
 )
 
 require (
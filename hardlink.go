@@ -0,0 +1,42 @@
+package fastzip
+
+import (
+	"github.com/saracen/zipextra"
+)
+
+// extraFieldHardlink is the extra field identifier used for hard links. The
+// field holds the name of the entry being linked to.
+const extraFieldHardlink uint16 = 0x6c68
+
+// fileID uniquely identifies a file on a system.
+type fileID struct {
+	dev, ino uint64
+}
+
+func encodeHardlink(target string) []byte {
+	buf := zipextra.NewBuffer([]byte{})
+	defer buf.WriteHeader(extraFieldHardlink)()
+
+	buf.WriteBytes([]byte(target))
+
+	return buf.Bytes()
+}
+
+// hardlinkTarget returns the name of the entry a hard link entry links to.
+func hardlinkTarget(extra []byte) (string, bool) {
+	if len(extra) == 0 {
+		return "", false
+	}
+
+	fields, err := zipextra.Parse(extra)
+	if err != nil {
+		return "", false
+	}
+
+	target, ok := fields[extraFieldHardlink]
+	if !ok || len(target) == 0 {
+		return "", false
+	}
+
+	return string(target), true
+}
@@ -0,0 +1,429 @@
+// Package deflate64 implements a decompressor for Deflate64, also known as
+// Enhanced Deflate, as used by zip method 9.
+//
+// Deflate64 is Deflate with a 64 kibibyte window. Length code 285 has 16 extra
+// bits, rather than representing a length of 258, and distance codes 30 and
+// 31 are used, for distances up to 65536.
+package deflate64
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// ErrCorrupt is returned when the compressed data is invalid.
+var ErrCorrupt = errors.New("deflate64: corrupt input")
+
+const (
+	maxBits    = 15
+	maxLitLen  = 288
+	maxDist    = 32
+	windowSize = 1 << 16
+
+	// the ring holds the window of history, as well as the output of a step
+	// that hasn't been read yet
+	ringSize = 1 << 18
+	ringMask = ringSize - 1
+
+	// stepSize is the amount of output a step produces before returning, which
+	// can be exceeded by a single match
+	stepSize = 1 << 15
+)
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 3}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 16}
+	distBase    = [32]uint32{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577, 32769, 49153}
+	distExtra   = [32]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13, 14, 14}
+
+	// codeLengthOrder is the order code length code lengths are stored in
+	codeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	fixedLitLen, fixedDist huffman
+)
+
+func init() {
+	var lengths [maxLitLen]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLitLen.init(lengths[:])
+
+	var dists [maxDist]uint8
+	for i := range dists {
+		dists[i] = 5
+	}
+	fixedDist.init(dists[:])
+}
+
+// huffman is a canonical Huffman code, decoded a bit at a time.
+type huffman struct {
+	count  [maxBits + 1]uint16
+	symbol [maxLitLen]uint16
+}
+
+// init builds the code from the code lengths of each symbol. Incomplete codes
+// are permitted, with the unused codes being rejected when decoded.
+func (h *huffman) init(lengths []uint8) error {
+	h.count = [maxBits + 1]uint16{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+
+	left := 1
+	for l := 1; l <= maxBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return ErrCorrupt
+		}
+	}
+
+	var offs [maxBits + 1]uint16
+	for l := 1; l < maxBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+
+	return nil
+}
+
+// Reader decompresses a Deflate64 stream.
+type Reader struct {
+	r      io.ByteReader
+	bitbuf uint32
+	bitcnt uint
+
+	ring       [ringSize]byte
+	rpos, wpos int64
+
+	final   bool
+	inBlock bool
+	stored  int
+	litLen  *huffman
+	dist    *huffman
+	dynamic [2]huffman
+
+	err error
+}
+
+// NewReader returns a Reader that decompresses the data read from r.
+func NewReader(r io.Reader) *Reader {
+	z := &Reader{}
+	z.Reset(r)
+	return z
+}
+
+// Reset discards the Reader's state, so that it decompresses the data read
+// from r.
+func (z *Reader) Reset(r io.Reader) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	*z = Reader{r: br, ring: z.ring}
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for {
+		if z.rpos < z.wpos {
+			start := int(z.rpos & ringMask)
+			end := start + int(z.wpos-z.rpos)
+			if end > ringSize {
+				end = ringSize
+			}
+			n := copy(p, z.ring[start:end])
+			z.rpos += int64(n)
+			return n, nil
+		}
+
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.step()
+	}
+}
+
+// Close closes the Reader. It doesn't close the underlying reader.
+func (z *Reader) Close() error {
+	if z.err == io.EOF {
+		return nil
+	}
+	return z.err
+}
+
+// step decompresses until at least stepSize bytes have been output, or the
+// end of the stream is reached.
+func (z *Reader) step() error {
+	start := z.wpos
+	for z.wpos-start < stepSize {
+		if !z.inBlock {
+			if z.final {
+				return io.EOF
+			}
+			if err := z.blockHeader(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if z.litLen == nil {
+			if err := z.copyStored(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		sym, err := z.decode(z.litLen)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case sym < 256:
+			z.ring[z.wpos&ringMask] = byte(sym)
+			z.wpos++
+
+		case sym == 256:
+			z.inBlock = false
+
+		default:
+			sym -= 257
+			if sym >= uint16(len(lengthBase)) {
+				return ErrCorrupt
+			}
+			extra, err := z.bits(uint(lengthExtra[sym]))
+			if err != nil {
+				return err
+			}
+			length := int64(lengthBase[sym]) + int64(extra)
+
+			sym, err = z.decode(z.dist)
+			if err != nil {
+				return err
+			}
+			if sym >= maxDist {
+				return ErrCorrupt
+			}
+			extra, err = z.bits(uint(distExtra[sym]))
+			if err != nil {
+				return err
+			}
+			dist := int64(distBase[sym]) + int64(extra)
+			if dist > z.wpos || dist > windowSize {
+				return ErrCorrupt
+			}
+
+			for i := int64(0); i < length; i++ {
+				z.ring[z.wpos&ringMask] = z.ring[(z.wpos-dist)&ringMask]
+				z.wpos++
+			}
+		}
+	}
+
+	return nil
+}
+
+// blockHeader reads a block's header, and its code lengths for blocks with
+// dynamic Huffman codes.
+func (z *Reader) blockHeader() error {
+	hdr, err := z.bits(3)
+	if err != nil {
+		return err
+	}
+	z.final = hdr&1 == 1
+
+	switch hdr >> 1 {
+	case 0:
+		// stored blocks start on a byte boundary
+		z.bitbuf, z.bitcnt = 0, 0
+
+		var b [4]byte
+		for i := range b {
+			if b[i], err = z.readByte(); err != nil {
+				return err
+			}
+		}
+		length := uint16(b[0]) | uint16(b[1])<<8
+		if length != ^(uint16(b[2]) | uint16(b[3])<<8) {
+			return ErrCorrupt
+		}
+		z.stored = int(length)
+		z.litLen, z.dist = nil, nil
+
+	case 1:
+		z.litLen, z.dist = &fixedLitLen, &fixedDist
+
+	case 2:
+		if err := z.dynamicCodes(); err != nil {
+			return err
+		}
+		z.litLen, z.dist = &z.dynamic[0], &z.dynamic[1]
+
+	default:
+		return ErrCorrupt
+	}
+
+	z.inBlock = true
+	return nil
+}
+
+// dynamicCodes reads the code lengths of a block with dynamic Huffman codes.
+func (z *Reader) dynamicCodes() error {
+	v, err := z.bits(14)
+	if err != nil {
+		return err
+	}
+	nlen := int(v&0x1f) + 257
+	ndist := int(v>>5&0x1f) + 1
+	ncode := int(v>>10) + 4
+	if nlen > 286 {
+		return ErrCorrupt
+	}
+
+	var lengths [maxLitLen + maxDist]uint8
+	for i := 0; i < ncode; i++ {
+		l, err := z.bits(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeLengthOrder[i]] = uint8(l)
+	}
+
+	var code huffman
+	if err := code.init(lengths[:19]); err != nil {
+		return err
+	}
+
+	lengths = [maxLitLen + maxDist]uint8{}
+	for i := 0; i < nlen+ndist; {
+		sym, err := z.decode(&code)
+		if err != nil {
+			return err
+		}
+
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var prev uint8
+		var repeat uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				return ErrCorrupt
+			}
+			prev = lengths[i-1]
+			repeat, err = z.bits(2)
+			repeat += 3
+		case 17:
+			repeat, err = z.bits(3)
+			repeat += 3
+		default:
+			repeat, err = z.bits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(repeat) > nlen+ndist {
+			return ErrCorrupt
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = prev
+			i++
+		}
+	}
+
+	// the end of block code is required
+	if lengths[256] == 0 {
+		return ErrCorrupt
+	}
+
+	if err := z.dynamic[0].init(lengths[:nlen]); err != nil {
+		return err
+	}
+	return z.dynamic[1].init(lengths[nlen : nlen+ndist])
+}
+
+// copyStored copies the data of a stored block.
+func (z *Reader) copyStored() error {
+	for ; z.stored > 0; z.stored-- {
+		b, err := z.readByte()
+		if err != nil {
+			return err
+		}
+		z.ring[z.wpos&ringMask] = b
+		z.wpos++
+	}
+	z.inBlock = false
+
+	return nil
+}
+
+// decode decodes a symbol, a bit at a time.
+func (z *Reader) decode(h *huffman) (uint16, error) {
+	var code, first, index int
+	for l := 1; l <= maxBits; l++ {
+		bit, err := z.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(bit)
+
+		count := int(h.count[l])
+		if code-first < count {
+			return h.symbol[index+code-first], nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+
+	return 0, ErrCorrupt
+}
+
+// bits reads n bits, least significant bit first.
+func (z *Reader) bits(n uint) (uint32, error) {
+	for z.bitcnt < n {
+		b, err := z.readByte()
+		if err != nil {
+			return 0, err
+		}
+		z.bitbuf |= uint32(b) << z.bitcnt
+		z.bitcnt += 8
+	}
+
+	v := z.bitbuf & (1<<n - 1)
+	z.bitbuf >>= n
+	z.bitcnt -= n
+
+	return v, nil
+}
+
+func (z *Reader) readByte() (byte, error) {
+	b, err := z.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
@@ -0,0 +1,183 @@
+package deflate64
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bitWriter writes a fixed Huffman code stream, for producing the matches that
+// only Deflate64 supports.
+type bitWriter struct {
+	buf    bytes.Buffer
+	bitbuf uint32
+	bitcnt uint
+}
+
+func (w *bitWriter) bits(v uint32, n uint) {
+	w.bitbuf |= v << w.bitcnt
+	w.bitcnt += n
+	for w.bitcnt >= 8 {
+		w.buf.WriteByte(byte(w.bitbuf))
+		w.bitbuf >>= 8
+		w.bitcnt -= 8
+	}
+}
+
+// code writes a Huffman code, most significant bit first.
+func (w *bitWriter) code(v uint32, n uint) {
+	for i := n; i > 0; i-- {
+		w.bits(v>>(i-1)&1, 1)
+	}
+}
+
+func (w *bitWriter) align() {
+	if w.bitcnt > 0 {
+		w.bits(0, 8-w.bitcnt)
+	}
+}
+
+func (w *bitWriter) stored(data []byte, final bool) {
+	w.bits(boolBit(final), 1)
+	w.bits(0, 2)
+	w.align()
+	w.bits(uint32(len(data)), 16)
+	w.bits(uint32(^uint16(len(data))), 16)
+	w.buf.Write(data)
+}
+
+func (w *bitWriter) literal(sym uint32) {
+	switch {
+	case sym < 144:
+		w.code(0x30+sym, 8)
+	case sym < 256:
+		w.code(0x190+sym-144, 9)
+	case sym < 280:
+		w.code(sym-256, 7)
+	default:
+		w.code(0xc0+sym-280, 8)
+	}
+}
+
+func (w *bitWriter) match(lengthSym, lengthBits, distSym, distBits uint32) {
+	w.literal(lengthSym)
+	w.bits(lengthBits, uint(lengthExtra[lengthSym-257]))
+	w.code(distSym, 5)
+	w.bits(distBits, uint(distExtra[distSym]))
+}
+
+func (w *bitWriter) bytes() []byte {
+	w.align()
+	return w.buf.Bytes()
+}
+
+func boolBit(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func copyMatch(out []byte, length, dist int) []byte {
+	for i := 0; i < length; i++ {
+		out = append(out, out[len(out)-dist])
+	}
+	return out
+}
+
+func TestReaderDeflate(t *testing.T) {
+	// a small alphabet produces plenty of matches, but none as long as 258,
+	// which is encoded differently by Deflate64
+	rnd := rand.New(rand.NewSource(0))
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = "abcd"[rnd.Intn(4)]
+	}
+
+	for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.HuffmanOnly} {
+		t.Run(fmt.Sprintf("level %d", level), func(t *testing.T) {
+			var buf bytes.Buffer
+			fw, err := flate.NewWriter(&buf, level)
+			require.NoError(t, err)
+			_, err = fw.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, fw.Close())
+
+			out, err := io.ReadAll(NewReader(&buf))
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(data, out))
+		})
+	}
+}
+
+func TestReaderDeflate64(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	history := make([]byte, 65535)
+	rnd.Read(history)
+
+	var w bitWriter
+	w.stored(history, false)
+	w.bits(1, 1)
+	w.bits(1, 2)
+
+	expected := append([]byte{}, history...)
+
+	// length code 285 has 16 extra bits, distance code 30 has 14 extra bits
+	w.match(285, 1000, 30, 7231)
+	expected = copyMatch(expected, 1003, 40000)
+
+	// length code 285 with no extra bits is a length of 3, distance code 31
+	// reaches the start of the 64KiB window
+	w.match(285, 0, 31, 16383)
+	expected = copyMatch(expected, 3, 65536)
+
+	// the longest match possible
+	w.match(285, 65535, 0, 0)
+	expected = copyMatch(expected, 65538, 1)
+
+	w.literal('!')
+	expected = append(expected, '!')
+	w.literal(256)
+
+	z := NewReader(bytes.NewReader(w.bytes()))
+	out, err := io.ReadAll(z)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, out))
+	assert.NoError(t, z.Close())
+
+	// resetting reuses the reader
+	z.Reset(bytes.NewReader(w.bytes()))
+	out, err = io.ReadAll(z)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, out))
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	var w bitWriter
+	w.bits(1, 1)
+	w.bits(1, 2)
+	w.literal('a')
+	w.match(257, 0, 1, 0)
+	w.literal(256)
+
+	_, err := io.ReadAll(NewReader(bytes.NewReader(w.bytes())))
+	assert.Equal(t, ErrCorrupt, err)
+
+	// reserved block type
+	_, err = io.ReadAll(NewReader(bytes.NewReader([]byte{0x07})))
+	assert.Equal(t, ErrCorrupt, err)
+
+	// stored block length mismatch
+	_, err = io.ReadAll(NewReader(bytes.NewReader([]byte{0x01, 0x01, 0x00, 0x00, 0x00})))
+	assert.Equal(t, ErrCorrupt, err)
+
+	// truncated
+	_, err = io.ReadAll(NewReader(bytes.NewReader([]byte{0x01, 0x05, 0x00, 0xfa, 0xff, 'a'})))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
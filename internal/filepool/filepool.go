@@ -1,6 +1,8 @@
 package filepool
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
@@ -9,11 +11,17 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 var ErrPoolSizeLessThanZero = errors.New("pool size must be greater than zero")
 
-const defaultBufferSize = 2 * 1024 * 1024
+var ErrSharedFilesLessThanZero = errors.New("shared files must be greater than zero")
+
+// DefaultBufferSize is the buffer size of each file when a negative size is
+// provided.
+const DefaultBufferSize = 2 * 1024 * 1024
 
 type filePoolCloseError []error
 
@@ -43,32 +51,103 @@ func (e filePoolCloseError) Unwrap() error {
 
 // FilePool represents a pool of files that can be used as buffers.
 type FilePool struct {
+	// This 2 fields are accessed via atomic operations
+	// They are at the start of the struct so they are properly 8 byte aligned
+	spillCount, spillBytes int64
+
 	files   []*File
+	shared  []*sharedFile
 	limiter chan int
+	prefix  string
 }
 
-// New returns a new FilePool.
+// New returns a new FilePool. Files are created in dir with a name prefix
+// unique to the pool, so that pools can share a directory.
 func New(dir string, poolSize int, bufferSize int) (*FilePool, error) {
+	return newFilePool(dir, poolSize, bufferSize, false)
+}
+
+// NewMemory returns a new FilePool where data exceeding the buffer size is
+// held in memory, rather than written to a file.
+func NewMemory(poolSize int, bufferSize int) (*FilePool, error) {
+	return newFilePool("", poolSize, bufferSize, true)
+}
+
+// NewShared returns a new FilePool where data exceeding the buffer size is
+// written to at most n files, shared by the pool's files, rather than a file
+// each. Each shared file is partitioned into chunks that are allocated to the
+// pool's files as they need them, and released for reuse when they're put
+// back into the pool. This limits the number of open files, but writes to a
+// shared file are somewhat serialized, and a shared file isn't truncated
+// until the pool is closed.
+func NewShared(dir string, poolSize int, bufferSize int, n int) (*FilePool, error) {
+	if n <= 0 {
+		return nil, ErrSharedFilesLessThanZero
+	}
+
+	fp, err := newFilePool(dir, poolSize, bufferSize, false)
+	if err != nil {
+		return nil, err
+	}
+	if n >= poolSize {
+		return fp, nil
+	}
+
+	fp.shared = make([]*sharedFile, n)
+	for i := range fp.shared {
+		fp.shared[i] = &sharedFile{name: filepath.Join(dir, fmt.Sprintf("%s%02d", fp.prefix, i))}
+	}
+	for i, f := range fp.files {
+		f.shared = fp.shared[i%n]
+	}
+
+	return fp, nil
+}
+
+func newFilePool(dir string, poolSize int, bufferSize int, mem bool) (*FilePool, error) {
 	if poolSize <= 0 {
 		return nil, ErrPoolSizeLessThanZero
 	}
 	fp := &FilePool{}
+	if !mem {
+		prefix, err := newPrefix()
+		if err != nil {
+			return nil, err
+		}
+		fp.prefix = prefix
+	}
 
 	fp.files = make([]*File, poolSize)
 	fp.limiter = make(chan int, poolSize)
 
 	if bufferSize < 0 {
-		bufferSize = defaultBufferSize
+		bufferSize = DefaultBufferSize
 	}
 
 	for i := range fp.files {
-		fp.files[i] = newFile(dir, i, bufferSize)
+		fp.files[i] = newFile(dir, fp.prefix, i, bufferSize, mem)
+		fp.files[i].fp = fp
 		fp.limiter <- i
 	}
 
 	return fp, nil
 }
 
+// newPrefix returns a file name prefix incorporating the process ID and a
+// random token.
+func newPrefix() (string, error) {
+	var token [4]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("fastzip_%d_%s_", os.Getpid(), hex.EncodeToString(token[:])), nil
+}
+
+// Prefix returns the name prefix of the pool's files.
+func (fp *FilePool) Prefix() string {
+	return fp.prefix
+}
+
 // Get gets a file from the pool.
 func (fp *FilePool) Get() *File {
 	idx := <-fp.limiter
@@ -81,23 +160,44 @@ func (fp *FilePool) Put(f *File) {
 	fp.limiter <- f.idx
 }
 
+// SpillCount returns how many times a file's data exceeded its buffer, with
+// the additional data written to disk, or held in memory for an in-memory
+// pool.
+func (fp *FilePool) SpillCount() int64 {
+	return atomic.LoadInt64(&fp.spillCount)
+}
+
+// SpillBytes returns the total number of bytes that exceeded file buffers.
+func (fp *FilePool) SpillBytes() int64 {
+	return atomic.LoadInt64(&fp.spillBytes)
+}
+
 // Close closes and removes all files in the pool.
 func (fp *FilePool) Close() error {
-	var err filePoolCloseError
+	var files []*os.File
 	for _, f := range fp.files {
-		if f == nil || f.f == nil {
-			continue
+		if f != nil && f.f != nil {
+			files = append(files, f.f)
+		}
+	}
+	for _, s := range fp.shared {
+		if s.f != nil {
+			files = append(files, s.f)
 		}
+	}
 
-		if cerr := f.f.Close(); cerr != nil {
+	var err filePoolCloseError
+	for _, f := range files {
+		if cerr := f.Close(); cerr != nil {
 			err = append(err, cerr)
 		}
-		if rerr := os.Remove(f.f.Name()); rerr != nil && !os.IsNotExist(rerr) {
+		if rerr := os.Remove(f.Name()); rerr != nil && !os.IsNotExist(rerr) {
 			err = append(err, rerr)
 		}
 	}
 
 	fp.files = nil
+	fp.shared = nil
 	if err.Len() > 0 {
 		return err
 	}
@@ -106,23 +206,35 @@ func (fp *FilePool) Close() error {
 
 // File is a file backed buffer.
 type File struct {
-	dir string
-	idx int
-	w   int64
-	r   int64
-	crc hash.Hash32
+	dir    string
+	prefix string
+	idx    int
+	w      int64
+	r      int64
+	crc    hash.Hash32
 
 	f    *os.File
 	buf  []byte
 	size int
+	mem  bool
+
+	fp      *FilePool
+	spilled bool
+
+	// shared is the file shared with other files in the pool, if any, with
+	// chunks holding the offsets of the chunks allocated to this file
+	shared *sharedFile
+	chunks []int64
 }
 
-func newFile(dir string, idx, size int) *File {
+func newFile(dir, prefix string, idx, size int, mem bool) *File {
 	return &File{
-		dir:  dir,
-		idx:  idx,
-		size: size,
-		crc:  crc32.NewIEEE(),
+		dir:    dir,
+		prefix: prefix,
+		idx:    idx,
+		size:   size,
+		mem:    mem,
+		crc:    crc32.NewIEEE(),
 	}
 }
 
@@ -137,17 +249,19 @@ func (f *File) Write(p []byte) (n int, err error) {
 		f.w += int64(n)
 	}
 
-	if len(p) > 0 {
-		if f.f == nil {
-			f.f, err = os.Create(filepath.Join(f.dir, fmt.Sprintf("fastzip_%02d", f.idx)))
-			if err != nil {
-				return n, err
-			}
-		}
+	// in memory mode, the buffer grows to hold the additional data
+	if len(p) > 0 && f.mem {
+		f.buf = append(f.buf, p...)
+		f.w += int64(len(p))
+		f.spill(len(p))
+		return n + len(p), nil
+	}
 
+	if len(p) > 0 {
 		bn := n
-		n, err = f.f.WriteAt(p, f.w-int64(len(f.buf)))
+		n, err = f.writeAt(p, f.w-int64(len(f.buf)))
 		f.w += int64(n)
+		f.spill(n)
 		n += bn
 		if err != nil {
 			return n, err
@@ -157,6 +271,48 @@ func (f *File) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+// writeAt writes data exceeding the buffer to the file's own file, or to its
+// chunks of the shared file.
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	if f.shared != nil {
+		return f.shared.rw(f, p, off, true)
+	}
+
+	if f.f == nil {
+		// O_EXCL ensures another pool's file is never clobbered
+		name := filepath.Join(f.dir, fmt.Sprintf("%s%02d", f.prefix, f.idx))
+		var err error
+		f.f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return f.f.WriteAt(p, off)
+}
+
+// readAt reads data exceeding the buffer from the file's own file, or from
+// its chunks of the shared file.
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if f.shared != nil {
+		return f.shared.rw(f, p, off, false)
+	}
+
+	return f.f.ReadAt(p, off)
+}
+
+// spill records n bytes exceeding the buffer.
+func (f *File) spill(n int) {
+	if f.fp == nil || n == 0 {
+		return
+	}
+	if !f.spilled {
+		f.spilled = true
+		atomic.AddInt64(&f.fp.spillCount, 1)
+	}
+	atomic.AddInt64(&f.fp.spillBytes, int64(n))
+}
+
 func (f *File) Read(p []byte) (n int, err error) {
 	remaining := f.w - f.r
 	if remaining <= 0 {
@@ -174,7 +330,7 @@ func (f *File) Read(p []byte) (n int, err error) {
 
 	if len(p) > 0 && f.r >= int64(len(f.buf)) {
 		bn := n
-		n, err = f.f.ReadAt(p, f.r-int64(len(f.buf)))
+		n, err = f.readAt(p, f.r-int64(len(f.buf)))
 		f.r += int64(n)
 		n += bn
 	}
@@ -182,6 +338,11 @@ func (f *File) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// Rewind resets reading to the beginning of the file's data.
+func (f *File) Rewind() {
+	f.r = 0
+}
+
 func (f *File) Written() uint64 {
 	return uint64(f.w)
 }
@@ -197,8 +358,105 @@ func (f *File) Checksum() uint32 {
 func (f *File) reset() {
 	f.w = 0
 	f.r = 0
+	f.spilled = false
 	f.crc.Reset()
 	if f.f != nil {
 		f.f.Truncate(0)
 	}
+	if f.shared != nil {
+		f.shared.release(f.chunks)
+		f.chunks = f.chunks[:0]
+	}
+	// release memory the buffer grew to hold
+	if len(f.buf) > f.size {
+		f.buf = nil
+	}
+}
+
+// sharedChunkSize is the size of the chunks a shared file is partitioned into.
+const sharedChunkSize = 1024 * 1024
+
+// sharedFile is a file partitioned into chunks, shared by a pool's files.
+type sharedFile struct {
+	name string
+
+	m    sync.Mutex
+	f    *os.File
+	free []int64
+	size int64
+}
+
+// alloc allocates a chunk, reusing a released chunk if there is one,
+// returning its offset.
+func (s *sharedFile) alloc() (int64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.f == nil {
+		// O_EXCL ensures another pool's file is never clobbered
+		f, err := os.OpenFile(s.name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+	}
+
+	if n := len(s.free); n > 0 {
+		off := s.free[n-1]
+		s.free = s.free[:n-1]
+		return off, nil
+	}
+
+	off := s.size
+	s.size += sharedChunkSize
+	return off, nil
+}
+
+// release releases chunks for reuse.
+func (s *sharedFile) release(chunks []int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.free = append(s.free, chunks...)
+}
+
+// rw writes or reads p at the offset off of a file's data, allocating chunks
+// as needed when writing.
+func (s *sharedFile) rw(f *File, p []byte, off int64, write bool) (int, error) {
+	var n int
+	for len(p) > 0 {
+		idx := int(off / sharedChunkSize)
+		for write && len(f.chunks) <= idx {
+			chunk, err := s.alloc()
+			if err != nil {
+				return n, err
+			}
+			f.chunks = append(f.chunks, chunk)
+		}
+		if idx >= len(f.chunks) {
+			return n, io.EOF
+		}
+
+		pos := off % sharedChunkSize
+		size := int64(len(p))
+		if size > sharedChunkSize-pos {
+			size = sharedChunkSize - pos
+		}
+
+		var rn int
+		var err error
+		if write {
+			rn, err = s.f.WriteAt(p[:size], f.chunks[idx]+pos)
+		} else {
+			rn, err = s.f.ReadAt(p[:size], f.chunks[idx]+pos)
+		}
+		n += rn
+		off += int64(rn)
+		p = p[rn:]
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
 }
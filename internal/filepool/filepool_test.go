@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -42,15 +43,17 @@ func TestFilePoolSizes(t *testing.T) {
 				assert.NoError(t, err)
 				fp.Put(f)
 
-				_, err = os.Lstat(filepath.Join(dir, fmt.Sprintf("fastzip_%02d", i)))
-				assert.NoError(t, err, fmt.Sprintf("fastzip_%02d should exist", i))
+				name := fmt.Sprintf("%s%02d", fp.Prefix(), i)
+				_, err = os.Lstat(filepath.Join(dir, name))
+				assert.NoError(t, err, fmt.Sprintf("%s should exist", name))
 			}
 
 			// closing should cleanup temporary files
 			assert.NoError(t, fp.Close())
 			for i := 0; i < tc.size; i++ {
-				_, err = os.Lstat(filepath.Join(dir, fmt.Sprintf("fastzip_%02d", i)))
-				assert.Error(t, err, fmt.Sprintf("fastzip_%02d shouldn't exist", i))
+				name := fmt.Sprintf("%s%02d", fp.Prefix(), i)
+				_, err = os.Lstat(filepath.Join(dir, name))
+				assert.Error(t, err, fmt.Sprintf("%s shouldn't exist", name))
 			}
 		})
 	}
@@ -176,11 +179,12 @@ func TestFilePoolFileBuffer(t *testing.T) {
 			assert.NoError(t, err)
 			assert.Equal(t, len(tc.data), n)
 
-			_, err = os.Lstat(filepath.Join(dir, "fastzip_00"))
+			name := fp.Prefix() + "00"
+			_, err = os.Lstat(filepath.Join(dir, name))
 			if tc.fileExists {
-				assert.NoError(t, err, "fastzip_00 should exist")
+				assert.NoError(t, err, name+" should exist")
 			} else {
-				assert.Error(t, err, "fastzip_00 should not exist")
+				assert.Error(t, err, name+" should not exist")
 			}
 
 			// split reads to ensure read/write indexes track correctly
@@ -201,3 +205,172 @@ func TestFilePoolFileBuffer(t *testing.T) {
 		})
 	}
 }
+
+func TestFilePoolMemory(t *testing.T) {
+	for _, size := range []int{0, 10} {
+		t.Run(fmt.Sprintf("buffer size %d", size), func(t *testing.T) {
+			fp, err := NewMemory(1, size)
+			require.NoError(t, err)
+			defer fp.Close()
+
+			data := bytes.Repeat([]byte("1234567890"), 100)
+
+			f := fp.Get()
+			for i := 0; i < len(data); i += 7 {
+				end := i + 7
+				if end > len(data) {
+					end = len(data)
+				}
+				n, err := f.Write(data[i:end])
+				require.NoError(t, err)
+				require.Equal(t, end-i, n)
+			}
+			assert.Nil(t, f.f)
+			assert.Equal(t, uint64(len(data)), f.Written())
+
+			b, err := io.ReadAll(f)
+			require.NoError(t, err)
+			assert.Equal(t, data, b)
+
+			fp.Put(f)
+			assert.LessOrEqual(t, len(f.buf), size)
+		})
+	}
+}
+
+func TestFilePoolSpillStats(t *testing.T) {
+	for _, mem := range []bool{false, true} {
+		t.Run(fmt.Sprintf("memory %v", mem), func(t *testing.T) {
+			var fp *FilePool
+			var err error
+			if mem {
+				fp, err = NewMemory(2, 10)
+			} else {
+				fp, err = New(t.TempDir(), 2, 10)
+			}
+			require.NoError(t, err)
+			defer fp.Close()
+
+			writes := [][]byte{
+				[]byte("123456789"),
+				[]byte("1234567890abc"),
+				[]byte("1234567890abcdef"),
+			}
+			for _, data := range writes {
+				f := fp.Get()
+				// write in two parts, a file should only be counted once
+				_, err = f.Write(data[:5])
+				require.NoError(t, err)
+				_, err = f.Write(data[5:])
+				require.NoError(t, err)
+				fp.Put(f)
+			}
+
+			assert.EqualValues(t, 2, fp.SpillCount())
+			assert.EqualValues(t, 9, fp.SpillBytes())
+		})
+	}
+}
+
+func TestFilePoolSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	fp1, err := New(dir, 2, 0)
+	require.NoError(t, err)
+	fp2, err := New(dir, 2, 0)
+	require.NoError(t, err)
+	defer fp2.Close()
+
+	require.NotEqual(t, fp1.Prefix(), fp2.Prefix())
+
+	for _, fp := range []*FilePool{fp1, fp2} {
+		for i := 0; i < 2; i++ {
+			f := fp.Get()
+			_, err = f.Write([]byte(fp.Prefix()))
+			require.NoError(t, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
+
+	// closing one pool only removes its own files
+	require.NoError(t, fp1.Close())
+
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.True(t, strings.HasPrefix(entry.Name(), fp2.Prefix()), entry.Name())
+	}
+
+	for i := 0; i < 2; i++ {
+		f := fp2.files[i]
+		b, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, fp2.Prefix(), string(b))
+	}
+}
+
+func TestFilePoolSharedFiles(t *testing.T) {
+	_, err := NewShared(t.TempDir(), 4, 0, 0)
+	require.Equal(t, ErrSharedFilesLessThanZero, err)
+
+	dir := t.TempDir()
+	fp, err := NewShared(dir, 4, 16, 1)
+	require.NoError(t, err)
+
+	contents := make([][]byte, 4)
+	for i := range contents {
+		contents[i] = bytes.Repeat([]byte{byte('a' + i)}, sharedChunkSize*2+100)
+	}
+
+	// files write interleaved, spanning several chunks of the shared file
+	files := make([]*File, 4)
+	for i := range files {
+		files[i] = fp.Get()
+	}
+	for off := 0; off < len(contents[0]); off += 1000 {
+		for i, f := range files {
+			end := off + 1000
+			if end > len(contents[i]) {
+				end = len(contents[i])
+			}
+			_, err := f.Write(contents[i][off:end])
+			require.NoError(t, err)
+		}
+	}
+
+	for i, f := range files {
+		b, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, contents[i], b)
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	size := fp.shared[0].size
+
+	// released chunks are reused
+	for _, f := range files {
+		fp.Put(f)
+	}
+	f := fp.Get()
+	_, err = f.Write(contents[0])
+	require.NoError(t, err)
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, contents[0], b)
+	fp.Put(f)
+
+	assert.Equal(t, size, fp.shared[0].size)
+
+	// closing removes the shared file
+	require.NoError(t, fp.Close())
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
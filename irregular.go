@@ -0,0 +1,28 @@
+package fastzip
+
+import (
+	"github.com/saracen/zipextra"
+)
+
+// extraFieldDevice is the extra field identifier used for device numbers. The
+// field holds a uint32 major and uint32 minor device number.
+const extraFieldDevice uint16 = 0x7664
+
+func encodeDevice(major, minor uint32) []byte {
+	buf := zipextra.NewBuffer([]byte{})
+	defer buf.WriteHeader(extraFieldDevice)()
+
+	buf.Write32(major)
+	buf.Write32(minor)
+
+	return buf.Bytes()
+}
+
+func decodeDevice(ef zipextra.ExtraField) (major, minor uint32, err error) {
+	buf := zipextra.NewBuffer(ef)
+	if buf.Available() < 8 {
+		return 0, 0, zipextra.ErrInvalidExtraFieldFormat
+	}
+
+	return buf.Read32(), buf.Read32(), nil
+}
@@ -0,0 +1,107 @@
+//go:build !windows
+// +build !windows
+
+package fastzip
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestArchiveExtractIrregular(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: "foo"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	special := map[string]os.FileMode{"fifo": os.ModeNamedPipe}
+	require.NoError(t, unix.Mkfifo(filepath.Join(dir, "fifo"), 0640))
+	if err := mknod(filepath.Join(dir, "null"), unix.S_IFCHR|0640, unix.Mkdev(1, 3)); err == nil {
+		special["null"] = os.ModeDevice | os.ModeCharDevice
+	}
+
+	for name := range special {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		files[filepath.Join(dir, name)] = fi
+	}
+
+	for _, include := range []bool{false, true} {
+		f, err := os.CreateTemp("", "fastzip-test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		a, err := NewArchiver(f, dir, WithArchiverIncludeIrregular(include))
+		require.NoError(t, err)
+		require.NoError(t, a.Archive(context.Background(), files))
+		require.NoError(t, a.Close())
+
+		_, entries := a.Written()
+		if include {
+			assert.EqualValues(t, len(files), entries)
+		} else {
+			assert.EqualValues(t, len(files)-len(special), entries)
+		}
+
+		for _, restore := range []bool{false, true} {
+			out := t.TempDir()
+			e, err := NewExtractor(f.Name(), out, WithExtractorRestoreIrregular(restore))
+			require.NoError(t, err)
+			require.NoError(t, e.Extract(context.Background()))
+			require.NoError(t, e.Close())
+
+			for name, typ := range special {
+				fi, err := os.Lstat(filepath.Join(out, name))
+				if !include || !restore {
+					assert.True(t, os.IsNotExist(err), name)
+					continue
+				}
+
+				require.NoError(t, err)
+				assert.Equal(t, typ, fi.Mode().Type(), name)
+				assert.Equal(t, os.FileMode(0640), fi.Mode().Perm(), name)
+			}
+
+			if fi, err := os.Lstat(filepath.Join(out, "null")); err == nil && include && restore {
+				rdev := uint64(fi.Sys().(*syscall.Stat_t).Rdev)
+				assert.Equal(t, uint32(1), unix.Major(rdev))
+				assert.Equal(t, uint32(3), unix.Minor(rdev))
+			}
+		}
+	}
+}
+
+func TestArchiveSkipHandlerIrregular(t *testing.T) {
+	files, dir := testCreateFiles(t, map[string]testFile{
+		"foo.go": {mode: 0666, contents: "foo"},
+	})
+	defer os.RemoveAll(dir)
+
+	fifo := filepath.Join(dir, "fifo")
+	require.NoError(t, unix.Mkfifo(fifo, 0640))
+	fi, err := os.Lstat(fifo)
+	require.NoError(t, err)
+	files[fifo] = fi
+
+	var skipped []string
+	a, err := NewArchiver(io.Discard, dir, WithArchiverSkipHandler(func(name string, fi os.FileInfo) {
+		assert.Equal(t, os.ModeNamedPipe, fi.Mode().Type())
+		skipped = append(skipped, name)
+	}))
+	require.NoError(t, err)
+	require.NoError(t, a.Archive(context.Background(), files))
+	require.NoError(t, a.Close())
+
+	assert.Equal(t, []string{fifo}, skipped)
+}
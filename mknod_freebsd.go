@@ -0,0 +1,17 @@
+//go:build freebsd
+// +build freebsd
+
+package fastzip
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func mknod(path string, mode uint32, dev uint64) error {
+	if err := unix.Mknod(path, mode, dev); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package fastzip
+
+import (
+	"time"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/saracen/zipextra"
+)
+
+// extraFieldModTime is the extra field identifier used for modification times
+// with nanosecond precision. The field holds the seconds since the Unix epoch
+// as an int64, split into its low and high uint32, followed by the nanoseconds
+// as a uint32.
+const extraFieldModTime uint16 = 0x6d74
+
+func encodeModTime(t time.Time) []byte {
+	buf := zipextra.NewBuffer([]byte{})
+	defer buf.WriteHeader(extraFieldModTime)()
+
+	secs := uint64(t.Unix())
+	buf.Write32(uint32(secs))
+	buf.Write32(uint32(secs >> 32))
+	buf.Write32(uint32(t.Nanosecond()))
+
+	return buf.Bytes()
+}
+
+// storedModTime returns the modification time stored in a precise
+// modification time extra field.
+func storedModTime(fields map[uint16]zipextra.ExtraField) (time.Time, bool) {
+	field, ok := fields[extraFieldModTime]
+	if !ok || len(field) != 12 {
+		return time.Time{}, false
+	}
+
+	buf := zipextra.NewBuffer(field)
+	secs := uint64(buf.Read32())
+	secs |= uint64(buf.Read32()) << 32
+	nsecs := buf.Read32()
+	if nsecs >= 1e9 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(secs), int64(nsecs)), true
+}
+
+// modTime returns the most precise modification time available for an entry.
+// The Info-ZIP extended timestamp the reader uses only has 1 second
+// precision, the NTFS extra field 100 nanosecond precision, and the precise
+// modification time extra field nanosecond precision.
+func modTime(file *zip.File, fields map[uint16]zipextra.ExtraField) time.Time {
+	if t, ok := storedModTime(fields); ok {
+		return t
+	}
+	if t, ok := ntfsModTime(fields); ok {
+		return t
+	}
+	return file.Modified
+}
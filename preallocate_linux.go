@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package fastzip
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate allocates the disk space for a file of the size provided,
+// without changing the file's size. Filesystems that don't support
+// preallocation are skipped.
+func preallocate(f *os.File, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS || err == unix.EINVAL {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package fastzip
+
+import "os"
+
+// preallocate is only supported on Linux.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
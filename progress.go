@@ -0,0 +1,14 @@
+package fastzip
+
+// Progress is a snapshot of an archiving or extraction operation's progress.
+type Progress struct {
+	// BytesWritten is the number of bytes written to the archive, when
+	// archiving, or to disk, when extracting.
+	BytesWritten int64
+
+	// EntriesDone is the number of entries processed.
+	EntriesDone int64
+
+	// EntriesTotal is the number of entries planned to be processed.
+	EntriesTotal int64
+}
@@ -0,0 +1,89 @@
+package fastzip
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket rate limiter that can be shared between
+// goroutines. The bucket holds up to a second's worth of tokens and starts
+// empty.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{
+		rate:  float64(bytesPerSec),
+		burst: bytesPerSec,
+		last:  time.Now(),
+	}
+}
+
+// wait blocks until n tokens, which must not exceed the burst, are available.
+// Tokens are reserved immediately, so concurrent callers are served in order.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitWriter limits the rate of writes to w.
+type rateLimitWriter struct {
+	w   io.Writer
+	l   *rateLimiter
+	ctx context.Context
+}
+
+func (w *rateLimitWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.l.burst {
+			chunk = chunk[:w.l.burst]
+		}
+
+		if err := w.l.wait(w.ctx, len(chunk)); err != nil {
+			return n, err
+		}
+
+		written, err := w.w.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+	}
+
+	return n, nil
+}
@@ -2,15 +2,37 @@ package fastzip
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
 	"sync"
 
 	stdflate "compress/flate"
 
+	"github.com/dsnet/compress/bzip2"
 	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/zstd"
+	"github.com/saracen/fastzip/internal/deflate64"
+	"github.com/ulikunitz/xz/lzma"
 )
 
+// ZipMethodDeflate64 is the zip method ID for Deflate64 (enhanced deflate)
+// compression.
+const ZipMethodDeflate64 uint16 = 9
+
+// ZipMethodBzip2 is the zip method ID for bzip2 compression.
+const ZipMethodBzip2 uint16 = 12
+
+// ZipMethodLZMA is the zip method ID for LZMA compression.
+const ZipMethodLZMA uint16 = 14
+
+// lzmaEOSFlag is the general purpose bit flag indicating that an LZMA stream
+// is terminated by an end-of-stream marker.
+const lzmaEOSFlag = 0x2
+
+var errLZMAProperties = errors.New("lzma: unsupported properties size")
+
 type flater interface {
 	Close() error
 	Flush() error
@@ -79,11 +101,36 @@ func (zr *zstdReader) Close() error {
 
 // ZstdDecompressor returns a pooled zstd decoder.
 func ZstdDecompressor() func(r io.Reader) io.ReadCloser {
+	return zstdDecompressor()
+}
+
+// ZstdDecompressorWithDict returns a pooled zstd decoder using the dictionary
+// provided, in the format produced by "zstd --train". The dictionary must
+// match the one used for compression, so needs to be transmitted out-of-band
+// or stored in the archive comment. Entries compressed without a dictionary
+// can still be decompressed.
+func ZstdDecompressorWithDict(dict []byte) func(r io.Reader) io.ReadCloser {
+	return zstdDecompressor(zstd.WithDecoderDicts(dict))
+}
+
+func zstdDecompressor(opts ...zstd.DOption) func(r io.Reader) io.ReadCloser {
+	opts = append([]zstd.DOption{zstd.WithDecoderLowmem(true), zstd.WithDecoderMaxWindow(128 << 20), zstd.WithDecoderConcurrency(1)}, opts...)
+
+	// a decoder is created upfront so that invalid options are reported
+	// rather than every pooled decoder failing
+	d, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return func(r io.Reader) io.ReadCloser {
+			return errReadCloser{err}
+		}
+	}
+
 	pool := &sync.Pool{}
 	pool.New = func() interface{} {
-		r, _ := zstd.NewReader(nil, zstd.WithDecoderLowmem(true), zstd.WithDecoderMaxWindow(128<<20), zstd.WithDecoderConcurrency(1))
+		r, _ := zstd.NewReader(nil, opts...)
 		return &zstdReader{pool, bufio.NewReaderSize(nil, 32*1024), r}
 	}
+	pool.Put(&zstdReader{pool, bufio.NewReaderSize(nil, 32*1024), d})
 
 	return func(r io.Reader) io.ReadCloser {
 		fr := pool.Get().(*zstdReader)
@@ -92,6 +139,119 @@ func ZstdDecompressor() func(r io.Reader) io.ReadCloser {
 	}
 }
 
+type bzip2Reader struct {
+	pool *sync.Pool
+	buf  *bufio.Reader
+	*bzip2.Reader
+}
+
+func (br *bzip2Reader) Reset(r io.Reader) {
+	br.buf.Reset(r)
+	br.Reader.Reset(br.buf)
+}
+
+func (br *bzip2Reader) Close() error {
+	err := br.Reader.Close()
+	br.pool.Put(br)
+	return err
+}
+
+// Bzip2Decompressor returns a pooled bzip2 decompressor.
+func Bzip2Decompressor() func(r io.Reader) io.ReadCloser {
+	pool := &sync.Pool{}
+	pool.New = func() interface{} {
+		r, _ := bzip2.NewReader(nil, nil)
+		return &bzip2Reader{pool, bufio.NewReaderSize(nil, 32*1024), r}
+	}
+
+	return func(r io.Reader) io.ReadCloser {
+		br := pool.Get().(*bzip2Reader)
+		br.Reset(r)
+		return br
+	}
+}
+
+type deflate64Reader struct {
+	pool *sync.Pool
+	buf  *bufio.Reader
+	*deflate64.Reader
+}
+
+func (dr *deflate64Reader) Reset(r io.Reader) {
+	dr.buf.Reset(r)
+	dr.Reader.Reset(dr.buf)
+}
+
+func (dr *deflate64Reader) Close() error {
+	err := dr.Reader.Close()
+	dr.pool.Put(dr)
+	return err
+}
+
+// Deflate64Decompressor returns a pooled Deflate64 decompressor.
+func Deflate64Decompressor() func(r io.Reader) io.ReadCloser {
+	pool := &sync.Pool{}
+	pool.New = func() interface{} {
+		return &deflate64Reader{pool, bufio.NewReaderSize(nil, 32*1024), deflate64.NewReader(nil)}
+	}
+
+	return func(r io.Reader) io.ReadCloser {
+		dr := pool.Get().(*deflate64Reader)
+		dr.Reset(r)
+		return dr
+	}
+}
+
+type errReadCloser struct {
+	err error
+}
+
+func (r errReadCloser) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func (r errReadCloser) Close() error {
+	return nil
+}
+
+// newLZMAReader returns a reader for a zip LZMA stream. The zip LZMA header
+// consists of a 2 byte version, a 2 byte properties size and the properties.
+// This is converted to the classic LZMA header, where a size of -1 indicates
+// that the stream is terminated by an end-of-stream marker.
+func newLZMAReader(r io.Reader, size int64) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, 32*1024)
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint16(hdr[2:]) != 5 {
+		return nil, errLZMAProperties
+	}
+
+	header := make([]byte, lzma.HeaderLen)
+	if _, err := io.ReadFull(br, header[:5]); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(header[5:], uint64(size))
+
+	return lzma.NewReader(io.MultiReader(bytes.NewReader(header), br))
+}
+
+// LZMADecompressor returns an LZMA decompressor. The decompressor is unaware
+// of the entry's uncompressed size, so expects the stream to be terminated
+// by an end-of-stream marker. The Extractor handles entries without the
+// marker itself.
+func LZMADecompressor() func(r io.Reader) io.ReadCloser {
+	return func(r io.Reader) io.ReadCloser {
+		lr, err := newLZMAReader(r, -1)
+		if err != nil {
+			return errReadCloser{err}
+		}
+		return io.NopCloser(lr)
+	}
+}
+
 func newFlateWriterPool(level int, newWriterFn func(w io.Writer, level int) (flater, error)) *sync.Pool {
 	pool := &sync.Pool{}
 	pool.New = func() interface{} {
@@ -160,3 +320,59 @@ func ZstdCompressor(level int) func(w io.Writer) (io.WriteCloser, error) {
 		return fw, nil
 	}
 }
+
+// ZstdCompressorWithDict returns a pooled zstd compressor configured to a
+// specified compression level and using the dictionary provided, in the format
+// produced by "zstd --train". The same dictionary is required to decompress
+// the data, see ZstdDecompressorWithDict. An invalid dictionary is returned
+// as an error by the compressor.
+func ZstdCompressorWithDict(level int, dict []byte) func(w io.Writer) (io.WriteCloser, error) {
+	newWriterFn := func(w io.Writer, level int) (flater, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderCRC(false), zstd.WithEncoderLevel(zstd.EncoderLevel(level)), zstd.WithEncoderDict(dict))
+	}
+
+	if _, err := newWriterFn(nil, level); err != nil {
+		return func(w io.Writer) (io.WriteCloser, error) {
+			return nil, err
+		}
+	}
+
+	pool := newFlateWriterPool(level, newWriterFn)
+
+	return func(w io.Writer) (io.WriteCloser, error) {
+		fw := pool.Get().(*flateWriter)
+		fw.Reset(w)
+		return fw, nil
+	}
+}
+
+type bzip2Writer struct {
+	pool *sync.Pool
+	*bzip2.Writer
+}
+
+func (bw *bzip2Writer) Close() error {
+	err := bw.Writer.Close()
+	bw.pool.Put(bw)
+	return err
+}
+
+// Bzip2Compressor returns a pooled bzip2 compressor configured to a specified
+// compression level (1-9). Invalid bzip2 levels will panic.
+func Bzip2Compressor(level int) func(w io.Writer) (io.WriteCloser, error) {
+	pool := &sync.Pool{}
+	pool.New = func() interface{} {
+		bw, err := bzip2.NewWriter(nil, &bzip2.WriterConfig{Level: level})
+		if err != nil {
+			panic(err)
+		}
+
+		return &bzip2Writer{pool, bw}
+	}
+
+	return func(w io.Writer) (io.WriteCloser, error) {
+		bw := pool.Get().(*bzip2Writer)
+		bw.Reset(w)
+		return bw, nil
+	}
+}
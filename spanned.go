@@ -0,0 +1,723 @@
+package fastzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zip"
+)
+
+const (
+	// spanSignature is written at the start of the first part of a split
+	// archive.
+	spanSignature = 0x08074b50
+
+	// spanMarkerSignature replaces spanSignature when a split archive
+	// only has a single part.
+	spanMarkerSignature = 0x30304b50
+
+	spanSignatureLen = 4
+
+	// MinPartSize is the minimum part size of a split archive.
+	MinPartSize = 64 * 1024
+)
+
+var (
+	// ErrMinPartSize is returned when creating a split archive with a part
+	// size less than MinPartSize.
+	ErrMinPartSize = fmt.Errorf("part size must be at least %d", MinPartSize)
+
+	// ErrTooManyParts is returned when a split archive requires more parts
+	// than can be recorded.
+	ErrTooManyParts = errors.New("split archive has too many parts")
+
+	// ErrMissingPart is returned by NewSpannedExtractor when a part of a
+	// split archive cannot be found.
+	ErrMissingPart = errors.New("split archive part is missing")
+
+	errSpanDirectory = errors.New("span: invalid central directory")
+)
+
+// NewSpannedArchiver returns a new Archiver that writes a split archive, with
+// each part being partSize bytes. The parts are named basePath.z01,
+// basePath.z02 and so on, with the final part, which holds the end of the
+// central directory, named basePath.zip. A ".zip" extension on basePath is
+// ignored.
+//
+// Close() must be called to write the central directory and close the
+// parts. The offset option is ignored for split archives.
+func NewSpannedArchiver(basePath, chroot string, partSize int64, opts ...ArchiverOption) (*Archiver, error) {
+	if partSize < MinPartSize {
+		return nil, ErrMinPartSize
+	}
+
+	sw, err := newSpanWriter(basePath, partSize)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := NewArchiver(sw, chroot, opts...)
+	if err != nil {
+		sw.f.Close()
+		os.Remove(sw.partName(sw.disk))
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// spanWriter writes to a sequence of part files, starting a new part whenever
+// the current part reaches the part size.
+//
+// Like zip64Writer, the central directory is buffered when finishing, as the
+// offsets written by zip.Writer are relative to the start of the first part,
+// but those of a split archive are relative to the start of the part holding
+// the entry's header.
+type spanWriter struct {
+	base     string
+	partSize int64
+
+	f    *os.File
+	disk int
+	n    int64
+
+	buf *bytes.Buffer
+}
+
+func newSpanWriter(basePath string, partSize int64) (*spanWriter, error) {
+	s := &spanWriter{
+		base:     strings.TrimSuffix(basePath, ".zip"),
+		partSize: partSize,
+	}
+
+	var err error
+	s.f, err = os.Create(s.partName(0))
+	if err != nil {
+		return nil, err
+	}
+
+	var sig [spanSignatureLen]byte
+	binary.LittleEndian.PutUint32(sig[:], spanSignature)
+	if _, err := s.write(sig[:]); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *spanWriter) partName(disk int) string {
+	return spanPartName(s.base, disk)
+}
+
+// spanPartName returns the name of a part, other than the final part, of a
+// split archive.
+func spanPartName(base string, disk int) string {
+	return fmt.Sprintf("%s.z%02d", base, disk+1)
+}
+
+func (s *spanWriter) Write(p []byte) (int, error) {
+	if s.buf != nil {
+		return s.buf.Write(p)
+	}
+	return s.write(p)
+}
+
+// write writes to the current part, starting the next part once the current
+// part is full.
+func (s *spanWriter) write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if s.n >= s.partSize {
+			if err := s.next(); err != nil {
+				return n, err
+			}
+		}
+
+		chunk := p
+		if remaining := s.partSize - s.n; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		written, err := s.f.Write(chunk)
+		n += written
+		s.n += int64(written)
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+	}
+
+	return n, nil
+}
+
+func (s *spanWriter) next() error {
+	if s.disk+1 >= uint16max {
+		return ErrTooManyParts
+	}
+
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+
+	s.disk++
+	s.n = 0
+
+	var err error
+	s.f, err = os.Create(s.partName(s.disk))
+	return err
+}
+
+// pos returns the part and offset within that part that the next byte is
+// written to.
+func (s *spanWriter) pos() (int, int64) {
+	if s.n >= s.partSize {
+		return s.disk + 1, 0
+	}
+	return s.disk, s.n
+}
+
+// finish rewrites the buffered central directory, so that each entry records
+// the part holding its local file header and an offset relative to that part,
+// followed by the end of central directory records, which are never split
+// across parts. The final part is then renamed with the ".zip" extension.
+func (s *spanWriter) finish() error {
+	b := s.buf.Bytes()
+	s.buf = nil
+
+	eocd := findDirectoryEnd(b)
+	if eocd < 0 {
+		return errSpanDirectory
+	}
+
+	records := uint64(binary.LittleEndian.Uint16(b[eocd+10:]))
+	size := uint64(binary.LittleEndian.Uint32(b[eocd+12:]))
+	offset := uint64(binary.LittleEndian.Uint32(b[eocd+16:]))
+
+	var end64 []byte
+	dirEnd := eocd
+	if records == uint16max || size == uint32max || offset == uint32max {
+		dirEnd = eocd - directory64LocLen - directory64EndLen
+		if dirEnd < 0 || binary.LittleEndian.Uint32(b[dirEnd:]) != directory64EndSignature {
+			return errSpanDirectory
+		}
+		end64 = append([]byte(nil), b[dirEnd:eocd]...)
+		size = binary.LittleEndian.Uint64(b[dirEnd+40:])
+	}
+	end := append([]byte(nil), b[eocd:]...)
+
+	dirStart := dirEnd - int(size)
+	if dirStart < 0 {
+		return errSpanDirectory
+	}
+
+	// data preceding the central directory, such as the last entry's data
+	// descriptor, is written unmodified
+	if _, err := s.write(b[:dirStart]); err != nil {
+		return err
+	}
+
+	dirDisk, dirOffset := s.pos()
+	entries := make(map[int]uint64)
+	for dir := b[dirStart:dirEnd]; len(dir) > 0; {
+		if len(dir) < directoryHeaderLen || binary.LittleEndian.Uint32(dir) != directoryHeaderSignature {
+			return errSpanDirectory
+		}
+
+		nameLen := int(binary.LittleEndian.Uint16(dir[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(dir[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(dir[32:]))
+		n := directoryHeaderLen + nameLen + extraLen + commentLen
+		if len(dir) < n {
+			return errSpanDirectory
+		}
+
+		hdr := append([]byte(nil), dir[:n]...)
+		if err := s.relocate(hdr, nameLen, extraLen); err != nil {
+			return err
+		}
+
+		disk, _ := s.pos()
+		entries[disk]++
+		if _, err := s.write(hdr); err != nil {
+			return err
+		}
+		dir = dir[n:]
+	}
+
+	if s.n < s.partSize && s.partSize-s.n < int64(len(end64)+len(end)) {
+		if err := s.next(); err != nil {
+			return err
+		}
+	}
+	disk, pos := s.pos()
+
+	if end64 != nil {
+		binary.LittleEndian.PutUint32(end64[16:], uint32(disk))
+		binary.LittleEndian.PutUint32(end64[20:], uint32(dirDisk))
+		binary.LittleEndian.PutUint64(end64[24:], entries[disk])
+		binary.LittleEndian.PutUint64(end64[48:], uint64(dirOffset))
+
+		loc := end64[directory64EndLen:]
+		binary.LittleEndian.PutUint32(loc[4:], uint32(disk))
+		binary.LittleEndian.PutUint64(loc[8:], uint64(pos))
+		binary.LittleEndian.PutUint32(loc[16:], uint32(disk+1))
+
+		if _, err := s.write(end64); err != nil {
+			return err
+		}
+	}
+
+	binary.LittleEndian.PutUint16(end[4:], uint16(disk))
+	binary.LittleEndian.PutUint16(end[6:], uint16(dirDisk))
+	if binary.LittleEndian.Uint16(end[8:]) != uint16max {
+		binary.LittleEndian.PutUint16(end[8:], uint16(entries[disk]))
+	}
+	if binary.LittleEndian.Uint32(end[16:]) != uint32max {
+		binary.LittleEndian.PutUint32(end[16:], uint32(dirOffset))
+	}
+	if _, err := s.write(end); err != nil {
+		return err
+	}
+
+	return s.close()
+}
+
+// relocate rewrites a central directory header's local file header offset,
+// either in the header or its ZIP64 extra field, to be relative to the part
+// holding it, and sets the header's disk number.
+func (s *spanWriter) relocate(hdr []byte, nameLen, extraLen int) error {
+	var offset []byte
+	if binary.LittleEndian.Uint32(hdr[42:]) != uint32max {
+		offset = hdr[42:46]
+	} else {
+		extra := hdr[directoryHeaderLen+nameLen : directoryHeaderLen+nameLen+extraLen]
+		for len(extra) >= 4 {
+			id := binary.LittleEndian.Uint16(extra)
+			size := int(binary.LittleEndian.Uint16(extra[2:]))
+			if len(extra) < 4+size {
+				return errSpanDirectory
+			}
+			field := extra[4 : 4+size]
+			extra = extra[4+size:]
+			if id != zip64ExtraID {
+				continue
+			}
+
+			// the offset follows the uncompressed and compressed sizes, if
+			// they're present
+			idx := 0
+			if binary.LittleEndian.Uint32(hdr[24:]) == uint32max {
+				idx += 8
+			}
+			if binary.LittleEndian.Uint32(hdr[20:]) == uint32max {
+				idx += 8
+			}
+			if len(field) < idx+8 {
+				return errSpanDirectory
+			}
+			offset = field[idx : idx+8]
+			break
+		}
+		if offset == nil {
+			return errSpanDirectory
+		}
+	}
+
+	var global uint64
+	if len(offset) == 4 {
+		global = uint64(binary.LittleEndian.Uint32(offset))
+		binary.LittleEndian.PutUint32(offset, uint32(global%uint64(s.partSize)))
+	} else {
+		global = binary.LittleEndian.Uint64(offset)
+		binary.LittleEndian.PutUint64(offset, global%uint64(s.partSize))
+	}
+
+	disk := global / uint64(s.partSize)
+	if disk >= uint16max {
+		return ErrTooManyParts
+	}
+	binary.LittleEndian.PutUint16(hdr[34:], uint16(disk))
+
+	return nil
+}
+
+// close closes the final part and renames it with the ".zip" extension. An
+// archive with a single part is a regular archive, so the spanning signature
+// is replaced with the marker used for this case.
+func (s *spanWriter) close() error {
+	if s.disk == 0 {
+		var sig [spanSignatureLen]byte
+		binary.LittleEndian.PutUint32(sig[:], spanMarkerSignature)
+		if _, err := s.f.WriteAt(sig[:], 0); err != nil {
+			s.f.Close()
+			return err
+		}
+	}
+
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(s.partName(s.disk), s.base+".zip")
+}
+
+// NewSpannedExtractor opens a split archive, with parts named basePath.z01,
+// basePath.z02 and so on, followed by the final part basePath.zip, and returns
+// a new extractor. A ".zip" extension on basePath is ignored. If a part is
+// missing, an error wrapping ErrMissingPart is returned.
+//
+// Close() should be called to close the parts when done.
+func NewSpannedExtractor(basePath, chroot string, opts ...ExtractorOption) (*Extractor, error) {
+	sr, err := openSpanReader(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(sr, sr.size)
+	if err == nil {
+		var e *Extractor
+		if e, err = newExtractor(zr, sr, chroot, opts); err == nil {
+			return e, nil
+		}
+	}
+
+	sr.Close()
+	return nil, err
+}
+
+type spanSegment struct {
+	r     io.ReaderAt
+	start int64
+	size  int64
+}
+
+// spanReader presents the parts of a split archive as a single archive. As
+// zip.Reader expects offsets relative to the start of the archive, the central
+// directory is replaced with one rewritten to use these offsets.
+type spanReader struct {
+	files    []*os.File
+	segments []spanSegment
+	size     int64
+}
+
+func openSpanReader(basePath string) (*spanReader, error) {
+	sr := &spanReader{}
+	if err := sr.open(basePath); err != nil {
+		sr.Close()
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+func (sr *spanReader) open(basePath string) error {
+	base := strings.TrimSuffix(basePath, ".zip")
+
+	for disk := 0; ; disk++ {
+		f, err := os.Open(spanPartName(base, disk))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sr.files = append(sr.files, f)
+	}
+
+	f, err := os.Open(base + ".zip")
+	if err != nil {
+		return err
+	}
+	sr.files = append(sr.files, f)
+
+	for _, f := range sr.files {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		sr.segments = append(sr.segments, spanSegment{r: f, start: sr.size, size: fi.Size()})
+		sr.size += fi.Size()
+	}
+
+	last := sr.segments[len(sr.segments)-1]
+	n := last.size
+	if n > directoryEndLen+uint16max {
+		n = directoryEndLen + uint16max
+	}
+	b := make([]byte, n)
+	if _, err := last.r.ReadAt(b, last.size-n); err != nil {
+		return err
+	}
+
+	eocd := findDirectoryEnd(b)
+	if eocd < 0 {
+		return errSpanDirectory
+	}
+	end := b[eocd:]
+
+	disk := int(binary.LittleEndian.Uint16(end[4:]))
+	dirDisk := int(binary.LittleEndian.Uint16(end[6:]))
+	records := uint64(binary.LittleEndian.Uint16(end[10:]))
+	size := uint64(binary.LittleEndian.Uint32(end[12:]))
+	offset := uint64(binary.LittleEndian.Uint32(end[16:]))
+
+	if records == uint16max || size == uint32max || offset == uint32max {
+		loc := eocd - directory64LocLen
+		if loc < 0 || binary.LittleEndian.Uint32(b[loc:]) != directory64LocSignature {
+			return errSpanDirectory
+		}
+
+		if err := sr.checkParts(base, int(binary.LittleEndian.Uint32(b[loc+16:]))-1); err != nil {
+			return err
+		}
+
+		end64Disk := int(binary.LittleEndian.Uint32(b[loc+4:]))
+		if end64Disk >= len(sr.segments) {
+			return errSpanDirectory
+		}
+
+		var end64 [directory64EndLen]byte
+		if _, err := sr.segments[end64Disk].r.ReadAt(end64[:], int64(binary.LittleEndian.Uint64(b[loc+8:]))); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(end64[:]) != directory64EndSignature {
+			return errSpanDirectory
+		}
+
+		disk = int(binary.LittleEndian.Uint32(end64[16:]))
+		dirDisk = int(binary.LittleEndian.Uint32(end64[20:]))
+		records = binary.LittleEndian.Uint64(end64[32:])
+		size = binary.LittleEndian.Uint64(end64[40:])
+		offset = binary.LittleEndian.Uint64(end64[48:])
+	}
+
+	if err := sr.checkParts(base, disk); err != nil {
+		return err
+	}
+	if dirDisk > disk {
+		return errSpanDirectory
+	}
+
+	dirStart := sr.segments[dirDisk].start + int64(offset)
+	if dirStart+int64(size) > sr.size {
+		return errSpanDirectory
+	}
+
+	dir := make([]byte, size)
+	if _, err := sr.ReadAt(dir, dirStart); err != nil {
+		return err
+	}
+
+	tail, err := sr.rewriteDirectory(dir, records, dirStart, end[directoryEndLen:])
+	if err != nil {
+		return err
+	}
+
+	// the segments are truncated at the start of the central directory,
+	// with the rewritten central directory following
+	var segments []spanSegment
+	for _, seg := range sr.segments {
+		if seg.start >= dirStart {
+			break
+		}
+		if seg.start+seg.size > dirStart {
+			seg.size = dirStart - seg.start
+		}
+		segments = append(segments, seg)
+	}
+	sr.segments = append(segments, spanSegment{r: bytes.NewReader(tail), start: dirStart, size: int64(len(tail))})
+	sr.size = dirStart + int64(len(tail))
+
+	return nil
+}
+
+// checkParts checks the number of parts opened against the final part's disk
+// number, which is the number of parts preceding it.
+func (sr *spanReader) checkParts(base string, disk int) error {
+	parts := len(sr.files) - 1
+	switch {
+	case parts < disk:
+		return fmt.Errorf("%s: %w", spanPartName(base, parts), ErrMissingPart)
+	case parts > disk:
+		return errSpanDirectory
+	}
+	return nil
+}
+
+// rewriteDirectory returns the central directory with each entry's local file
+// header offset relative to the start of the first part. Like zip64Writer,
+// every entry is given a ZIP64 extra field, so that offsets beyond 4GiB can be
+// represented, followed by ZIP64 end of central directory records.
+func (sr *spanReader) rewriteDirectory(dir []byte, records uint64, dirStart int64, comment []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(dir)+int(records)*zip64ExtraLen+directory64EndLen+directory64LocLen+directoryEndLen+len(comment)))
+
+	var entries uint64
+	for len(dir) > 0 {
+		if len(dir) < directoryHeaderLen || binary.LittleEndian.Uint32(dir) != directoryHeaderSignature {
+			return nil, errSpanDirectory
+		}
+
+		nameLen := int(binary.LittleEndian.Uint16(dir[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(dir[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(dir[32:]))
+		n := directoryHeaderLen + nameLen + extraLen + commentLen
+		if len(dir) < n {
+			return nil, errSpanDirectory
+		}
+
+		var hdr [directoryHeaderLen]byte
+		copy(hdr[:], dir)
+
+		uncompressed := uint64(binary.LittleEndian.Uint32(hdr[24:]))
+		compressed := uint64(binary.LittleEndian.Uint32(hdr[20:]))
+		offset := uint64(binary.LittleEndian.Uint32(hdr[42:]))
+
+		// the existing ZIP64 extra field is read and removed
+		var extra []byte
+		for b := dir[directoryHeaderLen+nameLen : directoryHeaderLen+nameLen+extraLen]; len(b) >= 4; {
+			id := binary.LittleEndian.Uint16(b)
+			size := int(binary.LittleEndian.Uint16(b[2:]))
+			if len(b) < 4+size {
+				return nil, errSpanDirectory
+			}
+			if id != zip64ExtraID {
+				extra = append(extra, b[:4+size]...)
+				b = b[4+size:]
+				continue
+			}
+
+			field := b[4 : 4+size]
+			for _, v := range []*uint64{&uncompressed, &compressed, &offset} {
+				if *v != uint32max {
+					continue
+				}
+				if len(field) < 8 {
+					return nil, errSpanDirectory
+				}
+				*v = binary.LittleEndian.Uint64(field)
+				field = field[8:]
+			}
+			b = b[4+size:]
+		}
+
+		disk := int(binary.LittleEndian.Uint16(hdr[34:]))
+		if disk >= len(sr.segments) {
+			return nil, errSpanDirectory
+		}
+		offset += uint64(sr.segments[disk].start)
+
+		if len(extra)+zip64ExtraLen > uint16max {
+			return nil, errors.New("zip64: extra field too long")
+		}
+
+		if binary.LittleEndian.Uint16(hdr[6:]) < zipVersion45 {
+			binary.LittleEndian.PutUint16(hdr[6:], zipVersion45)
+		}
+		binary.LittleEndian.PutUint32(hdr[20:], uint32max)
+		binary.LittleEndian.PutUint32(hdr[24:], uint32max)
+		binary.LittleEndian.PutUint16(hdr[30:], uint16(len(extra)+zip64ExtraLen))
+		binary.LittleEndian.PutUint16(hdr[34:], 0)
+		binary.LittleEndian.PutUint32(hdr[42:], uint32max)
+
+		var zip64Extra [zip64ExtraLen]byte
+		binary.LittleEndian.PutUint16(zip64Extra[0:], zip64ExtraID)
+		binary.LittleEndian.PutUint16(zip64Extra[2:], zip64ExtraLen-4)
+		binary.LittleEndian.PutUint64(zip64Extra[4:], uncompressed)
+		binary.LittleEndian.PutUint64(zip64Extra[12:], compressed)
+		binary.LittleEndian.PutUint64(zip64Extra[20:], offset)
+
+		out.Write(hdr[:])
+		out.Write(dir[directoryHeaderLen : directoryHeaderLen+nameLen])
+		out.Write(extra)
+		out.Write(zip64Extra[:])
+		out.Write(dir[directoryHeaderLen+nameLen+extraLen : n])
+		dir = dir[n:]
+		entries++
+	}
+
+	if entries != records {
+		return nil, errSpanDirectory
+	}
+
+	size := uint64(out.Len())
+
+	var records64 [directory64EndLen + directory64LocLen]byte
+	r := records64[:]
+	binary.LittleEndian.PutUint32(r[0:], directory64EndSignature)
+	binary.LittleEndian.PutUint64(r[4:], directory64EndLen-12)
+	binary.LittleEndian.PutUint16(r[12:], zipVersion45)
+	binary.LittleEndian.PutUint16(r[14:], zipVersion45)
+	binary.LittleEndian.PutUint64(r[24:], records)
+	binary.LittleEndian.PutUint64(r[32:], records)
+	binary.LittleEndian.PutUint64(r[40:], size)
+	binary.LittleEndian.PutUint64(r[48:], uint64(dirStart))
+
+	r = r[directory64EndLen:]
+	binary.LittleEndian.PutUint32(r[0:], directory64LocSignature)
+	binary.LittleEndian.PutUint64(r[8:], uint64(dirStart)+size)
+	binary.LittleEndian.PutUint32(r[16:], 1)
+	out.Write(records64[:])
+
+	var eocd [directoryEndLen]byte
+	binary.LittleEndian.PutUint32(eocd[0:], directoryEndSignature)
+	binary.LittleEndian.PutUint16(eocd[8:], uint16max)
+	binary.LittleEndian.PutUint16(eocd[10:], uint16max)
+	binary.LittleEndian.PutUint32(eocd[12:], uint32max)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32max)
+	binary.LittleEndian.PutUint16(eocd[20:], uint16(len(comment)))
+	out.Write(eocd[:])
+	out.Write(comment)
+
+	return out.Bytes(), nil
+}
+
+func (sr *spanReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("span: negative offset")
+	}
+
+	i := sort.Search(len(sr.segments), func(i int) bool {
+		return sr.segments[i].start+sr.segments[i].size > off
+	})
+
+	for ; n < len(p) && i < len(sr.segments); i++ {
+		seg := sr.segments[i]
+
+		chunk := p[n:]
+		pos := off + int64(n) - seg.start
+		if remaining := seg.size - pos; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		m, err := seg.r.ReadAt(chunk, pos)
+		n += m
+		if m < len(chunk) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes the parts.
+func (sr *spanReader) Close() error {
+	var err error
+	for _, f := range sr.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
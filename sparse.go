@@ -0,0 +1,58 @@
+package fastzip
+
+import (
+	"io"
+	"os"
+)
+
+// sparseBlockSize is the size of the blocks checked for zeros when writing
+// sparse files. It matches the block size of most filesystems, so that holes
+// are created for every block skipped.
+const sparseBlockSize = 4096
+
+// sparseWriter writes to a file, seeking past blocks of zeros rather than
+// writing them, leaving holes in the file on filesystems that support them.
+type sparseWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// split the data on block boundaries of the file's offset
+		n := sparseBlockSize - int(w.offset%sparseBlockSize)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if n == sparseBlockSize && isZero(p[:n]) {
+			if _, err := w.f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := w.f.Write(p[:n]); err != nil {
+			return written, err
+		}
+
+		w.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// finish truncates the file to the size written, extending it if it ends with
+// a hole.
+func (w *sparseWriter) finish() error {
+	return w.f.Truncate(w.offset)
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
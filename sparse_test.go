@@ -0,0 +1,62 @@
+//go:build !windows
+// +build !windows
+
+package fastzip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func allocatedSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestExtractorSparse(t *testing.T) {
+	zeros := strings.Repeat("\x00", 1024*1024)
+	testFiles := map[string]testFile{
+		"sparse":   {mode: 0666, contents: zeros + "data" + zeros + "data" + zeros},
+		"unsparse": {mode: 0666, contents: strings.Repeat("data", 1024)},
+		"empty":    {mode: 0666},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	// holes are only created on filesystems that support them
+	control := filepath.Join(t.TempDir(), "control")
+	require.NoError(t, os.WriteFile(control, nil, 0666))
+	require.NoError(t, os.Truncate(control, int64(len(zeros))))
+	supported := allocatedSize(t, control) < int64(len(zeros))
+
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		testCreateArchive(t, dir, files, func(filename, chroot string) {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out, WithExtractorSparse(true))
+			require.NoError(t, err)
+			defer e.Close()
+			require.NoError(t, e.Extract(context.Background()))
+
+			for name, tf := range testFiles {
+				contents, err := os.ReadFile(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, tf.contents, string(contents), name)
+			}
+
+			if supported {
+				assert.Less(t, allocatedSize(t, filepath.Join(out, "sparse")), int64(len(zeros)))
+			}
+		}, WithArchiverMethod(method))
+	}
+}
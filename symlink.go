@@ -0,0 +1,122 @@
+package fastzip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinkHops is the maximum number of symlinks followed when resolving a
+// path, matching Linux's limit.
+const maxSymlinkHops = 40
+
+// resolveSymlinkSafely resolves all symlinks in path, which must be absolute,
+// returning an error wrapping ErrSymlinkLoop if more than maxSymlinkHops
+// symlinks are followed, such as for a cycle, or ErrUnsafeSymlink if the
+// resolved path is outside of the chroot. The chroot itself may be beneath a
+// symlink.
+func resolveSymlinkSafely(path, chroot string) (string, error) {
+	resolved, err := resolveSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	if within(chroot, resolved) {
+		return resolved, nil
+	}
+
+	root, err := resolveSymlinks(chroot)
+	if err != nil {
+		return "", err
+	}
+	if !within(root, resolved) {
+		return "", fmt.Errorf("%s resolves outside of chroot (%s): %w", path, chroot, ErrUnsafeSymlink)
+	}
+
+	return resolved, nil
+}
+
+// resolveSymlinks resolves all symlinks in path, which must be absolute, like
+// filepath.EvalSymlinks, but follows at most maxSymlinkHops symlinks.
+func resolveSymlinks(path string) (string, error) {
+	return resolvePath(filepath.Clean(path), false)
+}
+
+// resolveExisting resolves the symlinks in path, which must be absolute, like
+// resolveSymlinks, but joins elements that don't exist yet as they are. The
+// path isn't cleaned first, so ".." elements apply to the path resolved so
+// far, rather than lexically.
+func resolveExisting(path string) (string, error) {
+	return resolvePath(path, true)
+}
+
+// resolvePath resolves path one element at a time, following symlinks as
+// they're found. If missing is true, elements that don't exist, or are beneath
+// a file that isn't a directory, are joined without being resolved.
+func resolvePath(path string, missing bool) (string, error) {
+	const sep = string(filepath.Separator)
+
+	volume := filepath.VolumeName(path)
+	resolved := volume + sep
+	rest := path[len(volume):]
+
+	hops := 0
+	for rest != "" {
+		var elem string
+		rest = strings.TrimLeft(rest, sep)
+		if idx := strings.Index(rest, sep); idx >= 0 {
+			elem, rest = rest[:idx], rest[idx+1:]
+		} else {
+			elem, rest = rest, ""
+		}
+
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, elem)
+		fi, err := os.Lstat(next)
+		if missing && (os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("%s: %w", path, ErrSymlinkLoop)
+		}
+
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+
+		// absolute targets restart resolution from their root, on the same
+		// volume if they don't specify one
+		link = filepath.FromSlash(link)
+		if filepath.IsAbs(link) || strings.HasPrefix(link, sep) {
+			if v := filepath.VolumeName(link); v != "" {
+				volume = v
+			}
+			resolved = volume + sep
+			link = link[len(filepath.VolumeName(link)):]
+		}
+		rest = link + sep + rest
+	}
+
+	return resolved, nil
+}
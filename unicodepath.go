@@ -0,0 +1,62 @@
+package fastzip
+
+import (
+	"hash/crc32"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/saracen/zipextra"
+)
+
+// extraFieldUnicodePath is the Info-ZIP Unicode Path extra field identifier.
+// The field holds a version byte, the CRC32 of the name in the header and the
+// UTF-8 encoded name. Tools that don't support the UTF-8 general purpose flag
+// can still use it to recover the name.
+const extraFieldUnicodePath uint16 = 0x7075
+
+const unicodePathVersion = 1
+
+// storeUnicodePath adds the Unicode Path extra field to headers with names
+// that require UTF-8.
+func storeUnicodePath(hdr *zip.FileHeader) {
+	valid, require := detectUTF8(hdr.Name)
+	if !valid || !require {
+		return
+	}
+
+	buf := zipextra.NewBuffer([]byte{})
+	done := buf.WriteHeader(extraFieldUnicodePath)
+	buf.Write8(unicodePathVersion)
+	buf.Write32(crc32.ChecksumIEEE([]byte(hdr.Name)))
+	buf.WriteBytes([]byte(hdr.Name))
+	done()
+
+	hdr.Extra = append(hdr.Extra, buf.Bytes()...)
+}
+
+// unicodePath returns the name stored in a file's Unicode Path extra field,
+// falling back to the header's name if the field is missing, or is stale
+// because the header's name has been changed since it was written.
+func unicodePath(file *zip.File) string {
+	fields, err := zipextra.Parse(file.Extra)
+	if err != nil {
+		return file.Name
+	}
+
+	field, ok := fields[extraFieldUnicodePath]
+	if !ok || len(field) < 5 {
+		return file.Name
+	}
+
+	buf := zipextra.NewBuffer(field)
+	if buf.Read8() != unicodePathVersion || buf.Read32() != crc32.ChecksumIEEE([]byte(file.Name)) {
+		return file.Name
+	}
+
+	name := buf.Bytes()
+	if len(name) == 0 || !utf8.Valid(name) {
+		return file.Name
+	}
+
+	return string(name)
+}
@@ -2,8 +2,16 @@ package fastzip
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"hash"
 	"io"
+	"math"
+	"strings"
+	"sync"
 	"sync/atomic"
+
+	"github.com/klauspost/compress/zip"
 )
 
 func dclose(c io.Closer, err *error) {
@@ -18,6 +26,103 @@ func incOnSuccess(inc *int64, err error) {
 	}
 }
 
+// removeExtraFields returns a copy of the extra fields provided, without the
+// fields of the IDs provided.
+func removeExtraFields(extra []byte, ids ...uint16) []byte {
+	var out []byte
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := 4 + int(binary.LittleEndian.Uint16(extra[2:]))
+		if size > len(extra) {
+			size = len(extra)
+		}
+
+		remove := false
+		for _, v := range ids {
+			remove = remove || id == v
+		}
+		if !remove {
+			out = append(out, extra[:size]...)
+		}
+		extra = extra[size:]
+	}
+	return out
+}
+
+// EntryError is an error encountered whilst processing a specific entry.
+type EntryError struct {
+	Name string
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is a collection of errors, each an *EntryError.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the collected errors, for errors.Is and errors.As on Go 1.20
+// and later.
+func (e MultiError) Unwrap() []error {
+	return e
+}
+
+// Is reports whether any of the collected errors matches target, for use with
+// errors.Is on earlier versions of Go.
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first collected error that matches target, for use with
+// errors.As on earlier versions of Go.
+func (e MultiError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryErrors collects entry errors concurrently.
+type entryErrors struct {
+	m    sync.Mutex
+	errs MultiError
+}
+
+// handle returns err unmodified if errors are not being collected, otherwise
+// the error is collected and nil is returned.
+func (e *entryErrors) handle(collect bool, name string, err error) error {
+	if !collect {
+		return err
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	e.errs = append(e.errs, &EntryError{Name: name, Err: err})
+	return nil
+}
+
 type countWriter struct {
 	w       io.Writer
 	written *int64
@@ -32,3 +137,64 @@ func (w countWriter) Write(p []byte) (n int, err error) {
 	}
 	return n, err
 }
+
+// checksumReader verifies the size and CRC32 of data read against that of the
+// file's header.
+type checksumReader struct {
+	r     io.Reader
+	hash  hash.Hash32
+	nread uint64
+	file  *zip.File
+}
+
+func (r *checksumReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.hash.Write(p[:n])
+	r.nread += uint64(n)
+	if r.nread > r.file.UncompressedSize64 {
+		return 0, zip.ErrFormat
+	}
+	if err != io.EOF {
+		return n, err
+	}
+
+	if r.nread != r.file.UncompressedSize64 {
+		return n, zip.ErrFormat
+	}
+	if r.file.CRC32 != 0 && r.hash.Sum32() != r.file.CRC32 {
+		return n, zip.ErrChecksum
+	}
+
+	return n, io.EOF
+}
+
+func (r *checksumReader) Close() error {
+	return nil
+}
+
+// histogram counts the occurrences of each byte written.
+type histogram struct {
+	counts [256]uint64
+	total  uint64
+}
+
+func (h *histogram) Write(p []byte) (int, error) {
+	for _, b := range p {
+		h.counts[b]++
+	}
+	h.total += uint64(len(p))
+	return len(p), nil
+}
+
+// entropy returns the Shannon entropy in bits per byte.
+func (h *histogram) entropy() float64 {
+	var entropy float64
+	for _, count := range h.counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(h.total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
@@ -0,0 +1,68 @@
+package fastzip
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/saracen/zipextra"
+)
+
+// ErrXattrUnsupported is returned when extended attributes are requested on a
+// platform that doesn't support them.
+var ErrXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// extraFieldXattr is the extra field identifier used for extended attributes.
+// The field holds a sequence of entries, each consisting of a uint16 name
+// length, the name, a uint16 value length and the value.
+const extraFieldXattr uint16 = 0x7861
+
+const maxExtraFieldSize = 0xffff
+
+type xattr struct {
+	name  string
+	value []byte
+}
+
+func encodeXattrs(attrs []xattr) ([]byte, error) {
+	buf := zipextra.NewBuffer([]byte{})
+	defer buf.WriteHeader(extraFieldXattr)()
+
+	for _, attr := range attrs {
+		buf.Write16(uint16(len(attr.name)))
+		buf.WriteBytes([]byte(attr.name))
+		buf.Write16(uint16(len(attr.value)))
+		buf.WriteBytes(attr.value)
+	}
+
+	if len(buf.Bytes()) > maxExtraFieldSize {
+		return nil, fmt.Errorf("extended attributes exceed maximum extra field size")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeXattrs(ef zipextra.ExtraField) ([]xattr, error) {
+	var attrs []xattr
+
+	buf := zipextra.NewBuffer(ef)
+	for buf.Available() > 0 {
+		if buf.Available() < 2 {
+			return nil, zipextra.ErrInvalidExtraFieldFormat
+		}
+		size := int(buf.Read16())
+		if buf.Available() < size+2 {
+			return nil, zipextra.ErrInvalidExtraFieldFormat
+		}
+		name := string(buf.ReadBytes(size))
+
+		size = int(buf.Read16())
+		if buf.Available() < size {
+			return nil, zipextra.ErrInvalidExtraFieldFormat
+		}
+		value := append([]byte{}, buf.ReadBytes(size)...)
+
+		attrs = append(attrs, xattr{name, value})
+	}
+
+	return attrs, nil
+}
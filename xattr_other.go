@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package fastzip
+
+const xattrSupported = false
+
+func lgetxattrs(path string) ([]xattr, error) {
+	return nil, ErrXattrUnsupported
+}
+
+func lsetxattrs(path string, attrs []xattr) error {
+	return ErrXattrUnsupported
+}
@@ -0,0 +1,70 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fastzip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestArchiveExtractXattrs(t *testing.T) {
+	testFiles := map[string]testFile{
+		"foo.go": {mode: 0666, contents: "foo"},
+		"bar.go": {mode: 0666, contents: "bar"},
+	}
+
+	files, dir := testCreateFiles(t, testFiles)
+	defer os.RemoveAll(dir)
+
+	err := unix.Setxattr(filepath.Join(dir, "foo.go"), "user.fastzip", []byte("hello"), 0)
+	if err == unix.ENOTSUP || err == unix.EPERM {
+		t.Skip("extended attributes not supported by filesystem")
+	}
+	require.NoError(t, err)
+
+	testCreateArchive(t, dir, files, func(filename, chroot string) {
+		for _, restore := range []bool{false, true} {
+			out := t.TempDir()
+			e, err := NewExtractor(filename, out, WithExtractorRestoreXattrs(restore))
+			require.NoError(t, err)
+			require.NoError(t, e.Extract(context.Background()))
+			require.NoError(t, e.Close())
+
+			value, err := lgetxattr(filepath.Join(out, "foo.go"), "user.fastzip")
+			if restore {
+				require.NoError(t, err)
+				assert.Equal(t, "hello", string(value))
+			} else {
+				assert.Error(t, err)
+			}
+
+			attrs, err := lgetxattrs(filepath.Join(out, "bar.go"))
+			require.NoError(t, err)
+			assert.Empty(t, attrs)
+		}
+	}, WithArchiverStoreXattrs(true))
+}
+
+func TestXattrsEncodeDecode(t *testing.T) {
+	attrs := []xattr{
+		{"user.a", []byte("1")},
+		{"user.empty", []byte{}},
+	}
+
+	extra, err := encodeXattrs(attrs)
+	require.NoError(t, err)
+
+	decoded, err := decodeXattrs(extra[4:])
+	require.NoError(t, err)
+	assert.Equal(t, attrs, decoded)
+
+	_, err = decodeXattrs(extra[4 : len(extra)-2])
+	assert.Error(t, err)
+}
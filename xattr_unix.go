@@ -0,0 +1,87 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fastzip
+
+import (
+	"bytes"
+	"os"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+const xattrSupported = true
+
+func lgetxattrs(path string) ([]xattr, error) {
+	var buf []byte
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf = make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+		}
+		buf = buf[:size]
+		break
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+
+	attrs := make([]xattr, 0, len(names))
+	for _, name := range names {
+		value, err := lgetxattr(path, name)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, xattr{name, value})
+	}
+
+	return attrs, nil
+}
+
+func lgetxattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: err}
+		}
+
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, value)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: err}
+		}
+
+		return value[:size], nil
+	}
+}
+
+func lsetxattrs(path string, attrs []xattr) error {
+	for _, attr := range attrs {
+		if err := unix.Lsetxattr(path, attr.name, attr.value, 0); err != nil {
+			return &os.PathError{Op: "lsetxattr", Path: path, Err: err}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package fastzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	uint16max = (1 << 16) - 1
+	uint32max = (1 << 32) - 1
+
+	directoryHeaderSignature = 0x02014b50
+	directoryEndSignature    = 0x06054b50
+	directory64LocSignature  = 0x07064b50
+	directory64EndSignature  = 0x06064b50
+
+	directoryHeaderLen = 46
+	directoryEndLen    = 22
+	directory64LocLen  = 20
+	directory64EndLen  = 56
+
+	zip64ExtraID  = 0x0001
+	zip64ExtraLen = 28
+	zipVersion45  = 45
+)
+
+var errZip64Directory = errors.New("zip64: invalid central directory")
+
+// zip64Writer passes data through to the underlying writer until finishing,
+// when the central directory written by zip.Writer's Close is buffered so
+// that it can be rewritten to unconditionally use the ZIP64 format.
+type zip64Writer struct {
+	w   io.Writer
+	buf *bytes.Buffer
+}
+
+func (z *zip64Writer) Write(p []byte) (int, error) {
+	if z.buf != nil {
+		return z.buf.Write(p)
+	}
+	return z.w.Write(p)
+}
+
+// finish rewrites the buffered central directory, adding a ZIP64 extra field
+// to each entry that doesn't already have one, followed by the ZIP64 end of
+// central directory record and locator, and writes it to the underlying
+// writer. Data buffered before the central directory, such as the last
+// entry's data descriptor, is written unmodified.
+func (z *zip64Writer) finish() error {
+	b := z.buf.Bytes()
+	z.buf = nil
+
+	eocd := findDirectoryEnd(b)
+	if eocd < 0 {
+		return errZip64Directory
+	}
+
+	records := uint64(binary.LittleEndian.Uint16(b[eocd+10:]))
+	size := uint64(binary.LittleEndian.Uint32(b[eocd+12:]))
+	offset := uint64(binary.LittleEndian.Uint32(b[eocd+16:]))
+	comment := b[eocd+directoryEndLen:]
+
+	// zip.Writer already wrote ZIP64 end records if they were required
+	dirEnd := eocd
+	if records == uint16max || size == uint32max || offset == uint32max {
+		dirEnd = eocd - directory64LocLen - directory64EndLen
+		if dirEnd < 0 || binary.LittleEndian.Uint32(b[dirEnd:]) != directory64EndSignature {
+			return errZip64Directory
+		}
+		records = binary.LittleEndian.Uint64(b[dirEnd+32:])
+		size = binary.LittleEndian.Uint64(b[dirEnd+40:])
+		offset = binary.LittleEndian.Uint64(b[dirEnd+48:])
+	}
+
+	dirStart := dirEnd - int(size)
+	if dirStart < 0 {
+		return errZip64Directory
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(b)+int(records)*zip64ExtraLen+directory64EndLen+directory64LocLen))
+	out.Write(b[:dirStart])
+
+	for dir := b[dirStart:dirEnd]; len(dir) > 0; {
+		if len(dir) < directoryHeaderLen || binary.LittleEndian.Uint32(dir) != directoryHeaderSignature {
+			return errZip64Directory
+		}
+
+		nameLen := int(binary.LittleEndian.Uint16(dir[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(dir[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(dir[32:]))
+		n := directoryHeaderLen + nameLen + extraLen + commentLen
+		if len(dir) < n {
+			return errZip64Directory
+		}
+
+		// zip.Writer sets all of the fields to the maximum when it adds the
+		// ZIP64 extra field itself
+		if binary.LittleEndian.Uint32(dir[20:]) == uint32max {
+			out.Write(dir[:n])
+			dir = dir[n:]
+			continue
+		}
+
+		if extraLen+zip64ExtraLen > uint16max {
+			return errors.New("zip64: extra field too long")
+		}
+
+		var hdr [directoryHeaderLen]byte
+		copy(hdr[:], dir)
+		if binary.LittleEndian.Uint16(hdr[6:]) < zipVersion45 {
+			binary.LittleEndian.PutUint16(hdr[6:], zipVersion45)
+		}
+		compressed := binary.LittleEndian.Uint32(hdr[20:])
+		uncompressed := binary.LittleEndian.Uint32(hdr[24:])
+		headerOffset := binary.LittleEndian.Uint32(hdr[42:])
+		binary.LittleEndian.PutUint32(hdr[20:], uint32max)
+		binary.LittleEndian.PutUint32(hdr[24:], uint32max)
+		binary.LittleEndian.PutUint32(hdr[42:], uint32max)
+		binary.LittleEndian.PutUint16(hdr[30:], uint16(extraLen+zip64ExtraLen))
+
+		var extra [zip64ExtraLen]byte
+		binary.LittleEndian.PutUint16(extra[0:], zip64ExtraID)
+		binary.LittleEndian.PutUint16(extra[2:], zip64ExtraLen-4)
+		binary.LittleEndian.PutUint64(extra[4:], uint64(uncompressed))
+		binary.LittleEndian.PutUint64(extra[12:], uint64(compressed))
+		binary.LittleEndian.PutUint64(extra[20:], uint64(headerOffset))
+
+		out.Write(hdr[:])
+		out.Write(dir[directoryHeaderLen : directoryHeaderLen+nameLen+extraLen])
+		out.Write(extra[:])
+		out.Write(dir[directoryHeaderLen+nameLen+extraLen : n])
+		dir = dir[n:]
+	}
+
+	size = uint64(out.Len() - dirStart)
+	end := offset + size
+
+	var records64 [directory64EndLen + directory64LocLen]byte
+	r := records64[:]
+	binary.LittleEndian.PutUint32(r[0:], directory64EndSignature)
+	binary.LittleEndian.PutUint64(r[4:], directory64EndLen-12)
+	binary.LittleEndian.PutUint16(r[12:], zipVersion45)
+	binary.LittleEndian.PutUint16(r[14:], zipVersion45)
+	binary.LittleEndian.PutUint64(r[24:], records)
+	binary.LittleEndian.PutUint64(r[32:], records)
+	binary.LittleEndian.PutUint64(r[40:], size)
+	binary.LittleEndian.PutUint64(r[48:], offset)
+
+	r = r[directory64EndLen:]
+	binary.LittleEndian.PutUint32(r[0:], directory64LocSignature)
+	binary.LittleEndian.PutUint64(r[8:], end)
+	binary.LittleEndian.PutUint32(r[16:], 1)
+	out.Write(records64[:])
+
+	var eocdRecord [directoryEndLen]byte
+	binary.LittleEndian.PutUint32(eocdRecord[0:], directoryEndSignature)
+	binary.LittleEndian.PutUint16(eocdRecord[8:], uint16max)
+	binary.LittleEndian.PutUint16(eocdRecord[10:], uint16max)
+	binary.LittleEndian.PutUint32(eocdRecord[12:], uint32max)
+	binary.LittleEndian.PutUint32(eocdRecord[16:], uint32max)
+	binary.LittleEndian.PutUint16(eocdRecord[20:], uint16(len(comment)))
+	out.Write(eocdRecord[:])
+	out.Write(comment)
+
+	_, err := out.WriteTo(z.w)
+	return err
+}
+
+// findDirectoryEnd returns the offset of the end of central directory record,
+// or -1 if not found.
+func findDirectoryEnd(b []byte) int {
+	for i := len(b) - directoryEndLen; i >= 0 && len(b)-i <= directoryEndLen+uint16max; i-- {
+		if binary.LittleEndian.Uint32(b[i:]) == directoryEndSignature &&
+			int(binary.LittleEndian.Uint16(b[i+20:])) == len(b)-i-directoryEndLen {
+			return i
+		}
+	}
+	return -1
+}